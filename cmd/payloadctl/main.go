@@ -0,0 +1,461 @@
+// Command payloadctl stores, fetches, deletes and inspects offloaded payloads with an S3BackedPayloadStore, so
+// operators can debug stuck messages without hand-crafting aws s3 commands from pointers.
+//
+// Usage:
+//
+//	payloadctl store [flags] [file]     store the file, or stdin, and print its pointer
+//	payloadctl get [flags] <pointer>    print the payload the pointer refers to
+//	payloadctl delete [flags] <pointer> delete the payload the pointer refers to
+//	payloadctl inspect [flags] <pointer> decode the pointer, show the object metadata and verify the checksum
+//	payloadctl resolve [flags] [file...] replace the pointers in SQS message dumps by their payloads
+//
+// A pointer argument of "-" is read from stdin. Pointers in any format of payload.DefaultPointerCodecs are accepted.
+// Credentials and the region are loaded like the AWS CLI does, from the environment, the shared config and credentials
+// files (with the profile of -profile or AWS_PROFILE), SSO, or the ECS or EC2 instance role. -region overrides the
+// region.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/threehook/aws-payload-offloading-go/config"
+	"github.com/threehook/aws-payload-offloading-go/encryption"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	s3dao "github.com/threehook/aws-payload-offloading-go/s3"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: payloadctl <command> [flags] [arguments]
+
+Commands:
+  store [file]       store the file, or stdin, and print its pointer
+  get <pointer>      print the payload the pointer refers to
+  delete <pointer>   delete the payload the pointer refers to
+  inspect <pointer>  decode the pointer, show the object metadata and verify the checksum
+  resolve [file...]  replace the pointers in SQS message dumps, or stdin, by their payloads
+
+A pointer argument of "-" is read from stdin. Run "payloadctl <command> -h" for the flags of a command.
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// options holds the flags shared by all commands. They map onto config.PayloadStorageConfig and the optional fields of
+// payload.S3BackedPayloadStore.
+type options struct {
+	bucket          string
+	region          string
+	profile         string
+	endpoint        string
+	kmsKeyId        string
+	awsManagedKms   bool
+	acl             string
+	codec           string
+	contentType     string
+	contentEncoding string
+	ttl             time.Duration
+	createOnly      bool
+	key             string
+	noVerify        bool
+	parallel        int
+	detectPointers  bool
+	verbose         bool
+}
+
+// run executes the command of args and returns the exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	command := args[0]
+	if command == "-h" || command == "-help" || command == "help" {
+		fmt.Fprint(stdout, usage)
+		return 0
+	}
+
+	var opts options
+	flags := flag.NewFlagSet("payloadctl "+command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&opts.bucket, "bucket", "", "S3 bucket to store payloads in")
+	flags.StringVar(&opts.region, "region", "", "AWS region of the bucket, by default the region of the profile")
+	flags.StringVar(&opts.profile, "profile", "", "shared config profile to load credentials and the region from")
+	flags.StringVar(&opts.endpoint, "endpoint", "", "custom S3 endpoint URL, requests use path-style addressing")
+	flags.StringVar(&opts.kmsKeyId, "sse-kms-key-id", "", "encrypt stored objects with this KMS key")
+	flags.BoolVar(&opts.awsManagedKms, "sse-kms", false, "encrypt stored objects with the AWS managed KMS key")
+	flags.StringVar(&opts.acl, "acl", "", "canned ACL of stored objects")
+	flags.BoolVar(&opts.verbose, "v", false, "log the S3 operations")
+	switch command {
+	case "store":
+		flags.StringVar(&opts.codec, "codec", "json", "pointer format: json, java, uri or binary")
+		flags.StringVar(&opts.contentType, "content-type", "", "content type of the stored object")
+		flags.StringVar(&opts.contentEncoding, "content-encoding", "", "content encoding of the stored object")
+		flags.DurationVar(&opts.ttl, "ttl", 0, "expire the payload after this duration")
+		flags.BoolVar(&opts.createOnly, "create-only", false, "fail instead of overwriting an existing object")
+		flags.StringVar(&opts.key, "key", "", "S3 key to store the payload under, a random key is used by default")
+	case "inspect":
+		flags.BoolVar(&opts.noVerify, "no-verify", false, "do not download the payload to verify its checksum")
+	case "resolve":
+		flags.IntVar(&opts.parallel, "parallel", 1, "number of payloads to fetch concurrently")
+		flags.BoolVar(&opts.detectPointers, "detect-pointers", false, "also resolve JSON and Java pointers in messages without a payload size attribute")
+	case "get", "delete":
+	default:
+		fmt.Fprintf(stderr, "payloadctl: unknown command %q\n\n%s", command, usage)
+		return 2
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if !opts.verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	var err error
+	switch command {
+	case "store":
+		err = store(flags.Args(), &opts, stdin, stdout)
+	case "get":
+		err = get(flags.Args(), &opts, stdin, stdout)
+	case "delete":
+		err = remove(flags.Args(), &opts, stdin)
+	case "resolve":
+		err = resolve(flags.Args(), &opts, stdin, stdout, stderr)
+	case "inspect":
+		var ok bool
+		ok, err = inspect(flags.Args(), &opts, stdin, stdout)
+		if err == nil && !ok {
+			return 1
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "payloadctl %s: %v\n", command, err)
+		return 1
+	}
+	return 0
+}
+
+func store(args []string, opts *options, stdin io.Reader, stdout io.Writer) error {
+	if opts.bucket == "" {
+		return errors.New("-bucket is required")
+	}
+	if len(args) > 1 {
+		return errors.New("expected at most one file")
+	}
+	in := stdin
+	if len(args) == 1 && args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	content, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	payloadStore, err := newPayloadStore(opts)
+	if err != nil {
+		return err
+	}
+	if err := payloadStore.Validate(); err != nil {
+		return err
+	}
+	var payloadPointer string
+	if opts.key != "" {
+		payloadPointer, err = payloadStore.StoreOriginalPayloadForS3Key(string(content), opts.key)
+	} else {
+		payloadPointer, err = payloadStore.StoreOriginalPayload(string(content))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(stdout, payloadPointer)
+	return err
+}
+
+func get(args []string, opts *options, stdin io.Reader, stdout io.Writer) error {
+	payloadPointer, err := pointerArg(args, stdin)
+	if err != nil {
+		return err
+	}
+	payloadStore, err := newPayloadStore(opts)
+	if err != nil {
+		return err
+	}
+	originalPayload, err := payloadStore.GetOriginalPayload(payloadPointer)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(stdout, originalPayload)
+	return err
+}
+
+func remove(args []string, opts *options, stdin io.Reader) error {
+	payloadPointer, err := pointerArg(args, stdin)
+	if err != nil {
+		return err
+	}
+	payloadStore, err := newPayloadStore(opts)
+	if err != nil {
+		return err
+	}
+	return payloadStore.DeleteOriginalPayload(payloadPointer)
+}
+
+// inspection is the report printed by inspect.
+type inspection struct {
+	Format   string                    `json:"format"`
+	Pointer  *payload.PayloadS3Pointer `json:"pointer"`
+	Expired  bool                      `json:"expired,omitempty"`
+	Exists   bool                      `json:"exists"`
+	Object   *objectInfo               `json:"object,omitempty"`
+	Checksum string                    `json:"checksum"`
+	Problems []string                  `json:"problems,omitempty"`
+}
+
+type objectInfo struct {
+	Size            int64             `json:"size"`
+	ContentType     string            `json:"contentType,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	ETag            string            `json:"eTag,omitempty"`
+	VersionId       string            `json:"versionId,omitempty"`
+	LastModified    time.Time         `json:"lastModified"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// Checksum results reported by inspect
+const (
+	checksumValid       = "valid"
+	checksumMismatch    = "mismatch"
+	checksumNotRecorded = "not recorded"
+	checksumNotVerified = "not verified"
+)
+
+// inspect prints an inspection of the pointer and reports whether the payload it refers to is intact.
+func inspect(args []string, opts *options, stdin io.Reader, stdout io.Writer) (bool, error) {
+	payloadPointer, err := pointerArg(args, stdin)
+	if err != nil {
+		return false, err
+	}
+	s3Pointer, err := payload.ParsePointer(payloadPointer)
+	if err != nil {
+		return false, err
+	}
+	if opts.bucket == "" {
+		opts.bucket = s3Pointer.S3BucketName
+	}
+	dao, err := newS3Dao(opts)
+	if err != nil {
+		return false, err
+	}
+
+	report := inspection{Format: pointerFormat(payloadPointer), Pointer: s3Pointer, Checksum: checksumNotVerified}
+	report.Expired = s3Pointer.ExpiresAt != nil && !time.Now().Before(*s3Pointer.ExpiresAt)
+	if report.Expired {
+		report.Problems = append(report.Problems, "the pointer has expired")
+	}
+
+	metadata, err := objectMetadata(dao, s3Pointer)
+	if err != nil {
+		return false, err
+	}
+	report.Exists = metadata != nil
+	if metadata == nil {
+		report.Problems = append(report.Problems, "the object does not exist")
+	} else {
+		report.Object = &objectInfo{
+			Size:            metadata.Size,
+			ContentType:     metadata.ContentType,
+			ContentEncoding: metadata.ContentEncoding,
+			ETag:            metadata.ETag,
+			VersionId:       metadata.VersionId,
+			LastModified:    metadata.LastModified,
+			Metadata:        metadata.Metadata,
+		}
+		if s3Pointer.Size != 0 && s3Pointer.Size != metadata.Size {
+			report.Problems = append(report.Problems, fmt.Sprintf("the object size %d differs from the pointer size %d", metadata.Size, s3Pointer.Size))
+		}
+		if s3Pointer.ETag != "" && s3Pointer.ETag != metadata.ETag {
+			report.Problems = append(report.Problems, "the object ETag differs from the pointer ETag")
+		}
+
+		switch {
+		case s3Pointer.SHA256 == "":
+			report.Checksum = checksumNotRecorded
+		case !opts.noVerify:
+			originalPayload, err := dao.GetTextFromS3Version(s3Pointer.S3BucketName, s3Pointer.S3Key, s3Pointer.VersionId)
+			if err != nil {
+				return false, err
+			}
+			sum := sha256.Sum256([]byte(originalPayload))
+			if hex.EncodeToString(sum[:]) == s3Pointer.SHA256 {
+				report.Checksum = checksumValid
+			} else {
+				report.Checksum = checksumMismatch
+				report.Problems = append(report.Problems, "the payload checksum differs from the pointer checksum")
+			}
+		}
+	}
+
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return false, err
+	}
+	return len(report.Problems) == 0, nil
+}
+
+// objectMetadata returns the metadata of the object version s3Pointer refers to, or nil when it does not exist.
+func objectMetadata(dao *s3dao.S3Dao, s3Pointer *payload.PayloadS3Pointer) (*s3dao.ObjectMetadata, error) {
+	metadata, err := dao.GetObjectMetadataFromS3(s3Pointer.S3BucketName, s3Pointer.S3Key)
+	if err != nil || metadata == nil || s3Pointer.VersionId == "" || metadata.VersionId == s3Pointer.VersionId {
+		return metadata, err
+	}
+	// The pointer refers to an older version, which exists when it can still be read
+	originalPayload, err := dao.GetTextFromS3Version(s3Pointer.S3BucketName, s3Pointer.S3Key, s3Pointer.VersionId)
+	if err != nil {
+		return nil, nil
+	}
+	return &s3dao.ObjectMetadata{Size: int64(len(originalPayload)), VersionId: s3Pointer.VersionId}, nil
+}
+
+// pointerFormat names the format of payloadPointer.
+func pointerFormat(payloadPointer string) string {
+	for _, codec := range payload.DefaultPointerCodecs {
+		if !codec.Detect(payloadPointer) {
+			continue
+		}
+		switch codec.(type) {
+		case *payload.JsonPointerCodec:
+			return "json"
+		case *payload.JavaPointerCodec:
+			return "java"
+		case *payload.URIPointerCodec:
+			return "uri"
+		case *payload.BinaryPointerCodec:
+			return "binary"
+		}
+	}
+	return "unknown"
+}
+
+// pointerArg returns the pointer given as the only argument, or read from stdin when it is "-".
+func pointerArg(args []string, stdin io.Reader) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("expected a single pointer argument")
+	}
+	if args[0] != "-" {
+		return args[0], nil
+	}
+	content, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// storageConfig returns the PayloadStorageConfig described by the flags.
+func storageConfig(opts *options) (*config.PayloadStorageConfig, error) {
+	client, err := newS3Client(opts)
+	if err != nil {
+		return nil, err
+	}
+	psc := &config.PayloadStorageConfig{ObjectCannedACL: types.ObjectCannedACL(opts.acl)}
+	switch {
+	case opts.kmsKeyId != "":
+		psc.ServerSideEncryptionStrategy = &encryption.CustomerKey{AwsKmsKeyId: opts.kmsKeyId}
+	case opts.awsManagedKms:
+		psc.ServerSideEncryptionStrategy = &encryption.AwsManagedCmk{}
+	}
+	if err := psc.SetPayloadSupportEnabled(client, opts.bucket); err != nil {
+		return nil, err
+	}
+	return psc, nil
+}
+
+func newS3Dao(opts *options) (*s3dao.S3Dao, error) {
+	psc, err := storageConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &s3dao.S3Dao{
+		S3Client:                     psc.S3Client,
+		ServerSideEncryptionStrategy: psc.ServerSideEncryptionStrategy,
+		ObjectCannedACL:              psc.ObjectCannedACL,
+	}, nil
+}
+
+func newPayloadStore(opts *options) (*payload.S3BackedPayloadStore, error) {
+	codecs := map[string]payload.PointerCodec{
+		"json":   &payload.JsonPointerCodec{},
+		"java":   &payload.JavaPointerCodec{},
+		"uri":    &payload.URIPointerCodec{},
+		"binary": &payload.BinaryPointerCodec{},
+	}
+	codec, ok := codecs[opts.codec]
+	if opts.codec != "" && !ok {
+		return nil, fmt.Errorf("unknown pointer format %q", opts.codec)
+	}
+	dao, err := newS3Dao(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &payload.S3BackedPayloadStore{
+		S3BucketName:    opts.bucket,
+		S3Dao:           dao,
+		PointerCodec:    codec,
+		ContentType:     opts.contentType,
+		ContentEncoding: opts.contentEncoding,
+		Region:          opts.region,
+		TTL:             opts.ttl,
+		CreateOnly:      opts.createOnly,
+	}, nil
+}
+
+// newS3Client returns an S3 client with the default AWS configuration, and sets opts.region to its region when -region
+// is not given.
+func newS3Client(opts *options) (*s3.Client, error) {
+	var loadOptions []func(*awsconfig.LoadOptions) error
+	if opts.profile != "" {
+		loadOptions = append(loadOptions, awsconfig.WithSharedConfigProfile(opts.profile))
+	}
+	if opts.region != "" {
+		loadOptions = append(loadOptions, awsconfig.WithRegion(opts.region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), loadOptions...)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Region == "" {
+		return nil, errors.New("-region, AWS_REGION or a profile with a region is required")
+	}
+	opts.region = cfg.Region
+
+	return s3.NewFromConfig(cfg, func(options *s3.Options) {
+		if opts.endpoint != "" {
+			region := opts.region
+			options.EndpointResolver = s3.EndpointResolverFromURL(opts.endpoint, func(e *aws.Endpoint) { e.SigningRegion = region })
+			options.UsePathStyle = true
+		}
+	}), nil
+}
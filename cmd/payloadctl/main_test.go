@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"github.com/threehook/aws-payload-offloading-go/s3/s3test"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	s3BucketName = "test-bucket-name"
+	anyPayload   = "anyPayload"
+)
+
+func TestMain(m *testing.M) {
+	// Suppress logging in unit tests
+	log.SetOutput(ioutil.Discard)
+	// Load the credentials of the test server, and nothing from the files or instance role of the machine
+	for name, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":           s3test.AccessKeyId,
+		"AWS_SECRET_ACCESS_KEY":       s3test.SecretAccessKey,
+		"AWS_SESSION_TOKEN":           "",
+		"AWS_REGION":                  s3test.Region,
+		"AWS_PROFILE":                 "",
+		"AWS_CONFIG_FILE":             os.DevNull,
+		"AWS_SHARED_CREDENTIALS_FILE": os.DevNull,
+		"AWS_EC2_METADATA_DISABLED":   "true",
+	} {
+		os.Setenv(name, value)
+	}
+	os.Exit(m.Run())
+}
+
+// payloadctl runs the command against server and returns its exit code and output
+func payloadctl(server *s3test.Server, stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	args = append([]string{args[0], "-endpoint", server.URL}, args[1:]...)
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestStoreGetDelete(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+
+	code, stdout, stderr := payloadctl(server, anyPayload, "store", "-bucket", s3BucketName, "-codec", "uri", "-key", "dir/key")
+	assert.Equal(t, 0, code, stderr)
+	payloadPointer := strings.TrimSpace(stdout)
+	assert.True(t, strings.HasPrefix(payloadPointer, "s3://"+s3BucketName+"/dir/key?"))
+
+	code, stdout, stderr = payloadctl(server, "", "get", payloadPointer)
+	assert.Equal(t, 0, code, stderr)
+	assert.Equal(t, anyPayload, stdout)
+
+	code, _, stderr = payloadctl(server, payloadPointer, "delete", "-")
+	assert.Equal(t, 0, code, stderr)
+	assert.Empty(t, server.Keys(s3BucketName))
+
+	code, _, stderr = payloadctl(server, "", "get", payloadPointer)
+	assert.Equal(t, 1, code)
+	assert.NotEmpty(t, stderr)
+}
+
+func TestStoreFromFile(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	file := filepath.Join(t.TempDir(), "payload.json")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(anyPayload), 0600))
+
+	code, stdout, stderr := payloadctl(server, "", "store", "-bucket", s3BucketName, "-content-type", "application/json", file)
+	assert.Equal(t, 0, code, stderr)
+
+	s3Pointer, err := payload.ParsePointer(stdout)
+	assert.NoError(t, err)
+	object, ok := server.Object(s3BucketName, s3Pointer.S3Key)
+	assert.True(t, ok)
+	assert.Equal(t, anyPayload, string(object.Body))
+	assert.Equal(t, "application/json", object.Header.Get("Content-Type"))
+}
+
+func TestInspect(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	_, stdout, _ := payloadctl(server, anyPayload, "store", "-bucket", s3BucketName, "-codec", "binary")
+	payloadPointer := strings.TrimSpace(stdout)
+
+	code, stdout, stderr := payloadctl(server, "", "inspect", payloadPointer)
+	assert.Equal(t, 0, code, stderr)
+	var report inspection
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &report))
+	assert.Equal(t, "binary", report.Format)
+	assert.True(t, report.Exists)
+	assert.Equal(t, int64(len(anyPayload)), report.Object.Size)
+	assert.Equal(t, checksumValid, report.Checksum)
+	assert.Empty(t, report.Problems)
+
+	// Tamper with the object
+	s3Pointer, _ := payload.ParsePointer(payloadPointer)
+	_, _, _ = payloadctl(server, "tampered", "store", "-bucket", s3BucketName, "-key", s3Pointer.S3Key)
+
+	code, stdout, _ = payloadctl(server, "", "inspect", payloadPointer)
+	assert.Equal(t, 1, code)
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &report))
+	assert.Equal(t, checksumMismatch, report.Checksum)
+	assert.Len(t, report.Problems, 3)
+}
+
+func TestInspectMissingObject(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+
+	code, stdout, _ := payloadctl(server, "", "inspect", `["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"test-bucket-name","s3Key":"missing"}]`)
+
+	assert.Equal(t, 1, code)
+	var report inspection
+	assert.NoError(t, json.Unmarshal([]byte(stdout), &report))
+	assert.Equal(t, "java", report.Format)
+	assert.False(t, report.Exists)
+	assert.Equal(t, []string{"the object does not exist"}, report.Problems)
+}
+
+func TestUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 2, run(nil, strings.NewReader(""), &stdout, &stderr))
+	assert.Equal(t, 2, run([]string{"unknown"}, strings.NewReader(""), &stdout, &stderr))
+	assert.Equal(t, 1, run([]string{"store", "-region", "us-east-1"}, strings.NewReader(""), &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "-bucket is required")
+}
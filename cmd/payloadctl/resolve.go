@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"github.com/threehook/aws-payload-offloading-go/util"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Message attributes the SQS extended clients set on messages whose body is a pointer to an offloaded payload. The
+// value is the size of the payload.
+const (
+	extendedPayloadSizeAttribute = "ExtendedPayloadSize"
+	legacyPayloadSizeAttribute   = "SQSLargePayloadSize"
+)
+
+// message is an SQS message as printed by the AWS CLI. Fields other than the body and message attributes are passed
+// through unchanged.
+type message map[string]json.RawMessage
+
+// resolve reads SQS message dumps from the files in args, or from stdin, and writes the messages to stdout as JSON
+// lines, with the bodies of offloaded messages replaced by the payloads they refer to. Like the SQS extended clients,
+// only messages with a payload size attribute are offloaded, unless -detect-pointers is set. The dumps may hold messages
+// one per line or in the {"Messages": [...]} output of aws sqs receive-message.
+func resolve(args []string, opts *options, stdin io.Reader, stdout, stderr io.Writer) error {
+	var messages []message
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+	for _, arg := range args {
+		in := stdin
+		if arg != "-" {
+			file, err := os.Open(arg)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			in = file
+		}
+		read, err := readMessages(in)
+		if err != nil {
+			return fmt.Errorf("%s: %v", arg, err)
+		}
+		messages = append(messages, read...)
+	}
+
+	payloadStore, err := newPayloadStore(opts)
+	if err != nil {
+		return err
+	}
+	errs := util.RunConcurrently(len(messages), opts.parallel, func(i int) error {
+		return resolveMessage(payloadStore, messages[i], opts.detectPointers)
+	})
+
+	failed := 0
+	encoder := json.NewEncoder(stdout)
+	encoder.SetEscapeHTML(false)
+	for i, m := range messages {
+		if errs[i] != nil {
+			failed++
+			var messageId string
+			_ = json.Unmarshal(m["MessageId"], &messageId)
+			fmt.Fprintf(stderr, "payloadctl resolve: message %d (%s): %v\n", i+1, messageId, errs[i])
+		}
+		if err := encoder.Encode(m); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d messages could not be resolved", failed, len(messages))
+	}
+	return nil
+}
+
+// readMessages decodes the messages of a dump, which holds a sequence of messages or of receive-message outputs.
+func readMessages(in io.Reader) ([]message, error) {
+	var messages []message
+	decoder := json.NewDecoder(in)
+	for {
+		var value message
+		err := decoder.Decode(&value)
+		if err == io.EOF {
+			return messages, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if batch, ok := value["Messages"]; ok {
+			var batchMessages []message
+			if err := json.Unmarshal(batch, &batchMessages); err != nil {
+				return nil, err
+			}
+			messages = append(messages, batchMessages...)
+			continue
+		}
+		messages = append(messages, value)
+	}
+}
+
+// resolveMessage replaces the body of m by the payload it points to, when it is offloaded, and removes the payload size
+// attribute. With detectPointers, messages without the attribute are offloaded when their body is a pointer in the JSON
+// or Java format, the formats no plain message is likely to have by accident.
+func resolveMessage(payloadStore payload.PayloadStore, m message, detectPointers bool) error {
+	var body string
+	if err := json.Unmarshal(m["Body"], &body); err != nil {
+		return errors.New("the message has no body")
+	}
+	var attributes map[string]json.RawMessage
+	if raw, ok := m["MessageAttributes"]; ok {
+		if err := json.Unmarshal(raw, &attributes); err != nil {
+			return err
+		}
+	}
+	size, sizeAttribute := payloadSize(attributes)
+	offloaded := sizeAttribute != ""
+	if !offloaded && !(detectPointers && isDetectablePointer(body)) {
+		return nil
+	}
+
+	if _, err := payload.ParsePointer(body); err != nil {
+		if offloaded {
+			return fmt.Errorf("the message has the %s attribute but its body is not a pointer", sizeAttribute)
+		}
+		return nil
+	}
+	originalPayload, err := payloadStore.GetOriginalPayload(body)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && int64(len(originalPayload)) != size {
+		return fmt.Errorf("the payload size %d differs from the size attribute %d", len(originalPayload), size)
+	}
+
+	if m["Body"], err = json.Marshal(originalPayload); err != nil {
+		return err
+	}
+	if offloaded {
+		delete(attributes, extendedPayloadSizeAttribute)
+		delete(attributes, legacyPayloadSizeAttribute)
+		if len(attributes) == 0 {
+			delete(m, "MessageAttributes")
+		} else if m["MessageAttributes"], err = json.Marshal(attributes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDetectablePointer reports whether body is a pointer in the JSON or Java format.
+func isDetectablePointer(body string) bool {
+	for _, codec := range []payload.PointerCodec{&payload.JsonPointerCodec{}, &payload.JavaPointerCodec{}} {
+		if codec.Detect(body) {
+			return true
+		}
+	}
+	return false
+}
+
+// payloadSize returns the payload size recorded in the message attributes, or -1 when it cannot be read, and the name
+// of the attribute marking the message as offloaded, or "" when there is none.
+func payloadSize(attributes map[string]json.RawMessage) (int64, string) {
+	for _, name := range []string{extendedPayloadSizeAttribute, legacyPayloadSizeAttribute} {
+		raw, ok := attributes[name]
+		if !ok {
+			continue
+		}
+		var attribute struct {
+			StringValue string
+		}
+		if err := json.Unmarshal(raw, &attribute); err != nil {
+			return -1, name
+		}
+		size, err := strconv.ParseInt(attribute.StringValue, 10, 64)
+		if err != nil {
+			return -1, name
+		}
+		return size, name
+	}
+	return -1, ""
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/s3/s3test"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// storePayload stores payload on server and returns its pointer
+func storePayload(t *testing.T, server *s3test.Server, payload string) string {
+	code, stdout, stderr := payloadctl(server, payload, "store", "-bucket", s3BucketName)
+	assert.Equal(t, 0, code, stderr)
+	return strings.TrimSpace(stdout)
+}
+
+func decodeMessages(t *testing.T, jsonLines string) []map[string]interface{} {
+	var messages []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(jsonLines), "\n") {
+		var m map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &m))
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+func TestResolveReceiveMessageOutput(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	payloadPointer := storePayload(t, server, anyPayload)
+	pointerBody, _ := json.Marshal(payloadPointer)
+
+	dump := fmt.Sprintf(`{"Messages": [
+		{"MessageId": "1", "Body": %s, "MessageAttributes": {"ExtendedPayloadSize": {"StringValue": "10", "DataType": "Number"}, "Other": {"StringValue": "x", "DataType": "String"}}},
+		{"MessageId": "2", "Body": "not offloaded"}
+	]}`, pointerBody)
+	code, stdout, stderr := payloadctl(server, dump, "resolve", "-parallel", "4")
+
+	assert.Equal(t, 0, code, stderr)
+	messages := decodeMessages(t, stdout)
+	assert.Len(t, messages, 2)
+	assert.Equal(t, anyPayload, messages[0]["Body"])
+	assert.Equal(t, map[string]interface{}{"Other": map[string]interface{}{"StringValue": "x", "DataType": "String"}}, messages[0]["MessageAttributes"])
+	assert.Equal(t, "not offloaded", messages[1]["Body"])
+}
+
+func TestResolveJsonLinesFile(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	var lines []string
+	for i := 0; i < 5; i++ {
+		pointerBody, _ := json.Marshal(storePayload(t, server, fmt.Sprintf("payload %d", i)))
+		lines = append(lines, fmt.Sprintf(`{"MessageId": "%d", "Body": %s, "MessageAttributes": {"SQSLargePayloadSize": {"StringValue": "9", "DataType": "Number"}}}`, i, pointerBody))
+	}
+	file := filepath.Join(t.TempDir(), "dlq.jsonl")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(strings.Join(lines, "\n")), 0600))
+
+	code, stdout, stderr := payloadctl(server, "", "resolve", "-parallel", "3", file)
+
+	assert.Equal(t, 0, code, stderr)
+	for i, m := range decodeMessages(t, stdout) {
+		assert.Equal(t, fmt.Sprintf("%d", i), m["MessageId"])
+		assert.Equal(t, fmt.Sprintf("payload %d", i), m["Body"])
+		assert.NotContains(t, m, "MessageAttributes")
+	}
+}
+
+func TestResolveReportsFailedMessages(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	missing, _ := json.Marshal(`{"s3BucketName":"test-bucket-name","s3Key":"missing"}`)
+
+	dump := fmt.Sprintf(`{"MessageId": "1", "Body": %s, "MessageAttributes": {"ExtendedPayloadSize": {"StringValue": "10", "DataType": "Number"}}}
+{"MessageId": "2", "Body": "not a pointer", "MessageAttributes": {"ExtendedPayloadSize": {"StringValue": "10", "DataType": "Number"}}}
+{"MessageId": "3", "Body": "plain"}
+{"MessageId": "4", "Body": "not a pointer", "MessageAttributes": {"SQSLargePayloadSize": {"StringValue": "10", "DataType": "Number"}}}`, missing)
+	code, stdout, stderr := payloadctl(server, dump, "resolve")
+
+	assert.Equal(t, 1, code)
+	messages := decodeMessages(t, stdout)
+	assert.Len(t, messages, 4)
+	assert.Equal(t, `{"s3BucketName":"test-bucket-name","s3Key":"missing"}`, messages[0]["Body"])
+	assert.Contains(t, stderr, "message 1 (1)")
+	assert.Contains(t, stderr, "message 2 (2)")
+	assert.NotContains(t, stderr, "message 3")
+	assert.Contains(t, stderr, "the message has the ExtendedPayloadSize attribute but its body is not a pointer")
+	assert.Contains(t, stderr, "the message has the SQSLargePayloadSize attribute but its body is not a pointer")
+	assert.Contains(t, stderr, "3 of 4 messages could not be resolved")
+}
+
+func TestResolveRequiresSizeAttribute(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	pointer := storePayload(t, server, anyPayload)
+	jsonBody, _ := json.Marshal(pointer)
+
+	dump := fmt.Sprintf(`{"MessageId": "1", "Body": %s}
+{"MessageId": "2", "Body": "s3://test-bucket-name/key"}`, jsonBody)
+
+	// Without the attribute the bodies are left alone
+	code, stdout, stderr := payloadctl(server, dump, "resolve")
+	assert.Equal(t, 0, code, stderr)
+	messages := decodeMessages(t, stdout)
+	assert.Equal(t, pointer, messages[0]["Body"])
+	assert.Equal(t, "s3://test-bucket-name/key", messages[1]["Body"])
+
+	// Pointers in the JSON format are detected on request, URIs never are
+	code, stdout, stderr = payloadctl(server, dump, "resolve", "-detect-pointers")
+	assert.Equal(t, 0, code, stderr)
+	messages = decodeMessages(t, stdout)
+	assert.Equal(t, anyPayload, messages[0]["Body"])
+	assert.Equal(t, "s3://test-bucket-name/key", messages[1]["Body"])
+}
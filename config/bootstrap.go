@@ -0,0 +1,245 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	s3dao "github.com/threehook/aws-payload-offloading-go/s3"
+	"log"
+	"strings"
+	"time"
+)
+
+// BucketSettings are the optional bucket settings applied by Bootstrap and verified by Validate.
+type BucketSettings struct {
+	// ExpiryTTLs are the TTLs payloads are stored with, an expiry lifecycle rule is required for each of them
+	ExpiryTTLs []time.Duration
+	// ContentAddressedRetention is how long the payloads of deduplicating stores are kept after they were last stored,
+	// a lifecycle rule expiring the keys under s3.ContentAddressedKeyPrefix is required when it is set. It should exceed
+	// the time pointers are held, for example the SQS message retention period.
+	ContentAddressedRetention time.Duration
+	// PublicAccessBlock is the public access block configuration required on the bucket, it is not checked when nil
+	PublicAccessBlock *types.PublicAccessBlockConfiguration
+}
+
+// MisconfigurationError is returned by Validate and Bootstrap when the bucket is not set up for storing payloads.
+type MisconfigurationError struct {
+	S3BucketName string
+	Problems     []string
+}
+
+func (e *MisconfigurationError) Error() string {
+	return fmt.Sprintf("The S3Client bucket is misconfigured, Bucket name: %s, Problems: %s.", e.S3BucketName, strings.Join(e.Problems, "; "))
+}
+
+// Validate checks that the bucket exists, that its default encryption matches the ServerSideEncryptionStrategy and
+// that it has the given settings. All problems found are reported in a single *MisconfigurationError. Without a
+// ServerSideEncryptionStrategy any default encryption is accepted.
+func (psc *PayloadStorageConfig) Validate(ctx context.Context, settings BucketSettings) error {
+	if err := psc.headBucket(ctx); err != nil {
+		return err
+	}
+	expiryRules, err := settings.expiryRules()
+	if err != nil {
+		return err
+	}
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	rules, err := psc.encryptionRules(ctx)
+	switch {
+	case err != nil:
+		report("default encryption cannot be read")
+	case !psc.hasDefaultEncryption(rules):
+		expected := psc.defaultEncryption()
+		report("default encryption is not %s", expected.SSEAlgorithm)
+	}
+
+	if len(expiryRules) > 0 {
+		output, err := psc.S3Client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: &psc.S3BucketName})
+		if err != nil && !s3dao.IsNotFound(err) {
+			log.Println(err)
+			report("lifecycle configuration cannot be read")
+		} else {
+			enabled := make(map[string]bool)
+			if output != nil {
+				for _, rule := range output.Rules {
+					enabled[aws.ToString(rule.ID)] = rule.Status == types.ExpirationStatusEnabled
+				}
+			}
+			for _, rule := range expiryRules {
+				if id := aws.ToString(rule.ID); !enabled[id] {
+					report("lifecycle rule %s is missing", id)
+				}
+			}
+		}
+	}
+
+	if settings.PublicAccessBlock != nil {
+		output, err := psc.S3Client.GetPublicAccessBlock(ctx, &s3.GetPublicAccessBlockInput{Bucket: &psc.S3BucketName})
+		switch {
+		case err != nil && !s3dao.IsNotFound(err):
+			log.Println(err)
+			report("public access block cannot be read")
+		case err != nil || output.PublicAccessBlockConfiguration == nil:
+			report("public access block is missing")
+		default:
+			actual, expected := *output.PublicAccessBlockConfiguration, *settings.PublicAccessBlock
+			if actual.BlockPublicAcls != expected.BlockPublicAcls || actual.IgnorePublicAcls != expected.IgnorePublicAcls ||
+				actual.BlockPublicPolicy != expected.BlockPublicPolicy || actual.RestrictPublicBuckets != expected.RestrictPublicBuckets {
+				report("public access block differs")
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		err := &MisconfigurationError{S3BucketName: psc.S3BucketName, Problems: problems}
+		log.Println(err)
+		return err
+	}
+	log.Printf("S3Client bucket validated, Bucket name: %s.", psc.S3BucketName) // info
+
+	return nil
+}
+
+// Bootstrap sets up an existing bucket for storing payloads: it applies the default encryption matching the
+// ServerSideEncryptionStrategy when the bucket has another one, installs the expiry lifecycle rules and public access
+// block of the settings, and then validates the bucket.
+func (psc *PayloadStorageConfig) Bootstrap(ctx context.Context, settings BucketSettings) error {
+	if err := psc.headBucket(ctx); err != nil {
+		return err
+	}
+	expiryRules, err := settings.expiryRules()
+	if err != nil {
+		return err
+	}
+
+	rules, err := psc.encryptionRules(ctx)
+	if err != nil || !psc.hasDefaultEncryption(rules) {
+		expected := psc.defaultEncryption()
+		_, err = psc.S3Client.PutBucketEncryption(ctx, &s3.PutBucketEncryptionInput{
+			Bucket: &psc.S3BucketName,
+			ServerSideEncryptionConfiguration: &types.ServerSideEncryptionConfiguration{
+				Rules: []types.ServerSideEncryptionRule{{ApplyServerSideEncryptionByDefault: &expected}},
+			},
+		})
+		if err != nil {
+			log.Println(err)
+			return errors.New("Failed to put the default encryption of the S3Client bucket")
+		}
+		log.Printf("S3Client bucket default encryption applied, Bucket name: %s, Algorithm: %s.", psc.S3BucketName, expected.SSEAlgorithm) // info
+	}
+
+	if len(expiryRules) > 0 {
+		if err := s3dao.InstallLifecycleRules(ctx, psc.S3Client, psc.S3BucketName, expiryRules...); err != nil {
+			return err
+		}
+	}
+
+	if settings.PublicAccessBlock != nil {
+		_, err := psc.S3Client.PutPublicAccessBlock(ctx, &s3.PutPublicAccessBlockInput{
+			Bucket:                         &psc.S3BucketName,
+			PublicAccessBlockConfiguration: settings.PublicAccessBlock,
+		})
+		if err != nil {
+			log.Println(err)
+			return errors.New("Failed to put the public access block of the S3Client bucket")
+		}
+		log.Printf("S3Client bucket public access block applied, Bucket name: %s.", psc.S3BucketName) // info
+	}
+
+	return psc.Validate(ctx, settings)
+}
+
+// expiryRules returns the expiry lifecycle rules required by the settings, including the s3.ExpiredDeleteMarkerRule
+// installed along with them.
+func (settings BucketSettings) expiryRules() ([]types.LifecycleRule, error) {
+	var rules []types.LifecycleRule
+	for _, ttl := range settings.ExpiryTTLs {
+		rule, err := s3dao.ExpiryRule(ttl)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if settings.ContentAddressedRetention != 0 {
+		rule, err := s3dao.ContentAddressedExpiryRule(settings.ContentAddressedRetention)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) > 0 {
+		rules = append(rules, s3dao.ExpiredDeleteMarkerRule())
+	}
+	return rules, nil
+}
+
+// headBucket checks that the bucket exists and can be accessed with the S3Client.
+func (psc *PayloadStorageConfig) headBucket(ctx context.Context) error {
+	if psc.S3Client == nil || psc.S3BucketName == "" {
+		err := errors.New("S3Client client and/or S3Client bucket name cannot be null.")
+		log.Println(err)
+		return err
+	}
+	_, err := psc.S3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &psc.S3BucketName})
+	if err != nil {
+		log.Println(err)
+		problem := "bucket is not accessible"
+		if s3dao.IsNotFound(err) {
+			problem = "bucket does not exist"
+		}
+		return &MisconfigurationError{S3BucketName: psc.S3BucketName, Problems: []string{problem}}
+	}
+	return nil
+}
+
+// encryptionRules returns the default encryption rules of the bucket, which are empty when it has none.
+func (psc *PayloadStorageConfig) encryptionRules(ctx context.Context) ([]types.ServerSideEncryptionRule, error) {
+	output, err := psc.S3Client.GetBucketEncryption(ctx, &s3.GetBucketEncryptionInput{Bucket: &psc.S3BucketName})
+	if err != nil {
+		if s3dao.IsNotFound(err) {
+			return nil, nil
+		}
+		log.Println(err)
+		return nil, err
+	}
+	if output.ServerSideEncryptionConfiguration == nil {
+		return nil, nil
+	}
+	return output.ServerSideEncryptionConfiguration.Rules, nil
+}
+
+// hasDefaultEncryption reports whether rules apply the default encryption of defaultEncryption.
+func (psc *PayloadStorageConfig) hasDefaultEncryption(rules []types.ServerSideEncryptionRule) bool {
+	expected := psc.defaultEncryption()
+	for _, rule := range rules {
+		actual := rule.ApplyServerSideEncryptionByDefault
+		switch {
+		case actual == nil:
+		case psc.ServerSideEncryptionStrategy == nil:
+			return true
+		case actual.SSEAlgorithm == expected.SSEAlgorithm && (expected.KMSMasterKeyID == nil || aws.ToString(actual.KMSMasterKeyID) == *expected.KMSMasterKeyID):
+			return true
+		}
+	}
+	return false
+}
+
+// defaultEncryption returns the bucket default encryption matching the ServerSideEncryptionStrategy, or SSE-S3 when
+// there is none.
+func (psc *PayloadStorageConfig) defaultEncryption() types.ServerSideEncryptionByDefault {
+	var input s3.PutObjectInput
+	if psc.ServerSideEncryptionStrategy != nil {
+		psc.ServerSideEncryptionStrategy.Decorate(&input)
+	}
+	if input.ServerSideEncryption == "" {
+		return types.ServerSideEncryptionByDefault{SSEAlgorithm: types.ServerSideEncryptionAes256}
+	}
+	return types.ServerSideEncryptionByDefault{SSEAlgorithm: input.ServerSideEncryption, KMSMasterKeyID: input.SSEKMSKeyId}
+}
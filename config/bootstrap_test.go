@@ -0,0 +1,140 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/encryption"
+	"github.com/threehook/aws-payload-offloading-go/s3/s3test"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+const s3BucketName = "test-bucket-name"
+
+func TestMain(m *testing.M) {
+	// Suppress logging in unit tests
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func TestValidateReportsMisconfigurations(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	psc := &PayloadStorageConfig{S3Client: server.Client(), S3BucketName: s3BucketName}
+	settings := BucketSettings{
+		ExpiryTTLs:                []time.Duration{24 * time.Hour},
+		ContentAddressedRetention: 14 * 24 * time.Hour,
+		PublicAccessBlock:         &types.PublicAccessBlockConfiguration{BlockPublicAcls: true, BlockPublicPolicy: true},
+	}
+
+	err := psc.Validate(context.Background(), settings)
+
+	var misconfigurationError *MisconfigurationError
+	assert.True(t, errors.As(err, &misconfigurationError))
+	assert.Equal(t, []string{
+		"default encryption is not AES256",
+		"lifecycle rule payload-expiry-1d is missing",
+		"lifecycle rule payload-expiry-content-addressed-14d is missing",
+		"lifecycle rule payload-expiry-delete-markers is missing",
+		"public access block is missing",
+	}, misconfigurationError.Problems)
+}
+
+func TestValidateMissingBucket(t *testing.T) {
+	server := s3test.NewServer()
+	defer server.Close()
+	psc := &PayloadStorageConfig{S3Client: server.Client(), S3BucketName: s3BucketName}
+
+	err := psc.Validate(context.Background(), BucketSettings{})
+
+	var misconfigurationError *MisconfigurationError
+	assert.True(t, errors.As(err, &misconfigurationError))
+	assert.Equal(t, []string{"bucket does not exist"}, misconfigurationError.Problems)
+}
+
+func TestBootstrapAppliesSettings(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	client := server.Client()
+	psc := &PayloadStorageConfig{
+		S3Client:                     client,
+		S3BucketName:                 s3BucketName,
+		ServerSideEncryptionStrategy: &encryption.CustomerKey{AwsKmsKeyId: "aws_test_customer_key"},
+	}
+	settings := BucketSettings{
+		ExpiryTTLs:                []time.Duration{24 * time.Hour, 7 * 24 * time.Hour},
+		ContentAddressedRetention: 14 * 24 * time.Hour,
+		PublicAccessBlock:         &types.PublicAccessBlockConfiguration{BlockPublicAcls: true, IgnorePublicAcls: true},
+	}
+
+	assert.NoError(t, psc.Bootstrap(context.Background(), settings))
+
+	lifecycle, err := client.GetBucketLifecycleConfiguration(context.Background(), &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(s3BucketName)})
+	assert.NoError(t, err)
+	assert.Len(t, lifecycle.Rules, 4)
+	contentAddressed := lifecycle.Rules[2]
+	assert.Equal(t, "payload-expiry-content-addressed-14d", aws.ToString(contentAddressed.ID))
+	assert.Equal(t, &types.LifecycleRuleFilterMemberPrefix{Value: "sha256/"}, contentAddressed.Filter)
+	assert.Equal(t, int32(14), contentAddressed.Expiration.Days)
+
+	output, err := client.GetBucketEncryption(context.Background(), &s3.GetBucketEncryptionInput{Bucket: aws.String(s3BucketName)})
+	assert.NoError(t, err)
+	applied := output.ServerSideEncryptionConfiguration.Rules[0].ApplyServerSideEncryptionByDefault
+	assert.Equal(t, types.ServerSideEncryptionAwsKms, applied.SSEAlgorithm)
+	assert.Equal(t, "aws_test_customer_key", aws.ToString(applied.KMSMasterKeyID))
+
+	// A second bootstrap leaves the matching encryption in place
+	assert.NoError(t, psc.Bootstrap(context.Background(), settings))
+	operations := server.Operations()
+	assert.Equal(t, 1, count(operations, "PutBucketEncryption"))
+	assert.Equal(t, 2, count(operations, "PutPublicAccessBlock"))
+}
+
+func TestNonPositiveExpiryTTLsAreRejected(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	psc := &PayloadStorageConfig{S3Client: server.Client(), S3BucketName: s3BucketName}
+	settings := BucketSettings{ExpiryTTLs: []time.Duration{24 * time.Hour, 0}}
+
+	assert.Error(t, psc.Validate(context.Background(), settings))
+	assert.Error(t, psc.Bootstrap(context.Background(), settings))
+	assert.Error(t, psc.Bootstrap(context.Background(), BucketSettings{ContentAddressedRetention: -time.Hour}))
+	assert.NotContains(t, server.Operations(), "PutBucketEncryption")
+	assert.NotContains(t, server.Operations(), "PutBucketLifecycleConfiguration")
+}
+
+func TestValidateAcceptsAnyEncryptionWithoutStrategy(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	client := server.Client()
+	_, err := client.PutBucketEncryption(context.Background(), &s3.PutBucketEncryptionInput{
+		Bucket: aws.String(s3BucketName),
+		ServerSideEncryptionConfiguration: &types.ServerSideEncryptionConfiguration{Rules: []types.ServerSideEncryptionRule{{
+			ApplyServerSideEncryptionByDefault: &types.ServerSideEncryptionByDefault{SSEAlgorithm: types.ServerSideEncryptionAwsKms},
+		}}},
+	})
+	assert.NoError(t, err)
+
+	psc := &PayloadStorageConfig{S3Client: client, S3BucketName: s3BucketName}
+	assert.NoError(t, psc.Validate(context.Background(), BucketSettings{}))
+
+	psc.ServerSideEncryptionStrategy = &encryption.CustomerKey{AwsKmsKeyId: "aws_test_customer_key"}
+	assert.Error(t, psc.Validate(context.Background(), BucketSettings{}))
+}
+
+func count(operations []string, operation string) int {
+	n := 0
+	for _, o := range operations {
+		if o == operation {
+			n++
+		}
+	}
+	return n
+}
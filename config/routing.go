@@ -0,0 +1,150 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// RouteConfigs are the storage configurations of the routes of a payload.RoutingPayloadStore by route name. Each
+// configures the bucket, encryption and ACL of its route.
+type RouteConfigs map[string]*PayloadStorageConfig
+
+// RoutesMisconfigurationError is returned by RouteConfigs.Validate, it holds the error of every misconfigured route.
+type RoutesMisconfigurationError struct {
+	Errors map[string]error
+}
+
+func (e *RoutesMisconfigurationError) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	routes := make([]string, len(names))
+	for i, name := range names {
+		routes[i] = fmt.Sprintf("%s: %v", name, e.Errors[name])
+	}
+	return fmt.Sprintf("The payload routes are misconfigured, Routes: %s", strings.Join(routes, "; "))
+}
+
+// Validate checks that the routes are the routeNames of the router, for example payload.Router.RouteNames, that every
+// route has a known ObjectCannedACL and validates its bucket with the given settings, see
+// PayloadStorageConfig.Validate. It is meant to run at startup, before payloads are routed.
+func (rc RouteConfigs) Validate(ctx context.Context, settings BucketSettings, routeNames []string) error {
+	if len(rc) == 0 {
+		err := errors.New("There are no payload routes")
+		log.Println(err)
+		return err
+	}
+	errs := make(map[string]error)
+	routed := make(map[string]bool)
+	for _, name := range routeNames {
+		routed[name] = true
+		if _, ok := rc[name]; !ok {
+			errs[name] = errors.New("The payload route has no storage configuration")
+		}
+	}
+	for name, psc := range rc {
+		if !routed[name] {
+			errs[name] = errors.New("The payload route is not a route of the router")
+			continue
+		}
+		if psc == nil {
+			errs[name] = errors.New("The payload route has no storage configuration")
+			continue
+		}
+		if !isCannedACL(psc.ObjectCannedACL) {
+			errs[name] = &MisconfigurationError{
+				S3BucketName: psc.S3BucketName,
+				Problems:     []string{fmt.Sprintf("object ACL %s is not a canned ACL", psc.ObjectCannedACL)},
+			}
+			continue
+		}
+		if err := psc.Validate(ctx, settings); err != nil {
+			errs[name] = err
+		}
+	}
+
+	if len(errs) > 0 {
+		err := &RoutesMisconfigurationError{Errors: errs}
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// NewRoutingPayloadStore validates the route configs for the routes of router, see Validate, and returns the
+// payload.RoutingPayloadStore of router with a store per bucket. The store of a bucket writes with an s3.S3Dao using
+// the S3Client, ServerSideEncryptionStrategy and ObjectCannedACL of the configs of its routes, which must agree. The
+// optional fields of the route stores can be set on the returned store.
+func (rc RouteConfigs) NewRoutingPayloadStore(ctx context.Context, settings BucketSettings, router payload.Router) (*payload.RoutingPayloadStore, error) {
+	if router == nil {
+		err := errors.New("There is no payload router")
+		log.Println(err)
+		return nil, err
+	}
+	if err := rc.Validate(ctx, settings, router.RouteNames()); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(rc))
+	for name := range rc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bucketConfigs := make(map[string]*PayloadStorageConfig)
+	stores := make(map[string]*payload.S3BackedPayloadStore)
+	routes := make(map[string]*payload.S3BackedPayloadStore, len(rc))
+	errs := make(map[string]error)
+	for _, name := range names {
+		psc := rc[name]
+		if first, ok := bucketConfigs[psc.S3BucketName]; !ok {
+			bucketConfigs[psc.S3BucketName] = psc
+			stores[psc.S3BucketName] = &payload.S3BackedPayloadStore{
+				S3BucketName: psc.S3BucketName,
+				S3Dao: &s3.S3Dao{
+					S3Client:                     psc.S3Client,
+					ServerSideEncryptionStrategy: psc.ServerSideEncryptionStrategy,
+					ObjectCannedACL:              psc.ObjectCannedACL,
+				},
+			}
+		} else if !sameStorage(first, psc) {
+			errs[name] = errors.New("The payload route shares its bucket with a route with another S3Client, encryption or ACL")
+			continue
+		}
+		routes[name] = stores[psc.S3BucketName]
+	}
+	if len(errs) > 0 {
+		err := &RoutesMisconfigurationError{Errors: errs}
+		log.Println(err)
+		return nil, err
+	}
+	return payload.NewRoutingPayloadStore(router, routes)
+}
+
+// sameStorage reports whether payloads stored by a and b are written alike.
+func sameStorage(a, b *PayloadStorageConfig) bool {
+	return a.S3Client == b.S3Client && a.ObjectCannedACL == b.ObjectCannedACL &&
+		reflect.DeepEqual(a.ServerSideEncryptionStrategy, b.ServerSideEncryptionStrategy)
+}
+
+// isCannedACL reports whether acl is empty or one of the canned ACLs of S3.
+func isCannedACL(acl types.ObjectCannedACL) bool {
+	if acl == "" {
+		return true
+	}
+	for _, value := range acl.Values() {
+		if acl == value {
+			return true
+		}
+	}
+	return false
+}
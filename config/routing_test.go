@@ -0,0 +1,96 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"github.com/threehook/aws-payload-offloading-go/s3/s3test"
+	"testing"
+)
+
+func TestRouteConfigsValidate(t *testing.T) {
+	server := s3test.NewServer("tenant-a-bucket", "tenant-b-bucket")
+	defer server.Close()
+	client := server.Client()
+	routes := RouteConfigs{
+		"tenant-a": {S3Client: client, S3BucketName: "tenant-a-bucket", ObjectCannedACL: "bucket-owner-full-control"},
+		"tenant-b": {S3Client: client, S3BucketName: "tenant-b-bucket", ObjectCannedACL: "owner-only"},
+		"tenant-c": {S3Client: client, S3BucketName: "tenant-c-bucket"},
+	}
+	assert.NoError(t, routes["tenant-a"].Bootstrap(context.Background(), BucketSettings{}))
+
+	routeNames := []string{"tenant-a", "tenant-b", "tenant-c"}
+	err := routes.Validate(context.Background(), BucketSettings{}, routeNames)
+
+	var routesError *RoutesMisconfigurationError
+	assert.True(t, errors.As(err, &routesError))
+	assert.Len(t, routesError.Errors, 2)
+	assert.EqualError(t, routesError.Errors["tenant-b"], "The S3Client bucket is misconfigured, Bucket name: tenant-b-bucket, Problems: object ACL owner-only is not a canned ACL.")
+	assert.EqualError(t, routesError.Errors["tenant-c"], "The S3Client bucket is misconfigured, Bucket name: tenant-c-bucket, Problems: bucket does not exist.")
+
+	delete(routes, "tenant-b")
+	delete(routes, "tenant-c")
+	assert.NoError(t, routes.Validate(context.Background(), BucketSettings{}, []string{"tenant-a"}))
+	assert.Error(t, RouteConfigs{}.Validate(context.Background(), BucketSettings{}, nil))
+}
+
+func TestRouteConfigsValidateRouteNames(t *testing.T) {
+	server := s3test.NewServer("tenant-a-bucket", "tenant-b-bucket")
+	defer server.Close()
+	client := server.Client()
+	routes := RouteConfigs{
+		"tenant-a": {S3Client: client, S3BucketName: "tenant-a-bucket"},
+		"tenant-b": {S3Client: client, S3BucketName: "tenant-b-bucket"},
+	}
+	assert.NoError(t, routes["tenant-a"].Bootstrap(context.Background(), BucketSettings{}))
+
+	err := routes.Validate(context.Background(), BucketSettings{}, []string{"tenant-a", "shared"})
+
+	var routesError *RoutesMisconfigurationError
+	assert.True(t, errors.As(err, &routesError))
+	assert.Len(t, routesError.Errors, 2)
+	assert.EqualError(t, routesError.Errors["shared"], "The payload route has no storage configuration")
+	assert.EqualError(t, routesError.Errors["tenant-b"], "The payload route is not a route of the router")
+
+	// A router without routes uses none of the routes
+	err = routes.Validate(context.Background(), BucketSettings{}, nil)
+	assert.True(t, errors.As(err, &routesError))
+	assert.Len(t, routesError.Errors, 2)
+}
+
+func TestRouteConfigsNewRoutingPayloadStore(t *testing.T) {
+	server := s3test.NewServer("tenant-a-bucket", "shared-bucket")
+	defer server.Close()
+	client := server.Client()
+	routes := RouteConfigs{
+		"tenant-a": {S3Client: client, S3BucketName: "tenant-a-bucket"},
+		"tenant-b": {S3Client: client, S3BucketName: "shared-bucket"},
+		"shared":   {S3Client: client, S3BucketName: "shared-bucket"},
+	}
+	for _, psc := range routes {
+		assert.NoError(t, psc.Bootstrap(context.Background(), BucketSettings{}))
+	}
+	router := &payload.TenantRouter{Tenants: map[string]string{"a": "tenant-a", "b": "tenant-b"}, DefaultRoute: "shared"}
+
+	store, err := routes.NewRoutingPayloadStore(context.Background(), BucketSettings{}, router)
+
+	assert.NoError(t, err)
+	assert.True(t, store.Routes["tenant-b"] == store.Routes["shared"])
+	payloadPointer, err := store.StoreOriginalPayloadForTenant("b", "payload")
+	assert.NoError(t, err)
+	actualPayload, err := store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, "payload", actualPayload)
+
+	// Routes sharing a bucket must write alike
+	routes["tenant-b"].ObjectCannedACL = "bucket-owner-full-control"
+	_, err = routes.NewRoutingPayloadStore(context.Background(), BucketSettings{}, router)
+	var routesError *RoutesMisconfigurationError
+	assert.True(t, errors.As(err, &routesError))
+	assert.Len(t, routesError.Errors, 1)
+	assert.Error(t, routesError.Errors["tenant-b"])
+
+	_, err = routes.NewRoutingPayloadStore(context.Background(), BucketSettings{}, nil)
+	assert.Error(t, err)
+}
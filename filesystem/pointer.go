@@ -0,0 +1,34 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+// PayloadFilePointer points to a payload stored by a FileBackedPayloadStore. Path is relative to RootDir and always
+// uses forward slashes.
+type PayloadFilePointer struct {
+	RootDir string `json:"rootDir"`
+	Path    string `json:"path"`
+}
+
+func (pfp *PayloadFilePointer) ToJson() (string, error) {
+	bytes, err := json.Marshal(pfp)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+func FromJson(filePointerJson string) (*PayloadFilePointer, error) {
+	var p PayloadFilePointer
+	bytes := []byte(filePointerJson)
+	err := json.Unmarshal(bytes, &p)
+	if err != nil || p.RootDir == "" || p.Path == "" {
+		log.Println(err)
+		return nil, errors.New("Failed to read the file pointer from given string")
+	}
+	return &p, nil
+}
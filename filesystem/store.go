@@ -0,0 +1,170 @@
+package filesystem
+
+import (
+	"errors"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var _ payload.PayloadStore = (*FileBackedPayloadStore)(nil)
+
+// batchConcurrency is the number of files read or written concurrently by batch operations
+const batchConcurrency = 4
+
+// FileBackedPayloadStore is a payload.PayloadStore that offloads payloads to files below RootDir instead of S3. The
+// S3 key of StoreOriginalPayloadForS3Key becomes the path of the file relative to RootDir.
+type FileBackedPayloadStore struct {
+	RootDir string
+	// This field is optional, when not set StoreOriginalPayload uses random UUIDs as keys
+	KeyGenerator payload.KeyGenerator
+}
+
+func (fps *FileBackedPayloadStore) StoreOriginalPayload(payload string) (string, error) {
+	s3Key, err := fps.keyGenerator().GenerateKey()
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	return fps.StoreOriginalPayloadForS3Key(payload, s3Key)
+}
+
+func (fps *FileBackedPayloadStore) StoreOriginalPayloadForS3Key(payload, s3Key string) (string, error) {
+	path, err := fps.resolve(s3Key)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	if err := writeFileAtomically(path, payload); err != nil {
+		log.Println(err)
+		return "", errors.New("Failed to store the message content in a file.")
+	}
+
+	log.Printf("File created, Root directory: %s, Path: %s.", fps.RootDir, s3Key) // info
+
+	filePointer := PayloadFilePointer{RootDir: fps.RootDir, Path: filepath.ToSlash(s3Key)}
+	json, _ := filePointer.ToJson()
+
+	return json, nil
+}
+
+func (fps *FileBackedPayloadStore) GetOriginalPayload(payloadPointer string) (string, error) {
+	path, err := fps.resolvePointer(payloadPointer)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Println(err)
+		return "", errors.New("Failed to get the file which contains the payload.")
+	}
+
+	log.Printf("File read, Root directory: %s, Path: %s.", fps.RootDir, path) // info
+
+	return string(bytes), nil
+}
+
+func (fps *FileBackedPayloadStore) DeleteOriginalPayload(payloadPointer string) error {
+	path, err := fps.resolvePointer(payloadPointer)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	// Like S3, deleting a payload that does not exist is not an error
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+		return errors.New("Failed to delete the file which contains the payload")
+	}
+	log.Printf("File deleted, Root directory: %s, Path: %s .", fps.RootDir, path) // info
+
+	return nil
+}
+
+func (fps *FileBackedPayloadStore) StoreOriginalPayloads(payloads []string) ([]string, error) {
+	return payload.StoreEach(fps, payloads, batchConcurrency)
+}
+
+func (fps *FileBackedPayloadStore) GetOriginalPayloads(payloadPointers []string) ([]string, error) {
+	return payload.GetEach(fps, payloadPointers, batchConcurrency)
+}
+
+func (fps *FileBackedPayloadStore) DeleteOriginalPayloads(payloadPointers []string) error {
+	return payload.DeleteEach(fps, payloadPointers, batchConcurrency)
+}
+
+func (fps *FileBackedPayloadStore) keyGenerator() payload.KeyGenerator {
+	if fps.KeyGenerator == nil {
+		return &payload.UUIDKeyGenerator{}
+	}
+	return fps.KeyGenerator
+}
+
+// resolvePointer parses payloadPointer and returns the absolute path of the file it points to. Pointers naming another
+// root directory are rejected, so a crafted pointer cannot be used to read or delete arbitrary files.
+func (fps *FileBackedPayloadStore) resolvePointer(payloadPointer string) (string, error) {
+	filePointer, err := FromJson(payloadPointer)
+	if err != nil {
+		return "", err
+	}
+	if filepath.Clean(filePointer.RootDir) != filepath.Clean(fps.RootDir) {
+		return "", errors.New("The file pointer refers to a different root directory.")
+	}
+	return fps.resolve(filePointer.Path)
+}
+
+// resolve returns the absolute path for the given relative path, making sure it does not escape RootDir.
+func (fps *FileBackedPayloadStore) resolve(relPath string) (string, error) {
+	if fps.RootDir == "" {
+		return "", errors.New("The root directory of the file backed payload store is not set.")
+	}
+	if relPath == "" || filepath.IsAbs(relPath) || strings.HasPrefix(relPath, "/") {
+		return "", errors.New("The payload path must be a non-empty relative path.")
+	}
+	root, err := filepath.Abs(fps.RootDir)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(root, filepath.FromSlash(relPath))
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("The payload path escapes the root directory.")
+	}
+	return path, nil
+}
+
+// writeFileAtomically writes payload to a temporary file in the target directory and renames it into place, so
+// readers never observe a partially written payload.
+func writeFileAtomically(path, payload string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".payload-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.WriteString(payload); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
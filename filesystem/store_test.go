@@ -0,0 +1,121 @@
+package filesystem
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"github.com/threehook/aws-payload-offloading-go/payload/payloadtest"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	anyS3Key   = "AnyS3key"
+	anyPayload = "AnyPayload"
+)
+
+func TestMain(m *testing.M) {
+	// Suppress logging in unit tests
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func newTestStore(t *testing.T) *FileBackedPayloadStore {
+	rootDir, err := ioutil.TempDir("", "payloads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(rootDir) })
+	return &FileBackedPayloadStore{RootDir: rootDir}
+}
+
+func TestStoreOriginalPayloadOnSuccess(t *testing.T) {
+	payloadStore := newTestStore(t)
+
+	actualPayloadPointer, err := payloadStore.StoreOriginalPayload(anyPayload)
+	assert.NoError(t, err)
+
+	filePointer, err := FromJson(actualPayloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, payloadStore.RootDir, filePointer.RootDir)
+
+	bytes, err := ioutil.ReadFile(filepath.Join(payloadStore.RootDir, filePointer.Path))
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, string(bytes))
+}
+
+func TestStoreOriginalPayloadWithS3KeyInSubdirectory(t *testing.T) {
+	payloadStore := newTestStore(t)
+
+	actualPayloadPointer, err := payloadStore.StoreOriginalPayloadForS3Key(anyPayload, "tenant/"+anyS3Key)
+	assert.NoError(t, err)
+
+	expectedPayloadPointer := &PayloadFilePointer{RootDir: payloadStore.RootDir, Path: "tenant/" + anyS3Key}
+	ptrJson, _ := expectedPayloadPointer.ToJson()
+	assert.Equal(t, ptrJson, actualPayloadPointer)
+
+	// No temporary files are left behind next to the payload
+	files, _ := ioutil.ReadDir(filepath.Join(payloadStore.RootDir, "tenant"))
+	assert.Len(t, files, 1)
+}
+
+func TestStoreOriginalPayloadRejectsPathTraversal(t *testing.T) {
+	payloadStore := newTestStore(t)
+
+	for _, s3Key := range []string{"../escaped", "a/../../escaped", "/etc/passwd", "", "."} {
+		_, err := payloadStore.StoreOriginalPayloadForS3Key(anyPayload, s3Key)
+		assert.Error(t, err, s3Key)
+	}
+}
+
+func TestGetOriginalPayloadOnSuccess(t *testing.T) {
+	payloadStore := newTestStore(t)
+
+	ptrJson, _ := payloadStore.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+	actualPayload, err := payloadStore.GetOriginalPayload(ptrJson)
+
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+}
+
+func TestGetOriginalPayloadIncorrectPointer(t *testing.T) {
+	payloadStore := newTestStore(t)
+
+	_, err := payloadStore.GetOriginalPayload("IncorrectPointer")
+	assert.Error(t, err)
+}
+
+func TestGetOriginalPayloadRejectsForeignPointers(t *testing.T) {
+	payloadStore := newTestStore(t)
+
+	otherRoot := &PayloadFilePointer{RootDir: os.TempDir(), Path: anyS3Key}
+	ptrJson, _ := otherRoot.ToJson()
+	_, err := payloadStore.GetOriginalPayload(ptrJson)
+	assert.Error(t, err)
+
+	escaping := &PayloadFilePointer{RootDir: payloadStore.RootDir, Path: "../" + anyS3Key}
+	ptrJson, _ = escaping.ToJson()
+	_, err = payloadStore.GetOriginalPayload(ptrJson)
+	assert.Error(t, err)
+	assert.Error(t, payloadStore.DeleteOriginalPayload(ptrJson))
+}
+
+func TestDeleteOriginalPayloadOnSuccess(t *testing.T) {
+	payloadStore := newTestStore(t)
+
+	ptrJson, _ := payloadStore.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+	assert.NoError(t, payloadStore.DeleteOriginalPayload(ptrJson))
+
+	_, err := payloadStore.GetOriginalPayload(ptrJson)
+	assert.Error(t, err)
+	// Deleting a payload twice behaves like S3 and does not fail
+	assert.NoError(t, payloadStore.DeleteOriginalPayload(ptrJson))
+}
+
+func TestConformance(t *testing.T) {
+	payloadtest.RunPayloadStoreSuite(t, func(t *testing.T) payload.PayloadStore {
+		return newTestStore(t)
+	})
+}
@@ -0,0 +1,274 @@
+// Package gc deletes offloaded payloads that have been orphaned, for example because a consumer crashed before it
+// called DeleteOriginalPayload.
+package gc
+
+import (
+	"context"
+	"errors"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMinAge is the maximum SQS message retention period. Older payloads cannot be referenced by a message that is
+// still in a queue.
+const DefaultMinAge = 14 * 24 * time.Hour
+
+// DefaultBatchSize is the number of objects deleted per request, the maximum of an S3 DeleteObjects request.
+const DefaultBatchSize = 1000
+
+// BookkeepingPrefixes are the key prefixes under which the payload package keeps objects it manages itself:
+// idempotently stored payloads whose keys are reused by retries, content addressed payloads shared by many pointers and
+// health check probes. The acknowledgements of shared payloads, with keys containing payload.AcknowledgementKeyInfix,
+// are bookkeeping too.
+var BookkeepingPrefixes = []string{payload.IdempotentKeyPrefix, payload.ContentAddressedKeyPrefix, payload.HealthCheckKeyPrefix}
+
+// LivenessOracle reports whether an object is still referenced by a live pointer, for example by a message that is
+// being processed or an entry in a database.
+type LivenessOracle interface {
+	IsLive(s3BucketName, s3Key string) (bool, error)
+}
+
+// LivenessOracleFunc adapts a function to a LivenessOracle.
+type LivenessOracleFunc func(s3BucketName, s3Key string) (bool, error)
+
+func (f LivenessOracleFunc) IsLive(s3BucketName, s3Key string) (bool, error) {
+	return f(s3BucketName, s3Key)
+}
+
+// Collector deletes the objects under Prefix that are older than MinAge and not live according to the Oracle. Shared
+// payloads whose references have not expired yet, payloads whose TTL has not passed yet and, unless IncludeBookkeeping
+// is set, the bookkeeping objects of the payload package are never orphans.
+type Collector struct {
+	S3BucketName string
+	S3Dao        s3.S3DaoClientI
+	// Prefix limits the collection to the keys of a single store, for example the prefix of its KeyGenerator
+	Prefix string
+	// MinAge is optional and defaults to DefaultMinAge
+	MinAge time.Duration
+	// This field is optional, without it every object older than MinAge is an orphan
+	Oracle LivenessOracle
+	// DryRun only reports the orphans without deleting them
+	DryRun bool
+	// IncludeBookkeeping also collects the objects under the BookkeepingPrefixes and the acknowledgements of shared
+	// payloads
+	IncludeBookkeeping bool
+	// BatchSize is optional and defaults to DefaultBatchSize
+	BatchSize int
+	// MaxDeletesPerSecond limits the delete rate to spare the request rate of the bucket. It is optional, zero means
+	// unlimited.
+	MaxDeletesPerSecond int
+	// Clock is optional and defaults to time.Now
+	Clock func() time.Time
+}
+
+// Report describes the outcome of a collection.
+type Report struct {
+	// Scanned is the number of objects listed under the prefix
+	Scanned int
+	// Orphans are the keys of the orphaned objects. Unless DryRun is set they have been deleted, except for the ones in
+	// Failed.
+	Orphans []string
+	Deleted int
+	// Failed holds the errors of the orphans that could not be deleted or checked with the Oracle, by key
+	Failed map[string]error
+}
+
+// Collect lists the objects under the prefix page by page and deletes the orphans of each page before listing the
+// next. It stops early with the error of ctx when ctx is done, the report then covers the work done so far.
+func (c *Collector) Collect(ctx context.Context) (*Report, error) {
+	report := &Report{Orphans: make([]string, 0), Failed: make(map[string]error)}
+	minAge := c.MinAge
+	if minAge <= 0 {
+		minAge = DefaultMinAge
+	}
+	cutoff := c.now().Add(-minAge)
+	limiter := &deleteLimiter{start: time.Now()}
+
+	var collectErr error
+	err := c.S3Dao.ListObjectPagesInS3(c.S3BucketName, c.Prefix, func(page []s3.ObjectSummary) bool {
+		report.Scanned += len(page)
+		orphans := c.orphans(ctx, page, cutoff, report)
+		report.Orphans = append(report.Orphans, orphans...)
+		if collectErr = ctx.Err(); collectErr != nil {
+			return false
+		}
+		if !c.DryRun {
+			collectErr = c.delete(ctx, orphans, limiter, report)
+		}
+		return collectErr == nil
+	})
+	if err != nil {
+		log.Println(err)
+		return report, err
+	}
+	log.Printf("Orphaned S3Client objects found, Bucket name: %s, Prefix: %s, Number of objects: %d of %d, Number of objects deleted: %d.", c.S3BucketName, c.Prefix, len(report.Orphans), report.Scanned, report.Deleted) // info
+	return report, collectErr
+}
+
+// orphans returns the keys of the objects of page older than cutoff that are not live.
+func (c *Collector) orphans(ctx context.Context, page []s3.ObjectSummary, cutoff time.Time, report *Report) []string {
+	var orphans []string
+	for _, summary := range page {
+		if ctx.Err() != nil {
+			break
+		}
+		if !summary.LastModified.Before(cutoff) {
+			continue
+		}
+		if !c.IncludeBookkeeping && isBookkeeping(summary.Key) {
+			continue
+		}
+		retained, err := c.retained(summary.Key)
+		if err != nil {
+			log.Println(err)
+			report.Failed[summary.Key] = err
+			continue
+		}
+		if retained {
+			continue
+		}
+		if c.Oracle != nil {
+			live, err := c.Oracle.IsLive(c.S3BucketName, summary.Key)
+			if err != nil {
+				log.Println(err)
+				report.Failed[summary.Key] = err
+				continue
+			}
+			if live {
+				continue
+			}
+		}
+		orphans = append(orphans, summary.Key)
+	}
+	return orphans
+}
+
+func isBookkeeping(s3Key string) bool {
+	if strings.Contains(s3Key, payload.AcknowledgementKeyInfix) {
+		return true
+	}
+	for _, prefix := range BookkeepingPrefixes {
+		if strings.HasPrefix(s3Key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// retained reports whether the metadata of the object keeps it from being an orphan: a shared payload before its
+// references expire or a payload before its TTL has passed. Objects deleted since they were listed are retained too.
+func (c *Collector) retained(s3Key string) (bool, error) {
+	metadata, err := c.S3Dao.GetObjectMetadataFromS3(c.S3BucketName, s3Key)
+	if err != nil {
+		return false, err
+	}
+	if metadata == nil {
+		return true, nil
+	}
+	now := c.now()
+	if consumers, ok := metadata.Metadata[payload.ExpectedConsumersMetadataKey]; ok {
+		if _, err := strconv.Atoi(consumers); err != nil {
+			return false, errors.New("Invalid expected consumers of shared payload " + s3Key + ": " + consumers)
+		}
+		referencesExpireAt, err := time.Parse(time.RFC3339Nano, metadata.Metadata[payload.ReferencesExpireAtMetadataKey])
+		if err != nil {
+			return false, err
+		}
+		if now.Before(referencesExpireAt) {
+			return true, nil
+		}
+	}
+	if value, ok := metadata.Metadata[payload.ExpiresAtMetadataKey]; ok {
+		expiresAt, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return false, err
+		}
+		if now.Before(expiresAt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// deleteLimiter counts the deletes sent since start, to keep within MaxDeletesPerSecond across pages.
+type deleteLimiter struct {
+	start time.Time
+	sent  int
+}
+
+func (c *Collector) delete(ctx context.Context, orphans []string, limiter *deleteLimiter, report *Report) error {
+	batchSize := c.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	// A batch is sent at once, so it must not exceed the deletes of a second
+	if c.MaxDeletesPerSecond > 0 && batchSize > c.MaxDeletesPerSecond {
+		batchSize = c.MaxDeletesPerSecond
+	}
+	for i := 0; i < len(orphans); i += batchSize {
+		end := i + batchSize
+		if end > len(orphans) {
+			end = len(orphans)
+		}
+		if err := c.wait(ctx, limiter.start, limiter.sent); err != nil {
+			return err
+		}
+
+		keys := orphans[i:end]
+		limiter.sent += len(keys)
+		err := c.S3Dao.DeletePayloadsFromS3(c.S3BucketName, keys)
+		var batchError *s3.BatchError
+		switch {
+		case err == nil:
+			report.Deleted += len(keys)
+		case errors.As(err, &batchError) && len(batchError.Errors) == len(keys):
+			for j, key := range keys {
+				if keyErr := batchError.Err(j); keyErr != nil {
+					report.Failed[key] = keyErr
+				} else {
+					report.Deleted++
+				}
+			}
+		default:
+			log.Println(err)
+			for _, key := range keys {
+				report.Failed[key] = err
+			}
+		}
+	}
+	return nil
+}
+
+// wait blocks until deleting the objects following the first deleted ones keeps within MaxDeletesPerSecond.
+func (c *Collector) wait(ctx context.Context, start time.Time, deleted int) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if c.MaxDeletesPerSecond <= 0 {
+		return nil
+	}
+	due := start.Add(time.Duration(deleted) * time.Second / time.Duration(c.MaxDeletesPerSecond))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (c *Collector) now() time.Time {
+	if c.Clock == nil {
+		return time.Now()
+	}
+	return c.Clock()
+}
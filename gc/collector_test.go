@@ -0,0 +1,251 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/inmemory"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+const s3BucketName = "test-bucket-name"
+
+func TestMain(m *testing.M) {
+	// Suppress logging in unit tests
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// later is a Clock for which all objects stored now are older than DefaultMinAge
+func later() time.Time {
+	return time.Now().Add(DefaultMinAge + time.Hour)
+}
+
+func newDao(keys ...string) *inmemory.S3Dao {
+	dao := inmemory.NewS3Dao()
+	for _, key := range keys {
+		dao.StoreTextInS3(s3BucketName, key, "payload")
+	}
+	return dao
+}
+
+func TestCollectDeletesOrphansUnderPrefix(t *testing.T) {
+	dao := newDao("store/a", "store/b", "store/c", "other/d")
+	oracle := LivenessOracleFunc(func(s3BucketName, s3Key string) (bool, error) {
+		return s3Key == "store/b", nil
+	})
+	collector := &Collector{S3BucketName: s3BucketName, S3Dao: dao, Prefix: "store/", Oracle: oracle, BatchSize: 1, Clock: later}
+
+	report, err := collector.Collect(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Scanned)
+	assert.Equal(t, []string{"store/a", "store/c"}, report.Orphans)
+	assert.Equal(t, 2, report.Deleted)
+	assert.Empty(t, report.Failed)
+	assert.Equal(t, []string{"other/d", "store/b"}, dao.Keys(s3BucketName))
+	assert.Equal(t, 2, dao.Calls(inmemory.DeletePayloadsFromS3))
+}
+
+func TestCollectKeepsRecentObjects(t *testing.T) {
+	dao := newDao("store/a")
+	collector := &Collector{S3BucketName: s3BucketName, S3Dao: dao}
+
+	report, err := collector.Collect(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Scanned)
+	assert.Empty(t, report.Orphans)
+	assert.Equal(t, 1, dao.Len())
+}
+
+func TestCollectDryRun(t *testing.T) {
+	dao := newDao("store/a", "store/b")
+	collector := &Collector{S3BucketName: s3BucketName, S3Dao: dao, DryRun: true, Clock: later}
+
+	report, err := collector.Collect(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"store/a", "store/b"}, report.Orphans)
+	assert.Equal(t, 0, report.Deleted)
+	assert.Equal(t, 2, dao.Len())
+	assert.Equal(t, 0, dao.Calls(inmemory.DeletePayloadsFromS3))
+}
+
+func TestCollectSkipsBookkeepingObjects(t *testing.T) {
+	for _, s3Key := range []string{"idempotent/a", "sha256/a", "healthcheck/a", "store/a.acks/queue-a"} {
+		t.Run(s3Key, func(t *testing.T) {
+			dao := newDao(s3Key)
+			collector := &Collector{S3BucketName: s3BucketName, S3Dao: dao, Clock: later}
+
+			report, err := collector.Collect(context.Background())
+
+			assert.NoError(t, err)
+			assert.Equal(t, 1, report.Scanned)
+			assert.Empty(t, report.Orphans)
+			assert.Equal(t, 1, dao.Len())
+
+			collector.IncludeBookkeeping = true
+			report, err = collector.Collect(context.Background())
+
+			assert.NoError(t, err)
+			assert.Equal(t, []string{s3Key}, report.Orphans)
+			assert.Equal(t, 0, dao.Len())
+		})
+	}
+}
+
+func TestCollectKeepsSharedPayloadsUntilTheirReferencesExpire(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	payloadStore.ReferenceExpiry = 30 * 24 * time.Hour
+	payloadStore.ConsumerId = "queue-a"
+	ptrJson, err := payloadStore.StoreOriginalPayloadForConsumers("payload", 2)
+	assert.NoError(t, err)
+	assert.NoError(t, payloadStore.DeleteOriginalPayload(ptrJson))
+	s3Pointer, _ := payload.ParsePointer(ptrJson)
+	collector := &Collector{S3BucketName: s3BucketName, S3Dao: dao, Clock: later}
+
+	report, err := collector.Collect(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Scanned)
+	assert.Empty(t, report.Orphans)
+
+	collector.Clock = func() time.Time { return s3Pointer.ReferencesExpireAt.Add(time.Hour) }
+	report, err = collector.Collect(context.Background())
+
+	// The acknowledgement is left to its lifecycle rule
+	assert.NoError(t, err)
+	assert.Equal(t, []string{s3Pointer.S3Key}, report.Orphans)
+	assert.Equal(t, []string{s3Pointer.S3Key + ".acks/queue-a"}, dao.Keys(s3BucketName))
+}
+
+func TestCollectKeepsPayloadsUntilTheyExpire(t *testing.T) {
+	dao := newDao()
+	expiresAt := later().Add(time.Hour)
+	options := s3.StoreOptions{Metadata: map[string]string{payload.ExpiresAtMetadataKey: expiresAt.Format(time.RFC3339Nano)}}
+	_, err := dao.StoreTextInS3WithOptions(s3BucketName, "store/a", "payload", options)
+	assert.NoError(t, err)
+	collector := &Collector{S3BucketName: s3BucketName, S3Dao: dao, Clock: later}
+
+	report, err := collector.Collect(context.Background())
+
+	assert.NoError(t, err)
+	assert.Empty(t, report.Orphans)
+
+	collector.Clock = func() time.Time { return expiresAt.Add(time.Second) }
+	report, err = collector.Collect(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"store/a"}, report.Orphans)
+}
+
+func TestCollectReportsMetadataFailures(t *testing.T) {
+	dao := newDao("store/a", "store/b")
+	dao.FailNext(inmemory.GetObjectMetadataFromS3, errors.New("S3Client Exception"))
+	collector := &Collector{S3BucketName: s3BucketName, S3Dao: dao, Clock: later}
+
+	report, err := collector.Collect(context.Background())
+
+	assert.NoError(t, err)
+	assert.Error(t, report.Failed["store/a"])
+	assert.Equal(t, []string{"store/b"}, report.Orphans)
+	assert.Equal(t, []string{"store/a"}, dao.Keys(s3BucketName))
+}
+
+func TestCollectReportsFailures(t *testing.T) {
+	dao := newDao("store/a", "store/b", "store/c")
+	oracleError := errors.New("oracle unavailable")
+	oracle := LivenessOracleFunc(func(s3BucketName, s3Key string) (bool, error) {
+		if s3Key == "store/a" {
+			return false, oracleError
+		}
+		return false, nil
+	})
+	dao.FailNext(inmemory.DeletePayloadFromS3, errors.New("S3Client Exception"))
+	collector := &Collector{S3BucketName: s3BucketName, S3Dao: dao, Oracle: oracle, Clock: later}
+
+	report, err := collector.Collect(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Deleted)
+	assert.Equal(t, oracleError, report.Failed["store/a"])
+	assert.Error(t, report.Failed["store/b"])
+	assert.Equal(t, []string{"store/a", "store/b"}, dao.Keys(s3BucketName))
+}
+
+func TestCollectOnListFailure(t *testing.T) {
+	dao := newDao("store/a")
+	dao.FailNext(inmemory.ListObjectPagesInS3, errors.New("S3Client Exception"))
+	collector := &Collector{S3BucketName: s3BucketName, S3Dao: dao, Clock: later}
+
+	_, err := collector.Collect(context.Background())
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, dao.Len())
+}
+
+func TestCollectIsRateLimited(t *testing.T) {
+	keys := make([]string, 6)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("store/%d", i)
+	}
+	dao := newDao(keys...)
+	collector := &Collector{S3BucketName: s3BucketName, S3Dao: dao, BatchSize: 2, MaxDeletesPerSecond: 100, Clock: later}
+
+	start := time.Now()
+	report, err := collector.Collect(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 6, report.Deleted)
+	// The second and third batch wait until 2 and 4 objects per 100 per second have passed
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+}
+
+func TestCollectCapsBatchesAtTheRate(t *testing.T) {
+	dao := newDao("store/a", "store/b", "store/c", "store/d", "store/e")
+	collector := &Collector{S3BucketName: s3BucketName, S3Dao: dao, MaxDeletesPerSecond: 2, Clock: later}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	report, err := collector.Collect(ctx)
+
+	// Only the deletes of the first second are sent before the context is done
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 2, report.Deleted)
+	assert.Equal(t, []string{"store/c", "store/d", "store/e"}, dao.Keys(s3BucketName))
+}
+
+func TestCollectDeletesPageByPage(t *testing.T) {
+	dao := newDao("store/a", "store/b", "store/c", "store/d", "store/e")
+	dao.ListPageSize = 2
+	collector := &Collector{S3BucketName: s3BucketName, S3Dao: dao, Clock: later}
+
+	report, err := collector.Collect(context.Background())
+
+	assert.NoError(t, err)
+	assert.Equal(t, 5, report.Scanned)
+	assert.Equal(t, 5, report.Deleted)
+	assert.Equal(t, 3, dao.Calls(inmemory.DeletePayloadsFromS3))
+	assert.Equal(t, 0, dao.Len())
+}
+
+func TestCollectStopsWhenContextIsDone(t *testing.T) {
+	dao := newDao("store/a", "store/b")
+	collector := &Collector{S3BucketName: s3BucketName, S3Dao: dao, BatchSize: 1, MaxDeletesPerSecond: 1, Clock: later}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	report, err := collector.Collect(ctx)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, report.Deleted)
+	assert.Equal(t, 1, dao.Len())
+}
@@ -3,7 +3,10 @@ module github.com/threehook/aws-payload-offloading-go
 go 1.15
 
 require (
+	github.com/aws/aws-sdk-go-v2 v1.16.16
+	github.com/aws/aws-sdk-go-v2/config v1.17.7
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.12.0
+	github.com/aws/smithy-go v1.13.3
 	github.com/golang/mock v1.6.0
 	github.com/google/uuid v1.3.0
 	github.com/stretchr/testify v1.7.0
@@ -0,0 +1,561 @@
+package inmemory
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operation names an S3DaoClientI method, used to target injected faults and to count calls.
+type Operation string
+
+const (
+	GetTextFromS3 Operation = "GetTextFromS3"
+	StoreTextInS3 Operation = "StoreTextInS3"
+	// StoreTextInS3WithOptions also counts as a call of StoreTextInS3
+	StoreTextInS3WithOptions Operation = "StoreTextInS3WithOptions"
+	CopyObjectInS3           Operation = "CopyObjectInS3"
+	// CopyObjectInS3WithOptions also counts as a call of CopyObjectInS3
+	CopyObjectInS3WithOptions Operation = "CopyObjectInS3WithOptions"
+	DeletePayloadFromS3       Operation = "DeletePayloadFromS3"
+	// Version operations also count as calls of their unversioned operation
+	GetTextFromS3Version       Operation = "GetTextFromS3Version"
+	DeletePayloadVersionFromS3 Operation = "DeletePayloadVersionFromS3"
+	DeleteAllVersionsFromS3    Operation = "DeleteAllVersionsFromS3"
+	DoesObjectExistInS3        Operation = "DoesObjectExistInS3"
+	DoesBucketExistInS3        Operation = "DoesBucketExistInS3"
+	GetObjectMetadataFromS3    Operation = "GetObjectMetadataFromS3"
+	ListObjectsInS3            Operation = "ListObjectsInS3"
+	ListObjectPagesInS3        Operation = "ListObjectPagesInS3"
+	// Batch operations also count as calls of their single item operation for every key
+	GetTextsFromS3       Operation = "GetTextsFromS3"
+	StoreTextsInS3       Operation = "StoreTextsInS3"
+	DeletePayloadsFromS3 Operation = "DeletePayloadsFromS3"
+)
+
+var _ s3.S3DaoClientI = (*S3Dao)(nil)
+
+type objectId struct {
+	bucket string
+	key    string
+}
+
+type object struct {
+	payload      string
+	options      s3.StoreOptions
+	lastModified time.Time
+	versionId    string
+	deleteMarker bool
+}
+
+type fault struct {
+	err       error
+	remaining int // a negative value means the fault never wears off
+}
+
+// S3Dao is a thread-safe in-memory implementation of s3.S3DaoClientI. Objects are kept in a map per bucket and key,
+// so tests can inspect what has been offloaded and inject failures without any AWS dependency. Buckets can be made
+// versioned with EnableVersioning.
+type S3Dao struct {
+	mu            sync.RWMutex
+	objects       map[objectId]object
+	versioned     map[string]bool
+	versions      map[objectId][]object // per key of a versioned bucket, oldest first
+	nextVersionId int
+	faults        map[Operation]*fault
+	calls         map[Operation]int
+	// ListPageSize is the number of objects per page of ListObjectPagesInS3, it is optional and defaults to 1000 like S3
+	ListPageSize int
+}
+
+func NewS3Dao() *S3Dao {
+	return &S3Dao{
+		objects:   make(map[objectId]object),
+		versioned: make(map[string]bool),
+		versions:  make(map[objectId][]object),
+		faults:    make(map[Operation]*fault),
+		calls:     make(map[Operation]int),
+	}
+}
+
+func (dao *S3Dao) GetTextFromS3(s3BucketName, s3Key string) (string, error) {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.enter(GetTextFromS3); err != nil {
+		return "", err
+	}
+
+	return dao.get(s3BucketName, s3Key, "")
+}
+
+func (dao *S3Dao) GetTextFromS3Version(s3BucketName, s3Key, versionId string) (string, error) {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.enter(GetTextFromS3Version); err != nil {
+		return "", err
+	}
+	if err := dao.enter(GetTextFromS3); err != nil {
+		return "", err
+	}
+
+	return dao.get(s3BucketName, s3Key, versionId)
+}
+
+func (dao *S3Dao) StoreTextInS3(s3BucketName, s3Key, payloadContentStr string) error {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.enter(StoreTextInS3); err != nil {
+		return err
+	}
+
+	dao.store(s3BucketName, s3Key, payloadContentStr, s3.StoreOptions{})
+	return nil
+}
+
+func (dao *S3Dao) StoreTextInS3WithOptions(s3BucketName, s3Key, payloadContentStr string, options s3.StoreOptions) (s3.StoreResult, error) {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.enter(StoreTextInS3WithOptions); err != nil {
+		return s3.StoreResult{}, err
+	}
+	if err := dao.enter(StoreTextInS3); err != nil {
+		return s3.StoreResult{}, err
+	}
+
+	// Like S3, the conditions are checked against the current object
+	current, exists := dao.objects[objectId{s3BucketName, s3Key}]
+	if options.IfNoneMatch != "" && exists {
+		return s3.StoreResult{}, &s3.ObjectAlreadyExistsError{S3BucketName: s3BucketName, S3Key: s3Key}
+	}
+	if options.IfMatch != "" && (!exists || (options.IfMatch != "*" && options.IfMatch != etag(current.payload))) {
+		return s3.StoreResult{}, &s3.ObjectModifiedError{S3BucketName: s3BucketName, S3Key: s3Key, ETag: options.IfMatch}
+	}
+	return dao.store(s3BucketName, s3Key, payloadContentStr, options), nil
+}
+
+// CopyObjectInS3 copies the payload and the options it was stored with, except for the store conditions.
+func (dao *S3Dao) CopyObjectInS3(sourceBucketName, sourceKey, versionId, s3BucketName, s3Key string) (s3.StoreResult, error) {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.enter(CopyObjectInS3); err != nil {
+		return s3.StoreResult{}, err
+	}
+
+	source, ok := dao.find(sourceBucketName, sourceKey, versionId)
+	if !ok {
+		err := errors.New("Failed to copy the S3Client object.")
+		log.Println(err)
+		return s3.StoreResult{}, err
+	}
+	options := source.options
+	options.IfNoneMatch, options.IfMatch = "", ""
+	return dao.store(s3BucketName, s3Key, source.payload, options), nil
+}
+
+// CopyObjectInS3WithOptions copies the payload with the given options, except for the store conditions.
+func (dao *S3Dao) CopyObjectInS3WithOptions(sourceBucketName, sourceKey, versionId, s3BucketName, s3Key string, options s3.StoreOptions) (s3.StoreResult, error) {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.enter(CopyObjectInS3WithOptions); err != nil {
+		return s3.StoreResult{}, err
+	}
+	if err := dao.enter(CopyObjectInS3); err != nil {
+		return s3.StoreResult{}, err
+	}
+
+	source, ok := dao.find(sourceBucketName, sourceKey, versionId)
+	if !ok {
+		err := errors.New("Failed to copy the S3Client object.")
+		log.Println(err)
+		return s3.StoreResult{}, err
+	}
+	options.IfNoneMatch, options.IfMatch = "", ""
+	return dao.store(s3BucketName, s3Key, source.payload, options), nil
+}
+
+func (dao *S3Dao) DeletePayloadFromS3(s3BucketName, s3Key string) error {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.enter(DeletePayloadFromS3); err != nil {
+		return err
+	}
+
+	dao.delete(s3BucketName, s3Key, "")
+	return nil
+}
+
+func (dao *S3Dao) DeletePayloadVersionFromS3(s3BucketName, s3Key, versionId string) error {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.enter(DeletePayloadVersionFromS3); err != nil {
+		return err
+	}
+	if err := dao.enter(DeletePayloadFromS3); err != nil {
+		return err
+	}
+
+	dao.delete(s3BucketName, s3Key, versionId)
+	return nil
+}
+
+func (dao *S3Dao) DeleteAllVersionsFromS3(s3BucketName, s3Key string) error {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.enter(DeleteAllVersionsFromS3); err != nil {
+		return err
+	}
+
+	id := objectId{s3BucketName, s3Key}
+	delete(dao.objects, id)
+	delete(dao.versions, id)
+	return nil
+}
+
+func (dao *S3Dao) DoesObjectExistInS3(s3BucketName, s3Key string) (bool, error) {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.enter(DoesObjectExistInS3); err != nil {
+		return false, err
+	}
+
+	_, ok := dao.objects[objectId{s3BucketName, s3Key}]
+	return ok, nil
+}
+
+// DoesBucketExistInS3 reports every bucket as existing, buckets are created implicitly by the first store.
+func (dao *S3Dao) DoesBucketExistInS3(s3BucketName string) (bool, error) {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.enter(DoesBucketExistInS3); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (dao *S3Dao) GetObjectMetadataFromS3(s3BucketName, s3Key string) (*s3.ObjectMetadata, error) {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.enter(GetObjectMetadataFromS3); err != nil {
+		return nil, err
+	}
+
+	stored, ok := dao.objects[objectId{s3BucketName, s3Key}]
+	if !ok {
+		return nil, nil
+	}
+	metadata := &s3.ObjectMetadata{
+		Size:            int64(len(stored.payload)),
+		ContentType:     stored.options.ContentType,
+		ContentEncoding: stored.options.ContentEncoding,
+		ETag:            etag(stored.payload),
+		VersionId:       stored.versionId,
+		LastModified:    stored.lastModified,
+		Metadata:        make(map[string]string, len(stored.options.Metadata)),
+	}
+	for name, value := range stored.options.Metadata {
+		metadata.Metadata[strings.ToLower(name)] = value
+	}
+	return metadata, nil
+}
+
+func (dao *S3Dao) ListObjectsInS3(s3BucketName, prefix string) ([]s3.ObjectSummary, error) {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if err := dao.enter(ListObjectsInS3); err != nil {
+		return nil, err
+	}
+
+	return dao.list(s3BucketName, prefix), nil
+}
+
+// ListObjectPagesInS3 calls fn without holding the lock, so fn may call the dao, for example to delete the objects of
+// the page.
+func (dao *S3Dao) ListObjectPagesInS3(s3BucketName, prefix string, fn func(page []s3.ObjectSummary) bool) error {
+	dao.mu.Lock()
+	if err := dao.enter(ListObjectPagesInS3); err != nil {
+		dao.mu.Unlock()
+		return err
+	}
+	summaries := dao.list(s3BucketName, prefix)
+	dao.mu.Unlock()
+
+	pageSize := dao.ListPageSize
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+	for start := 0; start < len(summaries); start += pageSize {
+		end := start + pageSize
+		if end > len(summaries) {
+			end = len(summaries)
+		}
+		if !fn(summaries[start:end]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (dao *S3Dao) list(s3BucketName, prefix string) []s3.ObjectSummary {
+	summaries := make([]s3.ObjectSummary, 0)
+	for id, stored := range dao.objects {
+		if id.bucket == s3BucketName && strings.HasPrefix(id.key, prefix) {
+			summaries = append(summaries, s3.ObjectSummary{Key: id.key, Size: int64(len(stored.payload)), LastModified: stored.lastModified})
+		}
+	}
+	// Like S3, objects are listed in key order
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Key < summaries[j].Key })
+	return summaries
+}
+
+func (dao *S3Dao) GetTextsFromS3(s3BucketName string, s3Keys []string) ([]string, error) {
+	if err := dao.enterBatch(GetTextsFromS3); err != nil {
+		return nil, err
+	}
+	payloads := make([]string, len(s3Keys))
+	errs := make([]error, len(s3Keys))
+	for i, s3Key := range s3Keys {
+		payloads[i], errs[i] = dao.GetTextFromS3(s3BucketName, s3Key)
+	}
+	return payloads, s3.NewBatchError(errs)
+}
+
+func (dao *S3Dao) StoreTextsInS3(s3BucketName string, s3Keys, payloadContentStrs []string, options s3.StoreOptions) ([]s3.StoreResult, error) {
+	if err := dao.enterBatch(StoreTextsInS3); err != nil {
+		return nil, err
+	}
+	if len(s3Keys) != len(payloadContentStrs) {
+		return nil, errors.New("The number of S3Client keys and payloads must be equal.")
+	}
+	results := make([]s3.StoreResult, len(s3Keys))
+	errs := make([]error, len(s3Keys))
+	for i, s3Key := range s3Keys {
+		results[i], errs[i] = dao.StoreTextInS3WithOptions(s3BucketName, s3Key, payloadContentStrs[i], options)
+	}
+	return results, s3.NewBatchError(errs)
+}
+
+func (dao *S3Dao) DeletePayloadsFromS3(s3BucketName string, s3Keys []string) error {
+	if err := dao.enterBatch(DeletePayloadsFromS3); err != nil {
+		return err
+	}
+	errs := make([]error, len(s3Keys))
+	for i, s3Key := range s3Keys {
+		errs[i] = dao.DeletePayloadFromS3(s3BucketName, s3Key)
+	}
+	return s3.NewBatchError(errs)
+}
+
+// FailNext makes the next call of op return err.
+func (dao *S3Dao) FailNext(op Operation, err error) {
+	dao.FailTimes(op, err, 1)
+}
+
+// FailTimes makes the next n calls of op return err. A negative n makes every call fail until ClearFaults is called, a
+// zero n removes the fault injected for op.
+func (dao *S3Dao) FailTimes(op Operation, err error, n int) {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	if n == 0 {
+		delete(dao.faults, op)
+		return
+	}
+	dao.faults[op] = &fault{err: err, remaining: n}
+}
+
+// ClearFaults removes all injected faults.
+func (dao *S3Dao) ClearFaults() {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	dao.faults = make(map[Operation]*fault)
+}
+
+// Calls returns how many times op has been called, including calls that failed.
+func (dao *S3Dao) Calls(op Operation) int {
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	return dao.calls[op]
+}
+
+// EnableVersioning makes the bucket keep every version of its objects, like an S3 bucket with versioning enabled.
+func (dao *S3Dao) EnableVersioning(s3BucketName string) {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	dao.versioned[s3BucketName] = true
+}
+
+// Versions returns the version ids of the given key, oldest first. Delete markers are included.
+func (dao *S3Dao) Versions(s3BucketName, s3Key string) []string {
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	versionIds := make([]string, 0)
+	for _, version := range dao.versions[objectId{s3BucketName, s3Key}] {
+		versionIds = append(versionIds, version.versionId)
+	}
+	return versionIds
+}
+
+// Object returns the payload stored under the given bucket and key.
+func (dao *S3Dao) Object(s3BucketName, s3Key string) (string, bool) {
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	stored, ok := dao.objects[objectId{s3BucketName, s3Key}]
+	return stored.payload, ok
+}
+
+// Options returns the options the object stored under the given bucket and key was stored with.
+func (dao *S3Dao) Options(s3BucketName, s3Key string) (s3.StoreOptions, bool) {
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	stored, ok := dao.objects[objectId{s3BucketName, s3Key}]
+	return stored.options, ok
+}
+
+// Keys returns the sorted keys of all objects stored in the given bucket.
+func (dao *S3Dao) Keys(s3BucketName string) []string {
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	keys := make([]string, 0)
+	for id := range dao.objects {
+		if id.bucket == s3BucketName {
+			keys = append(keys, id.key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Len returns the number of objects stored across all buckets.
+func (dao *S3Dao) Len() int {
+	dao.mu.RLock()
+	defer dao.mu.RUnlock()
+	return len(dao.objects)
+}
+
+// Reset removes all objects, faults and call counts.
+func (dao *S3Dao) Reset() {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	dao.objects = make(map[objectId]object)
+	dao.versioned = make(map[string]bool)
+	dao.versions = make(map[objectId][]object)
+	dao.faults = make(map[Operation]*fault)
+	dao.calls = make(map[Operation]int)
+}
+
+// store saves an object and returns its result. The caller must hold the write lock.
+func (dao *S3Dao) store(s3BucketName, s3Key, payloadContentStr string, options s3.StoreOptions) s3.StoreResult {
+	id := objectId{s3BucketName, s3Key}
+	stored := object{payload: payloadContentStr, options: options, lastModified: time.Now()}
+	if dao.versioned[s3BucketName] {
+		stored.versionId = dao.newVersionId()
+		dao.versions[id] = append(dao.versions[id], stored)
+	}
+	dao.objects[id] = stored
+	return s3.StoreResult{ETag: etag(payloadContentStr), VersionId: stored.versionId}
+}
+
+// etag returns the ETag S3 computes for a payload uploaded in a single part
+func etag(payload string) string {
+	sum := md5.Sum([]byte(payload))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// get returns the given version of an object, or its current version when versionId is empty. The caller must hold
+// the write lock.
+func (dao *S3Dao) get(s3BucketName, s3Key, versionId string) (string, error) {
+	stored, ok := dao.find(s3BucketName, s3Key, versionId)
+	if !ok {
+		err := errors.New("Failed to get the S3Client object which contains the payload.")
+		log.Println(err)
+		return "", err
+	}
+	return stored.payload, nil
+}
+
+// find returns the given version of an object, or its current version when versionId is empty. The caller must hold
+// the lock.
+func (dao *S3Dao) find(s3BucketName, s3Key, versionId string) (object, bool) {
+	id := objectId{s3BucketName, s3Key}
+	stored, ok := dao.objects[id]
+	if versionId != "" {
+		ok = false
+		for _, version := range dao.versions[id] {
+			if version.versionId == versionId && !version.deleteMarker {
+				stored, ok = version, true
+			}
+		}
+	}
+	return stored, ok
+}
+
+// delete deletes an object like S3 does: in a versioned bucket deleting the object adds a delete marker and deleting
+// a version removes it for good. Deleting an object that does not exist is not an error. The caller must hold the
+// write lock.
+func (dao *S3Dao) delete(s3BucketName, s3Key, versionId string) {
+	id := objectId{s3BucketName, s3Key}
+	if !dao.versioned[s3BucketName] {
+		if versionId == "" || versionId == "null" {
+			delete(dao.objects, id)
+		}
+		return
+	}
+	if versionId == "" {
+		dao.versions[id] = append(dao.versions[id], object{versionId: dao.newVersionId(), lastModified: time.Now(), deleteMarker: true})
+		delete(dao.objects, id)
+		return
+	}
+
+	versions := make([]object, 0, len(dao.versions[id]))
+	for _, version := range dao.versions[id] {
+		if version.versionId != versionId {
+			versions = append(versions, version)
+		}
+	}
+	switch {
+	case len(versions) == 0:
+		delete(dao.versions, id)
+		delete(dao.objects, id)
+	case versions[len(versions)-1].deleteMarker:
+		dao.versions[id] = versions
+		delete(dao.objects, id)
+	default:
+		dao.versions[id] = versions
+		dao.objects[id] = versions[len(versions)-1]
+	}
+}
+
+func (dao *S3Dao) newVersionId() string {
+	dao.nextVersionId++
+	return strconv.Itoa(dao.nextVersionId)
+}
+
+func (dao *S3Dao) enterBatch(op Operation) error {
+	dao.mu.Lock()
+	defer dao.mu.Unlock()
+	return dao.enter(op)
+}
+
+// enter records a call of op and returns the injected fault for it, if any. The caller must hold the write lock.
+func (dao *S3Dao) enter(op Operation) error {
+	dao.calls[op]++
+	f, ok := dao.faults[op]
+	if !ok {
+		return nil
+	}
+	if f.remaining > 0 {
+		f.remaining--
+		if f.remaining == 0 {
+			delete(dao.faults, op)
+		}
+	}
+	log.Println(f.err)
+	return f.err
+}
@@ -0,0 +1,134 @@
+package inmemory
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+)
+
+const (
+	s3BucketName = "test-bucket-name"
+	anyS3Key     = "AnyS3key"
+	anyPayload   = "AnyPayload"
+)
+
+func TestMain(m *testing.M) {
+	// Suppress logging in unit tests
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func TestPayloadStoreRoundTrip(t *testing.T) {
+	payloadStore, dao := NewPayloadStore(s3BucketName)
+
+	ptrJson, err := payloadStore.StoreOriginalPayload(anyPayload)
+	assert.NoError(t, err)
+
+	pointer, err := payload.FromJson(ptrJson)
+	assert.NoError(t, err)
+	assert.Equal(t, s3BucketName, pointer.S3BucketName)
+	assert.Equal(t, []string{pointer.S3Key}, dao.Keys(s3BucketName))
+
+	actualPayload, err := payloadStore.GetOriginalPayload(ptrJson)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+
+	assert.NoError(t, payloadStore.DeleteOriginalPayload(ptrJson))
+	assert.Equal(t, 0, dao.Len())
+	_, err = payloadStore.GetOriginalPayload(ptrJson)
+	assert.Error(t, err)
+}
+
+func TestStoreTextInS3OverwritesExistingObject(t *testing.T) {
+	dao := NewS3Dao()
+
+	assert.NoError(t, dao.StoreTextInS3(s3BucketName, anyS3Key, "first"))
+	assert.NoError(t, dao.StoreTextInS3(s3BucketName, anyS3Key, anyPayload))
+
+	actualPayload, ok := dao.Object(s3BucketName, anyS3Key)
+	assert.True(t, ok)
+	assert.Equal(t, anyPayload, actualPayload)
+	assert.Equal(t, 2, dao.Calls(StoreTextInS3))
+}
+
+func TestStoreTextInS3WithOptionsReturnsETag(t *testing.T) {
+	dao := NewS3Dao()
+
+	result, err := dao.StoreTextInS3WithOptions(s3BucketName, anyS3Key, anyPayload, s3.StoreOptions{ContentType: "text/plain"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, s3.StoreResult{ETag: `"08269d3d09c23249009e7126d1b56ed0"`}, result)
+	assert.Equal(t, 1, dao.Calls(StoreTextInS3WithOptions))
+	assert.Equal(t, 1, dao.Calls(StoreTextInS3))
+}
+
+func TestDeletePayloadFromS3MissingObject(t *testing.T) {
+	dao := NewS3Dao()
+
+	assert.NoError(t, dao.DeletePayloadFromS3(s3BucketName, anyS3Key))
+}
+
+func TestFailNext(t *testing.T) {
+	dao := NewS3Dao()
+	expectedError := errors.New("S3Client Exception")
+	dao.FailNext(StoreTextInS3, expectedError)
+
+	assert.Equal(t, expectedError, dao.StoreTextInS3(s3BucketName, anyS3Key, anyPayload))
+	assert.NoError(t, dao.StoreTextInS3(s3BucketName, anyS3Key, anyPayload))
+	assert.Equal(t, 2, dao.Calls(StoreTextInS3))
+}
+
+func TestFailTimesZero(t *testing.T) {
+	dao := NewS3Dao()
+	expectedError := errors.New("S3Client Exception")
+	dao.FailTimes(StoreTextInS3, expectedError, 0)
+	assert.NoError(t, dao.StoreTextInS3(s3BucketName, anyS3Key, anyPayload))
+
+	// Clears the fault injected before
+	dao.FailTimes(StoreTextInS3, expectedError, -1)
+	dao.FailTimes(StoreTextInS3, expectedError, 0)
+	assert.NoError(t, dao.StoreTextInS3(s3BucketName, anyS3Key, anyPayload))
+}
+
+func TestFailTimesUntilCleared(t *testing.T) {
+	payloadStore, dao := NewPayloadStore(s3BucketName)
+	expectedError := errors.New("S3Client Exception")
+	dao.FailTimes(GetTextFromS3, expectedError, -1)
+
+	ptrJson, _ := payloadStore.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+	for i := 0; i < 3; i++ {
+		_, err := payloadStore.GetOriginalPayload(ptrJson)
+		assert.Equal(t, expectedError, err)
+	}
+
+	dao.ClearFaults()
+	actualPayload, err := payloadStore.GetOriginalPayload(ptrJson)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	payloadStore, dao := NewPayloadStore(s3BucketName)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ptrJson, err := payloadStore.StoreOriginalPayload(anyPayload)
+			assert.NoError(t, err)
+			actualPayload, err := payloadStore.GetOriginalPayload(ptrJson)
+			assert.NoError(t, err)
+			assert.Equal(t, anyPayload, actualPayload)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 50, dao.Len())
+}
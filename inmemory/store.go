@@ -0,0 +1,12 @@
+package inmemory
+
+import (
+	"github.com/threehook/aws-payload-offloading-go/payload"
+)
+
+// NewPayloadStore returns an S3BackedPayloadStore for the given bucket that keeps its objects in memory. The returned
+// S3Dao can be used to inspect the stored objects and to inject faults.
+func NewPayloadStore(s3BucketName string) (*payload.S3BackedPayloadStore, *S3Dao) {
+	dao := NewS3Dao()
+	return &payload.S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: dao}, dao
+}
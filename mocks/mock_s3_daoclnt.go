@@ -8,6 +8,7 @@ import (
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
+	s3 "github.com/threehook/aws-payload-offloading-go/s3"
 )
 
 // MockS3DaoClientI is a mock of S3DaoClientI interface.
@@ -33,6 +34,50 @@ func (m *MockS3DaoClientI) EXPECT() *MockS3DaoClientIMockRecorder {
 	return m.recorder
 }
 
+// CopyObjectInS3 mocks base method.
+func (m *MockS3DaoClientI) CopyObjectInS3(arg0, arg1, arg2, arg3, arg4 string) (s3.StoreResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CopyObjectInS3", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(s3.StoreResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CopyObjectInS3 indicates an expected call of CopyObjectInS3.
+func (mr *MockS3DaoClientIMockRecorder) CopyObjectInS3(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CopyObjectInS3", reflect.TypeOf((*MockS3DaoClientI)(nil).CopyObjectInS3), arg0, arg1, arg2, arg3, arg4)
+}
+
+// CopyObjectInS3WithOptions mocks base method.
+func (m *MockS3DaoClientI) CopyObjectInS3WithOptions(arg0, arg1, arg2, arg3, arg4 string, arg5 s3.StoreOptions) (s3.StoreResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CopyObjectInS3WithOptions", arg0, arg1, arg2, arg3, arg4, arg5)
+	ret0, _ := ret[0].(s3.StoreResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CopyObjectInS3WithOptions indicates an expected call of CopyObjectInS3WithOptions.
+func (mr *MockS3DaoClientIMockRecorder) CopyObjectInS3WithOptions(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CopyObjectInS3WithOptions", reflect.TypeOf((*MockS3DaoClientI)(nil).CopyObjectInS3WithOptions), arg0, arg1, arg2, arg3, arg4, arg5)
+}
+
+// DeleteAllVersionsFromS3 mocks base method.
+func (m *MockS3DaoClientI) DeleteAllVersionsFromS3(arg0, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteAllVersionsFromS3", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteAllVersionsFromS3 indicates an expected call of DeleteAllVersionsFromS3.
+func (mr *MockS3DaoClientIMockRecorder) DeleteAllVersionsFromS3(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteAllVersionsFromS3", reflect.TypeOf((*MockS3DaoClientI)(nil).DeleteAllVersionsFromS3), arg0, arg1)
+}
+
 // DeletePayloadFromS3 mocks base method.
 func (m *MockS3DaoClientI) DeletePayloadFromS3(arg0, arg1 string) error {
 	m.ctrl.T.Helper()
@@ -47,6 +92,79 @@ func (mr *MockS3DaoClientIMockRecorder) DeletePayloadFromS3(arg0, arg1 interface
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeletePayloadFromS3", reflect.TypeOf((*MockS3DaoClientI)(nil).DeletePayloadFromS3), arg0, arg1)
 }
 
+// DeletePayloadVersionFromS3 mocks base method.
+func (m *MockS3DaoClientI) DeletePayloadVersionFromS3(arg0, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeletePayloadVersionFromS3", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeletePayloadVersionFromS3 indicates an expected call of DeletePayloadVersionFromS3.
+func (mr *MockS3DaoClientIMockRecorder) DeletePayloadVersionFromS3(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeletePayloadVersionFromS3", reflect.TypeOf((*MockS3DaoClientI)(nil).DeletePayloadVersionFromS3), arg0, arg1, arg2)
+}
+
+// DeletePayloadsFromS3 mocks base method.
+func (m *MockS3DaoClientI) DeletePayloadsFromS3(arg0 string, arg1 []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeletePayloadsFromS3", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeletePayloadsFromS3 indicates an expected call of DeletePayloadsFromS3.
+func (mr *MockS3DaoClientIMockRecorder) DeletePayloadsFromS3(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeletePayloadsFromS3", reflect.TypeOf((*MockS3DaoClientI)(nil).DeletePayloadsFromS3), arg0, arg1)
+}
+
+// DoesBucketExistInS3 mocks base method.
+func (m *MockS3DaoClientI) DoesBucketExistInS3(arg0 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DoesBucketExistInS3", arg0)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DoesBucketExistInS3 indicates an expected call of DoesBucketExistInS3.
+func (mr *MockS3DaoClientIMockRecorder) DoesBucketExistInS3(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DoesBucketExistInS3", reflect.TypeOf((*MockS3DaoClientI)(nil).DoesBucketExistInS3), arg0)
+}
+
+// DoesObjectExistInS3 mocks base method.
+func (m *MockS3DaoClientI) DoesObjectExistInS3(arg0, arg1 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DoesObjectExistInS3", arg0, arg1)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DoesObjectExistInS3 indicates an expected call of DoesObjectExistInS3.
+func (mr *MockS3DaoClientIMockRecorder) DoesObjectExistInS3(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DoesObjectExistInS3", reflect.TypeOf((*MockS3DaoClientI)(nil).DoesObjectExistInS3), arg0, arg1)
+}
+
+// GetObjectMetadataFromS3 mocks base method.
+func (m *MockS3DaoClientI) GetObjectMetadataFromS3(arg0, arg1 string) (*s3.ObjectMetadata, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetObjectMetadataFromS3", arg0, arg1)
+	ret0, _ := ret[0].(*s3.ObjectMetadata)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetObjectMetadataFromS3 indicates an expected call of GetObjectMetadataFromS3.
+func (mr *MockS3DaoClientIMockRecorder) GetObjectMetadataFromS3(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetObjectMetadataFromS3", reflect.TypeOf((*MockS3DaoClientI)(nil).GetObjectMetadataFromS3), arg0, arg1)
+}
+
 // GetTextFromS3 mocks base method.
 func (m *MockS3DaoClientI) GetTextFromS3(arg0, arg1 string) (string, error) {
 	m.ctrl.T.Helper()
@@ -62,6 +180,65 @@ func (mr *MockS3DaoClientIMockRecorder) GetTextFromS3(arg0, arg1 interface{}) *g
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTextFromS3", reflect.TypeOf((*MockS3DaoClientI)(nil).GetTextFromS3), arg0, arg1)
 }
 
+// GetTextFromS3Version mocks base method.
+func (m *MockS3DaoClientI) GetTextFromS3Version(arg0, arg1, arg2 string) (string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTextFromS3Version", arg0, arg1, arg2)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTextFromS3Version indicates an expected call of GetTextFromS3Version.
+func (mr *MockS3DaoClientIMockRecorder) GetTextFromS3Version(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTextFromS3Version", reflect.TypeOf((*MockS3DaoClientI)(nil).GetTextFromS3Version), arg0, arg1, arg2)
+}
+
+// GetTextsFromS3 mocks base method.
+func (m *MockS3DaoClientI) GetTextsFromS3(arg0 string, arg1 []string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetTextsFromS3", arg0, arg1)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetTextsFromS3 indicates an expected call of GetTextsFromS3.
+func (mr *MockS3DaoClientIMockRecorder) GetTextsFromS3(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTextsFromS3", reflect.TypeOf((*MockS3DaoClientI)(nil).GetTextsFromS3), arg0, arg1)
+}
+
+// ListObjectPagesInS3 mocks base method.
+func (m *MockS3DaoClientI) ListObjectPagesInS3(arg0, arg1 string, arg2 func([]s3.ObjectSummary) bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListObjectPagesInS3", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ListObjectPagesInS3 indicates an expected call of ListObjectPagesInS3.
+func (mr *MockS3DaoClientIMockRecorder) ListObjectPagesInS3(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListObjectPagesInS3", reflect.TypeOf((*MockS3DaoClientI)(nil).ListObjectPagesInS3), arg0, arg1, arg2)
+}
+
+// ListObjectsInS3 mocks base method.
+func (m *MockS3DaoClientI) ListObjectsInS3(arg0, arg1 string) ([]s3.ObjectSummary, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListObjectsInS3", arg0, arg1)
+	ret0, _ := ret[0].([]s3.ObjectSummary)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListObjectsInS3 indicates an expected call of ListObjectsInS3.
+func (mr *MockS3DaoClientIMockRecorder) ListObjectsInS3(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListObjectsInS3", reflect.TypeOf((*MockS3DaoClientI)(nil).ListObjectsInS3), arg0, arg1)
+}
+
 // StoreTextInS3 mocks base method.
 func (m *MockS3DaoClientI) StoreTextInS3(arg0, arg1, arg2 string) error {
 	m.ctrl.T.Helper()
@@ -75,3 +252,33 @@ func (mr *MockS3DaoClientIMockRecorder) StoreTextInS3(arg0, arg1, arg2 interface
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StoreTextInS3", reflect.TypeOf((*MockS3DaoClientI)(nil).StoreTextInS3), arg0, arg1, arg2)
 }
+
+// StoreTextInS3WithOptions mocks base method.
+func (m *MockS3DaoClientI) StoreTextInS3WithOptions(arg0, arg1, arg2 string, arg3 s3.StoreOptions) (s3.StoreResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StoreTextInS3WithOptions", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(s3.StoreResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// StoreTextInS3WithOptions indicates an expected call of StoreTextInS3WithOptions.
+func (mr *MockS3DaoClientIMockRecorder) StoreTextInS3WithOptions(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StoreTextInS3WithOptions", reflect.TypeOf((*MockS3DaoClientI)(nil).StoreTextInS3WithOptions), arg0, arg1, arg2, arg3)
+}
+
+// StoreTextsInS3 mocks base method.
+func (m *MockS3DaoClientI) StoreTextsInS3(arg0 string, arg1, arg2 []string, arg3 s3.StoreOptions) ([]s3.StoreResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StoreTextsInS3", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].([]s3.StoreResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// StoreTextsInS3 indicates an expected call of StoreTextsInS3.
+func (mr *MockS3DaoClientIMockRecorder) StoreTextsInS3(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StoreTextsInS3", reflect.TypeOf((*MockS3DaoClientI)(nil).StoreTextsInS3), arg0, arg1, arg2, arg3)
+}
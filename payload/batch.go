@@ -0,0 +1,206 @@
+package payload
+
+import (
+	"errors"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"github.com/threehook/aws-payload-offloading-go/util"
+	"log"
+)
+
+// BatchError is returned by the batch operations of a PayloadStore when some of the items failed. Its Errors are
+// indexed like the payloads or pointers of the batch.
+type BatchError = s3.BatchError
+
+// StoreEach stores payloads one by one on at most concurrency goroutines. It implements StoreOriginalPayloads for
+// stores without a native batch operation.
+func StoreEach(store PayloadStore, payloads []string, concurrency int) ([]string, error) {
+	payloadPointers := make([]string, len(payloads))
+	errs := util.RunConcurrently(len(payloads), concurrency, func(i int) error {
+		var err error
+		payloadPointers[i], err = store.StoreOriginalPayload(payloads[i])
+		return err
+	})
+	return payloadPointers, s3.NewBatchError(errs)
+}
+
+// GetEach retrieves payloads one by one on at most concurrency goroutines. It implements GetOriginalPayloads for
+// stores without a native batch operation.
+func GetEach(store PayloadStore, payloadPointers []string, concurrency int) ([]string, error) {
+	payloads := make([]string, len(payloadPointers))
+	errs := util.RunConcurrently(len(payloadPointers), concurrency, func(i int) error {
+		var err error
+		payloads[i], err = store.GetOriginalPayload(payloadPointers[i])
+		return err
+	})
+	return payloads, s3.NewBatchError(errs)
+}
+
+// DeleteEach deletes payloads one by one on at most concurrency goroutines. It implements DeleteOriginalPayloads for
+// stores without a native batch operation.
+func DeleteEach(store PayloadStore, payloadPointers []string, concurrency int) error {
+	errs := util.RunConcurrently(len(payloadPointers), concurrency, func(i int) error {
+		return store.DeleteOriginalPayload(payloadPointers[i])
+	})
+	return s3.NewBatchError(errs)
+}
+
+func (bps *S3BackedPayloadStore) StoreOriginalPayloads(payloads []string) ([]string, error) {
+	if bps.Deduplicate {
+		return StoreEach(bps, payloads, s3.DefaultBatchConcurrency)
+	}
+
+	errs := make([]error, len(payloads))
+	var indexes []int
+	var s3Keys, contents []string
+	for i, payload := range payloads {
+		s3Key, err := next(bps.KeyGenerator).GenerateKey()
+		if err != nil {
+			log.Println(err)
+			errs[i] = err
+			continue
+		}
+		indexes = append(indexes, i)
+		s3Keys = append(s3Keys, s3Key)
+		contents = append(contents, payload)
+	}
+
+	payloadPointers := make([]string, len(payloads))
+	results, err := bps.S3Dao.StoreTextsInS3(bps.S3BucketName, s3Keys, contents, bps.storeOptions())
+	storeErrs := itemErrors(err, len(s3Keys))
+	for j, i := range indexes {
+		if storeErrs[j] != nil {
+			errs[i] = storeErrs[j]
+			continue
+		}
+		s3Pointer := bps.newPointer(s3Keys[j], contents[j], results[j])
+		payloadPointers[i], errs[i] = bps.encodePointer(&s3Pointer)
+	}
+	log.Printf("S3Client objects created, Bucket name: %s, Number of objects: %d.", bps.S3BucketName, len(s3Keys)) // info
+
+	return payloadPointers, s3.NewBatchError(errs)
+}
+
+func (bps *S3BackedPayloadStore) GetOriginalPayloads(payloadPointers []string) ([]string, error) {
+	payloads := make([]string, len(payloadPointers))
+	errs := make([]error, len(payloadPointers))
+	for s3BucketName, group := range groupByBucket(payloadPointers, errs) {
+		var indexes []int
+		var s3Keys []string
+		for j, i := range group.indexes {
+			if errs[i] = bps.checkExpiry(group.pointers[j]); errs[i] != nil {
+				continue
+			}
+			if group.pointers[j].VersionId != "" {
+				// Versioned reads are not batched
+				payloads[i], errs[i] = bps.GetOriginalPayload(payloadPointers[i])
+				continue
+			}
+			if bps.Cache != nil {
+				if cached, ok := bps.Cache.Get(s3BucketName, group.s3Keys[j]); ok {
+					payloads[i] = cached
+					continue
+				}
+			}
+			indexes = append(indexes, i)
+			s3Keys = append(s3Keys, group.s3Keys[j])
+		}
+		if len(s3Keys) == 0 {
+			continue
+		}
+
+		var generation uint64
+		if bps.Cache != nil {
+			generation = bps.Cache.Generation()
+		}
+		groupPayloads, err := bps.S3Dao.GetTextsFromS3(s3BucketName, s3Keys)
+		groupErrs := itemErrors(err, len(s3Keys))
+		for j, i := range indexes {
+			if groupErrs[j] != nil {
+				errs[i] = groupErrs[j]
+				continue
+			}
+			payloads[i] = groupPayloads[j]
+			if bps.Cache != nil {
+				bps.Cache.PutUnlessInvalidated(s3BucketName, s3Keys[j], payloads[i], generation)
+			}
+		}
+	}
+	return payloads, s3.NewBatchError(errs)
+}
+
+func (bps *S3BackedPayloadStore) DeleteOriginalPayloads(payloadPointers []string) error {
+	errs := make([]error, len(payloadPointers))
+	for s3BucketName, group := range groupByBucket(payloadPointers, errs) {
+		var indexes []int
+		var s3Keys []string
+		for j, i := range group.indexes {
+			s3Pointer := group.pointers[j]
+			if bps.Cache != nil {
+				bps.Cache.Invalidate(s3BucketName, versionedKey(s3Pointer))
+			}
+			switch {
+			case s3Pointer.ExpectedConsumers > 1:
+				errs[i] = bps.releaseSharedPayload(s3Pointer, bps.ConsumerId)
+			case s3Pointer.ContentAddressed:
+				// Other pointers may share this object, leave it to the bucket lifecycle rules
+			case bps.DeleteAllVersions || s3Pointer.VersionId != "":
+				// Deletes of versions are not batched
+				errs[i] = bps.deleteObject(s3Pointer)
+			default:
+				indexes = append(indexes, i)
+				s3Keys = append(s3Keys, s3Pointer.S3Key)
+			}
+		}
+		if len(s3Keys) == 0 {
+			continue
+		}
+		deleteErrs := itemErrors(bps.S3Dao.DeletePayloadsFromS3(s3BucketName, s3Keys), len(s3Keys))
+		for j, i := range indexes {
+			errs[i] = deleteErrs[j]
+		}
+	}
+	return s3.NewBatchError(errs)
+}
+
+type bucketGroup struct {
+	indexes  []int
+	pointers []*PayloadS3Pointer
+	s3Keys   []string
+}
+
+// groupByBucket parses payloadPointers and groups them by bucket. Pointers that cannot be parsed are reported in errs.
+func groupByBucket(payloadPointers []string, errs []error) map[string]*bucketGroup {
+	groups := make(map[string]*bucketGroup)
+	for i, payloadPointer := range payloadPointers {
+		s3Pointer, err := ParsePointer(payloadPointer)
+		if err != nil {
+			log.Println(err)
+			errs[i] = err
+			continue
+		}
+		group, ok := groups[s3Pointer.S3BucketName]
+		if !ok {
+			group = &bucketGroup{}
+			groups[s3Pointer.S3BucketName] = group
+		}
+		group.indexes = append(group.indexes, i)
+		group.pointers = append(group.pointers, s3Pointer)
+		group.s3Keys = append(group.s3Keys, s3Pointer.S3Key)
+	}
+	return groups
+}
+
+// itemErrors returns the error of every item of a batch of n items that failed with err.
+func itemErrors(err error, n int) []error {
+	var batchError *BatchError
+	if errors.As(err, &batchError) && len(batchError.Errors) == n {
+		return batchError.Errors
+	}
+	errs := make([]error, n)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return errs
+}
@@ -0,0 +1,75 @@
+package payload_test
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/inmemory"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"testing"
+)
+
+func TestBatchRoundTrip(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	payloads := []string{"first", "second", "third"}
+
+	ptrJsons, err := payloadStore.StoreOriginalPayloads(payloads)
+	assert.NoError(t, err)
+	assert.Len(t, ptrJsons, 3)
+	assert.Equal(t, 3, dao.Len())
+	assert.Equal(t, 1, dao.Calls(inmemory.StoreTextsInS3))
+
+	actualPayloads, err := payloadStore.GetOriginalPayloads(ptrJsons)
+	assert.NoError(t, err)
+	assert.Equal(t, payloads, actualPayloads)
+
+	assert.NoError(t, payloadStore.DeleteOriginalPayloads(ptrJsons))
+	assert.Equal(t, 0, dao.Len())
+	assert.Equal(t, 1, dao.Calls(inmemory.DeletePayloadsFromS3))
+}
+
+func TestGetOriginalPayloadsPartialFailure(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	ptrJsons, _ := payloadStore.StoreOriginalPayloads([]string{"first", "second"})
+	otherBucket := &payload.S3BackedPayloadStore{S3BucketName: "other-bucket", S3Dao: dao}
+	otherPtrJson, _ := otherBucket.StoreOriginalPayload("third")
+
+	actualPayloads, err := payloadStore.GetOriginalPayloads([]string{ptrJsons[0], "IncorrectPointer", otherPtrJson, ptrJsons[1]})
+
+	var batchError *payload.BatchError
+	assert.True(t, errors.As(err, &batchError))
+	assert.NoError(t, batchError.Err(0))
+	assert.Error(t, batchError.Err(1))
+	assert.NoError(t, batchError.Err(2))
+	assert.NoError(t, batchError.Err(3))
+	assert.Equal(t, []string{"first", "", "third", "second"}, actualPayloads)
+}
+
+func TestStoreOriginalPayloadsOnS3Failure(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	dao.FailNext(inmemory.StoreTextsInS3, errors.New("S3Client Exception"))
+
+	ptrJsons, err := payloadStore.StoreOriginalPayloads([]string{"first", "second"})
+
+	var batchError *payload.BatchError
+	assert.True(t, errors.As(err, &batchError))
+	assert.Error(t, batchError.Err(0))
+	assert.Error(t, batchError.Err(1))
+	assert.Equal(t, []string{"", ""}, ptrJsons)
+}
+
+func TestDeleteOriginalPayloadsHonoursSharedPayloads(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	payloadStore.ConsumerId = "consumer-0"
+	sharedPtrJson, _ := payloadStore.StoreOriginalPayloadForConsumers("shared", 2)
+	ptrJson, _ := payloadStore.StoreOriginalPayload("single")
+
+	assert.NoError(t, payloadStore.DeleteOriginalPayloads([]string{sharedPtrJson, ptrJson}))
+
+	actualPayload, err := payloadStore.GetOriginalPayload(sharedPtrJson)
+	assert.NoError(t, err)
+	assert.Equal(t, "shared", actualPayload)
+	_, err = payloadStore.GetOriginalPayload(ptrJson)
+	assert.Error(t, err)
+	// The shared payload and the acknowledgement of consumer-0
+	assert.Equal(t, 2, dao.Len())
+}
@@ -0,0 +1,182 @@
+package payload
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maxTombstones bounds the number of invalidations a PayloadCache remembers for reads that are still in flight
+const maxTombstones = 1024
+
+// PayloadCache is a least recently used cache of retrieved payloads, bounded by the total size of the cached payloads
+// in bytes. Set it on S3BackedPayloadStore.Cache to serve repeated reads of the same pointer from memory.
+type PayloadCache struct {
+	mu          sync.Mutex
+	maxBytes    int64
+	ttl         time.Duration
+	size        int64
+	entries     map[cacheKey]*list.Element
+	lru         *list.List
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	generation  uint64
+	tombstones  map[cacheKey]uint64
+	invalidated *list.List
+	floor       uint64
+}
+
+// CacheStats is a snapshot of the counters of a PayloadCache
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+}
+
+type cacheKey struct {
+	s3BucketName string
+	s3Key        string
+}
+
+type cacheEntry struct {
+	key       cacheKey
+	payload   string
+	expiresAt time.Time
+}
+
+type tombstone struct {
+	key        cacheKey
+	generation uint64
+}
+
+// NewPayloadCache returns a cache holding at most maxBytes of payloads. Entries expire after ttl, a ttl of zero keeps
+// them until they are evicted or invalidated.
+func NewPayloadCache(maxBytes int64, ttl time.Duration) *PayloadCache {
+	return &PayloadCache{
+		maxBytes:    maxBytes,
+		ttl:         ttl,
+		entries:     make(map[cacheKey]*list.Element),
+		lru:         list.New(),
+		tombstones:  make(map[cacheKey]uint64),
+		invalidated: list.New(),
+	}
+}
+
+// Get returns the cached payload of the given object.
+func (c *PayloadCache) Get(s3BucketName, s3Key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[cacheKey{s3BucketName, s3Key}]
+	if !ok {
+		c.misses++
+		return "", false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		c.remove(element)
+		c.misses++
+		return "", false
+	}
+	c.lru.MoveToFront(element)
+	c.hits++
+	return entry.payload, true
+}
+
+// Put caches the payload of the given object, evicting the least recently used payloads when the cache is full.
+// Payloads larger than the cache are not cached.
+func (c *PayloadCache) Put(s3BucketName, s3Key, payload string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.put(cacheKey{s3BucketName, s3Key}, payload)
+}
+
+// Generation returns the current generation of the cache. Take it before reading a payload from S3 and pass it to
+// PutUnlessInvalidated, so a payload deleted while it was read is not cached again.
+func (c *PayloadCache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+// PutUnlessInvalidated is Put for a payload read at the given Generation. The payload is not cached when the object was
+// invalidated after that generation.
+func (c *PayloadCache) PutUnlessInvalidated(s3BucketName, s3Key, payload string, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey{s3BucketName, s3Key}
+	if generation < c.floor || generation < c.tombstones[key] {
+		return
+	}
+	c.put(key, payload)
+}
+
+// put caches payload under key. The caller must hold the lock.
+func (c *PayloadCache) put(key cacheKey, payload string) {
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	size := entrySize(key, payload)
+	if size > c.maxBytes {
+		return
+	}
+	for c.size+size > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+
+	entry := &cacheEntry{key: key, payload: payload}
+	if c.ttl > 0 {
+		entry.expiresAt = time.Now().Add(c.ttl)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += size
+}
+
+// Invalidate removes the payload of the given object from the cache. Reads of the object that are in flight do not
+// cache it again, see PutUnlessInvalidated.
+func (c *PayloadCache) Invalidate(s3BucketName, s3Key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey{s3BucketName, s3Key}
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+
+	c.generation++
+	c.tombstones[key] = c.generation
+	c.invalidated.PushBack(tombstone{key, c.generation})
+	if c.invalidated.Len() > maxTombstones {
+		// Forgetting the oldest tombstone drops the payloads of all reads that started before it
+		oldest := c.invalidated.Remove(c.invalidated.Front()).(tombstone)
+		if c.tombstones[oldest.key] == oldest.generation {
+			delete(c.tombstones, oldest.key)
+		}
+		c.floor = oldest.generation
+	}
+}
+
+func (c *PayloadCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{Hits: c.hits, Misses: c.misses, Evictions: c.evictions, Entries: len(c.entries), Bytes: c.size}
+}
+
+// remove drops element from the cache. The caller must hold the lock.
+func (c *PayloadCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entrySize(entry.key, entry.payload)
+}
+
+func entrySize(key cacheKey, payload string) int64 {
+	return int64(len(key.s3BucketName) + len(key.s3Key) + len(payload))
+}
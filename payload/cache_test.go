@@ -0,0 +1,157 @@
+package payload
+
+import (
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/mocks"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPayloadCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	// Room for two entries of len("bucket") + len("k1") + len("1234567890") bytes
+	cache := NewPayloadCache(2*18, 0)
+
+	cache.Put("bucket", "k1", "1234567890")
+	cache.Put("bucket", "k2", "1234567890")
+	_, ok := cache.Get("bucket", "k1")
+	assert.True(t, ok)
+	cache.Put("bucket", "k3", "1234567890")
+
+	_, ok = cache.Get("bucket", "k2")
+	assert.False(t, ok)
+	_, ok = cache.Get("bucket", "k1")
+	assert.True(t, ok)
+	_, ok = cache.Get("bucket", "k3")
+	assert.True(t, ok)
+	assert.Equal(t, CacheStats{Hits: 3, Misses: 1, Evictions: 1, Entries: 2, Bytes: 36}, cache.Stats())
+}
+
+func TestPayloadCacheSkipsOversizedPayloads(t *testing.T) {
+	cache := NewPayloadCache(64, 0)
+
+	cache.Put("bucket", "key", strings.Repeat("x", 64))
+
+	_, ok := cache.Get("bucket", "key")
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), cache.Stats().Bytes)
+}
+
+func TestPayloadCacheExpiresEntries(t *testing.T) {
+	cache := NewPayloadCache(1024, time.Millisecond)
+
+	cache.Put("bucket", "key", anyPayload)
+	time.Sleep(5 * time.Millisecond)
+
+	_, ok := cache.Get("bucket", "key")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestGetOriginalPayloadIsCached(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
+
+	mockS3Dao.EXPECT().GetTextFromS3(s3BucketName, anyS3Key).Return(anyPayload, nil).Times(2)
+	mockS3Dao.EXPECT().DeletePayloadFromS3(s3BucketName, anyS3Key).Times(1)
+
+	cache := NewPayloadCache(1024, time.Minute)
+	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao, Cache: cache}
+	anyPointer := PayloadS3Pointer{S3BucketName: s3BucketName, S3Key: anyS3Key}
+	ptrJson, _ := anyPointer.ToJson()
+
+	for i := 0; i < 3; i++ {
+		actualPayload, err := payloadStore.GetOriginalPayload(ptrJson)
+		assert.NoError(t, err)
+		assert.Equal(t, anyPayload, actualPayload)
+	}
+	assert.Equal(t, uint64(2), cache.Stats().Hits)
+
+	// Deleting invalidates the cached payload, so the next read goes to S3 again
+	assert.NoError(t, payloadStore.DeleteOriginalPayload(ptrJson))
+	actualPayload, err := payloadStore.GetOriginalPayload(ptrJson)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+}
+
+func TestGetOriginalPayloadsUsesCache(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
+
+	mockS3Dao.EXPECT().GetTextsFromS3(s3BucketName, []string{"other"}).Return([]string{"OtherPayload"}, nil).Times(1)
+
+	cache := NewPayloadCache(1024, 0)
+	cache.Put(s3BucketName, anyS3Key, anyPayload)
+	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao, Cache: cache}
+	cachedPointer, _ := (&PayloadS3Pointer{S3BucketName: s3BucketName, S3Key: anyS3Key}).ToJson()
+	otherPointer, _ := (&PayloadS3Pointer{S3BucketName: s3BucketName, S3Key: "other"}).ToJson()
+
+	actualPayloads, err := payloadStore.GetOriginalPayloads([]string{cachedPointer, otherPointer})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{anyPayload, "OtherPayload"}, actualPayloads)
+	_, ok := cache.Get(s3BucketName, "other")
+	assert.True(t, ok)
+}
+
+func TestPayloadCacheDropsPayloadsInvalidatedWhileRead(t *testing.T) {
+	cache := NewPayloadCache(1024, 0)
+
+	generation := cache.Generation()
+	cache.Invalidate("bucket", "key")
+	cache.PutUnlessInvalidated("bucket", "key", anyPayload, generation)
+	_, ok := cache.Get("bucket", "key")
+	assert.False(t, ok)
+
+	// Reads started after the invalidation are cached, as are reads of other objects
+	cache.PutUnlessInvalidated("bucket", "other", anyPayload, generation)
+	cache.PutUnlessInvalidated("bucket", "key", anyPayload, cache.Generation())
+	assert.Equal(t, 2, cache.Stats().Entries)
+}
+
+func TestPayloadCacheForgetsOldestTombstones(t *testing.T) {
+	cache := NewPayloadCache(1024, 0)
+
+	generation := cache.Generation()
+	cache.Invalidate("bucket", "key")
+	for i := 0; i < maxTombstones; i++ {
+		cache.Invalidate("bucket", "other")
+	}
+	assert.Len(t, cache.tombstones, 1)
+
+	// The tombstone of key is gone, but reads that started before it are still dropped
+	cache.PutUnlessInvalidated("bucket", "key", anyPayload, generation)
+	_, ok := cache.Get("bucket", "key")
+	assert.False(t, ok)
+}
+
+func TestDeleteDuringReadIsNotCached(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
+
+	reading := make(chan struct{})
+	deleted := make(chan struct{})
+	mockS3Dao.EXPECT().GetTextFromS3(s3BucketName, anyS3Key).DoAndReturn(func(string, string) (string, error) {
+		close(reading)
+		<-deleted
+		return anyPayload, nil
+	})
+	mockS3Dao.EXPECT().DeletePayloadFromS3(s3BucketName, anyS3Key).Return(nil)
+
+	cache := NewPayloadCache(1024, 0)
+	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao, Cache: cache}
+	ptrJson, _ := (&PayloadS3Pointer{S3BucketName: s3BucketName, S3Key: anyS3Key}).ToJson()
+
+	go func() {
+		<-reading
+		assert.NoError(t, payloadStore.DeleteOriginalPayload(ptrJson))
+		close(deleted)
+	}()
+	actualPayload, err := payloadStore.GetOriginalPayload(ptrJson)
+
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+	_, ok := cache.Get(s3BucketName, anyS3Key)
+	assert.False(t, ok)
+}
@@ -0,0 +1,77 @@
+package payload
+
+import (
+	"context"
+	"sync"
+)
+
+// ReadCoalescer coalesces concurrent retrievals of the same object into a single S3 request whose result is shared by
+// all callers. Set it on S3BackedPayloadStore.Coalescer.
+type ReadCoalescer struct {
+	mu      sync.Mutex
+	flights map[cacheKey]*flight
+}
+
+type flight struct {
+	done    chan struct{}
+	payload string
+	err     error
+}
+
+func NewReadCoalescer() *ReadCoalescer {
+	return &ReadCoalescer{flights: make(map[cacheKey]*flight)}
+}
+
+// Do calls read unless a read of the same object is already in flight, and waits for its result. The read runs
+// independently of ctx, so a caller that gives up does not fail the other callers waiting for the same object.
+func (rc *ReadCoalescer) Do(ctx context.Context, s3BucketName, s3Key string, read func() (string, error)) (string, error) {
+	key := cacheKey{s3BucketName, s3Key}
+
+	rc.mu.Lock()
+	f, ok := rc.flights[key]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		rc.flights[key] = f
+		go func() {
+			f.payload, f.err = read()
+			rc.mu.Lock()
+			delete(rc.flights, key)
+			rc.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	rc.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.payload, f.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// await calls read and waits for its result or for ctx to be done, whichever comes first.
+func await(ctx context.Context, read func() (string, error)) (string, error) {
+	if ctx.Done() == nil {
+		return read()
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	type result struct {
+		payload string
+		err     error
+	}
+	results := make(chan result, 1)
+	go func() {
+		payload, err := read()
+		results <- result{payload, err}
+	}()
+	select {
+	case r := <-results:
+		return r.payload, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
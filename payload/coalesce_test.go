@@ -0,0 +1,93 @@
+package payload
+
+import (
+	"context"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/mocks"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentGetOriginalPayloadIsCoalesced(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mockS3Dao.EXPECT().GetTextFromS3(s3BucketName, anyS3Key).DoAndReturn(
+		func(s3BucketName, s3Key string) (string, error) {
+			close(started)
+			<-release
+			return anyPayload, nil
+		},
+	).Times(1)
+
+	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao, Coalescer: NewReadCoalescer()}
+	ptrJson, _ := (&PayloadS3Pointer{S3BucketName: s3BucketName, S3Key: anyS3Key}).ToJson()
+
+	var wg sync.WaitGroup
+	results := make(chan string, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		actualPayload, err := payloadStore.GetOriginalPayload(ptrJson)
+		assert.NoError(t, err)
+		results <- actualPayload
+	}()
+	<-started
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			actualPayload, err := payloadStore.GetOriginalPayload(ptrJson)
+			assert.NoError(t, err)
+			results <- actualPayload
+		}()
+	}
+
+	// A caller giving up does not affect the others
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := payloadStore.GetOriginalPayloadWithContext(ctx, ptrJson)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	close(release)
+	wg.Wait()
+	close(results)
+	for actualPayload := range results {
+		assert.Equal(t, anyPayload, actualPayload)
+	}
+}
+
+func TestSequentialReadsAreNotCoalesced(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
+
+	mockS3Dao.EXPECT().GetTextFromS3(s3BucketName, anyS3Key).Return(anyPayload, nil).Times(2)
+
+	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao, Coalescer: NewReadCoalescer()}
+	ptrJson, _ := (&PayloadS3Pointer{S3BucketName: s3BucketName, S3Key: anyS3Key}).ToJson()
+
+	for i := 0; i < 2; i++ {
+		actualPayload, err := payloadStore.GetOriginalPayload(ptrJson)
+		assert.NoError(t, err)
+		assert.Equal(t, anyPayload, actualPayload)
+	}
+}
+
+func TestGetOriginalPayloadWithCancelledContext(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
+
+	mockS3Dao.EXPECT().GetTextFromS3(gomock.Any(), gomock.Any()).Times(0)
+
+	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao}
+	ptrJson, _ := (&PayloadS3Pointer{S3BucketName: s3BucketName, S3Key: anyS3Key}).ToJson()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := payloadStore.GetOriginalPayloadWithContext(ctx, ptrJson)
+	assert.Equal(t, context.Canceled, err)
+}
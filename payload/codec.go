@@ -0,0 +1,412 @@
+package payload
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PointerCodec serialises PayloadS3Pointers to and from strings.
+type PointerCodec interface {
+	Encode(s3Pointer *PayloadS3Pointer) (string, error)
+	Decode(payloadPointer string) (*PayloadS3Pointer, error)
+	// Detect reports whether payloadPointer looks like a pointer encoded by this codec
+	Detect(payloadPointer string) bool
+}
+
+// DefaultPointerCodecs are the codecs tried by ParsePointer, in order.
+var DefaultPointerCodecs = []PointerCodec{
+	&JsonPointerCodec{},
+	&JavaPointerCodec{},
+	&URIPointerCodec{},
+	&BinaryPointerCodec{},
+}
+
+// ParsePointer decodes a pointer in any of the formats of DefaultPointerCodecs.
+func ParsePointer(payloadPointer string) (*PayloadS3Pointer, error) {
+	for _, codec := range DefaultPointerCodecs {
+		if codec.Detect(payloadPointer) {
+			return codec.Decode(payloadPointer)
+		}
+	}
+	err := errors.New("Failed to read the S3Client object pointer from given string")
+	log.Println(err)
+	return nil, err
+}
+
+// validate checks that a decoded pointer names an object.
+func validate(s3Pointer *PayloadS3Pointer) (*PayloadS3Pointer, error) {
+	if s3Pointer.S3BucketName == "" || s3Pointer.S3Key == "" {
+		err := errors.New("The S3Client object pointer does not contain a bucket name and key")
+		log.Println(err)
+		return nil, err
+	}
+	return s3Pointer, nil
+}
+
+// JsonPointerCodec encodes pointers as JSON objects, {"s3BucketName":"...","s3Key":"..."}. It is the default codec.
+type JsonPointerCodec struct{}
+
+func (c *JsonPointerCodec) Encode(s3Pointer *PayloadS3Pointer) (string, error) {
+	return s3Pointer.ToJson()
+}
+
+func (c *JsonPointerCodec) Decode(payloadPointer string) (*PayloadS3Pointer, error) {
+	return FromJson(payloadPointer)
+}
+
+func (c *JsonPointerCodec) Detect(payloadPointer string) bool {
+	return strings.HasPrefix(strings.TrimSpace(payloadPointer), "{")
+}
+
+// JavaPayloadS3PointerClass is the class name in pointers written by the Java payload offloading library.
+const JavaPayloadS3PointerClass = "software.amazon.payloadoffloading.PayloadS3Pointer"
+
+// javaMessageS3PointerClass is the class name in pointers written by older versions of the Java SQS extended client.
+const javaMessageS3PointerClass = "com.amazon.sqs.javamessaging.MessageS3Pointer"
+
+// JavaPointerCodec encodes pointers like the Java payload offloading library does, as a JSON array holding the class
+// name and the pointer. Only the bucket name and key are encoded, as Java consumers reject unknown fields.
+type JavaPointerCodec struct{}
+
+func (c *JavaPointerCodec) Encode(s3Pointer *PayloadS3Pointer) (string, error) {
+	bytes, err := json.Marshal([]interface{}{
+		JavaPayloadS3PointerClass,
+		PayloadS3Pointer{S3BucketName: s3Pointer.S3BucketName, S3Key: s3Pointer.S3Key},
+	})
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+func (c *JavaPointerCodec) Decode(payloadPointer string) (*PayloadS3Pointer, error) {
+	var className string
+	var p PayloadS3Pointer
+	typed := []interface{}{&className, &p}
+	if err := json.Unmarshal([]byte(payloadPointer), &typed); err != nil || len(typed) != 2 ||
+		(className != JavaPayloadS3PointerClass && className != javaMessageS3PointerClass) {
+		log.Println(err)
+		return nil, errors.New("Failed to read the S3Client object pointer from given string")
+	}
+	return validate(&p)
+}
+
+func (c *JavaPointerCodec) Detect(payloadPointer string) bool {
+	return strings.HasPrefix(strings.TrimSpace(payloadPointer), "[")
+}
+
+// URIPointerCodec encodes pointers as s3://bucket/key URIs. Optional pointer fields are added as query parameters.
+type URIPointerCodec struct{}
+
+func (c *URIPointerCodec) Encode(s3Pointer *PayloadS3Pointer) (string, error) {
+	query := url.Values{}
+	setInt := func(name string, value int64) {
+		if value != 0 {
+			query.Set(name, strconv.FormatInt(value, 10))
+		}
+	}
+	setString := func(name, value string) {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	setTime := func(name string, value *time.Time) {
+		if value != nil {
+			query.Set(name, value.Format(time.RFC3339Nano))
+		}
+	}
+	setInt("expectedConsumers", int64(s3Pointer.ExpectedConsumers))
+	setTime("referencesExpireAt", s3Pointer.ReferencesExpireAt)
+	if s3Pointer.ContentAddressed {
+		setInt("contentAddressed", 1)
+	}
+	setInt("size", s3Pointer.Size)
+	setString("contentType", s3Pointer.ContentType)
+	setString("contentEncoding", s3Pointer.ContentEncoding)
+	setString("versionId", s3Pointer.VersionId)
+	setString("eTag", s3Pointer.ETag)
+	setString("region", s3Pointer.Region)
+	setTime("createdAt", s3Pointer.CreatedAt)
+	setString("sha256", s3Pointer.SHA256)
+	setInt("schemaVersion", int64(s3Pointer.SchemaVersion))
+	setTime("expiresAt", s3Pointer.ExpiresAt)
+	for _, replica := range s3Pointer.Replicas {
+		location := url.Values{}
+		for name, value := range map[string]string{"region": replica.Region, "versionId": replica.VersionId, "eTag": replica.ETag} {
+			if value != "" {
+				location.Set(name, value)
+			}
+		}
+		uri := url.URL{Scheme: "s3", Host: replica.S3BucketName, Path: "/" + replica.S3Key, RawQuery: location.Encode()}
+		query.Add("replica", uri.String())
+	}
+
+	uri := url.URL{Scheme: "s3", Host: s3Pointer.S3BucketName, Path: "/" + s3Pointer.S3Key, RawQuery: query.Encode()}
+	return uri.String(), nil
+}
+
+func (c *URIPointerCodec) Decode(payloadPointer string) (*PayloadS3Pointer, error) {
+	uri, err := url.Parse(strings.TrimSpace(payloadPointer))
+	if err != nil || uri.Scheme != "s3" {
+		log.Println(err)
+		return nil, errors.New("Failed to read the S3Client object pointer from given string")
+	}
+	p := PayloadS3Pointer{S3BucketName: uri.Host, S3Key: strings.TrimPrefix(uri.Path, "/")}
+	query := uri.Query()
+	var invalid error
+	getInt := func(name string) int64 {
+		value := query.Get(name)
+		if value == "" {
+			return 0
+		}
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			invalid = err
+		}
+		return i
+	}
+	getTime := func(name string) *time.Time {
+		value := query.Get(name)
+		if value == "" {
+			return nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			invalid = err
+		}
+		return &t
+	}
+	p.ExpectedConsumers = int(getInt("expectedConsumers"))
+	p.ReferencesExpireAt = getTime("referencesExpireAt")
+	p.ContentAddressed = getInt("contentAddressed") != 0
+	p.Size = getInt("size")
+	p.ContentType = query.Get("contentType")
+	p.ContentEncoding = query.Get("contentEncoding")
+	p.VersionId = query.Get("versionId")
+	p.ETag = query.Get("eTag")
+	p.Region = query.Get("region")
+	p.CreatedAt = getTime("createdAt")
+	p.SHA256 = query.Get("sha256")
+	p.SchemaVersion = int(getInt("schemaVersion"))
+	p.ExpiresAt = getTime("expiresAt")
+	for _, replica := range query["replica"] {
+		uri, err := url.Parse(replica)
+		if err != nil || uri.Scheme != "s3" {
+			invalid = errors.New("Failed to read the replica of the S3Client object pointer")
+			continue
+		}
+		location := uri.Query()
+		p.Replicas = append(p.Replicas, PayloadLocation{
+			S3BucketName: uri.Host,
+			S3Key:        strings.TrimPrefix(uri.Path, "/"),
+			Region:       location.Get("region"),
+			VersionId:    location.Get("versionId"),
+			ETag:         location.Get("eTag"),
+		})
+	}
+	if invalid != nil {
+		log.Println(invalid)
+		return nil, errors.New("Failed to read the S3Client object pointer from given string")
+	}
+	return validate(&p)
+}
+
+func (c *URIPointerCodec) Detect(payloadPointer string) bool {
+	return strings.HasPrefix(strings.TrimSpace(payloadPointer), "s3://")
+}
+
+// binaryPointerMagic starts every binary pointer, the second byte is the format version.
+var binaryPointerMagic = []byte{'P', 1}
+
+// Field tags of the binary pointer format. Decoders skip tags they do not know.
+const (
+	binaryTagS3BucketName       = 1
+	binaryTagS3Key              = 2
+	binaryTagExpectedConsumers  = 3
+	binaryTagReferencesExpireAt = 4
+	binaryTagSize               = 5
+	binaryTagContentType        = 6
+	binaryTagContentEncoding    = 7
+	binaryTagVersionId          = 8
+	binaryTagETag               = 9
+	binaryTagRegion             = 10
+	binaryTagCreatedAt          = 11
+	binaryTagSHA256             = 12
+	binaryTagSchemaVersion      = 13
+	binaryTagExpiresAt          = 14
+	// binaryTagReplica holds a PayloadLocation encoded with the tags of the bucket name, key, region, version id and ETag
+	binaryTagReplica          = 15
+	binaryTagContentAddressed = 16
+)
+
+// BinaryPointerCodec encodes pointers in a compact tag-length-value format, using unpadded URL-safe base64 so the
+// pointer fits in message attributes and headers.
+type BinaryPointerCodec struct{}
+
+func (c *BinaryPointerCodec) Encode(s3Pointer *PayloadS3Pointer) (string, error) {
+	buf := append([]byte(nil), binaryPointerMagic...)
+	appendInt := func(tag byte, value int64) {
+		if value != 0 {
+			buf = appendField(buf, tag, varint(value))
+		}
+	}
+	appendString := func(tag byte, value string) {
+		if value != "" {
+			buf = appendField(buf, tag, []byte(value))
+		}
+	}
+	appendTime := func(tag byte, value *time.Time) {
+		if value != nil {
+			buf = appendField(buf, tag, varint(value.UnixNano()))
+		}
+	}
+	buf = appendField(buf, binaryTagS3BucketName, []byte(s3Pointer.S3BucketName))
+	buf = appendField(buf, binaryTagS3Key, []byte(s3Pointer.S3Key))
+	appendInt(binaryTagExpectedConsumers, int64(s3Pointer.ExpectedConsumers))
+	appendTime(binaryTagReferencesExpireAt, s3Pointer.ReferencesExpireAt)
+	if s3Pointer.ContentAddressed {
+		appendInt(binaryTagContentAddressed, 1)
+	}
+	appendInt(binaryTagSize, s3Pointer.Size)
+	appendString(binaryTagContentType, s3Pointer.ContentType)
+	appendString(binaryTagContentEncoding, s3Pointer.ContentEncoding)
+	appendString(binaryTagVersionId, s3Pointer.VersionId)
+	appendString(binaryTagETag, s3Pointer.ETag)
+	appendString(binaryTagRegion, s3Pointer.Region)
+	appendTime(binaryTagCreatedAt, s3Pointer.CreatedAt)
+	appendString(binaryTagSHA256, s3Pointer.SHA256)
+	appendInt(binaryTagSchemaVersion, int64(s3Pointer.SchemaVersion))
+	appendTime(binaryTagExpiresAt, s3Pointer.ExpiresAt)
+	for _, replica := range s3Pointer.Replicas {
+		var location []byte
+		for _, field := range []struct {
+			tag   byte
+			value string
+		}{
+			{binaryTagS3BucketName, replica.S3BucketName},
+			{binaryTagS3Key, replica.S3Key},
+			{binaryTagRegion, replica.Region},
+			{binaryTagVersionId, replica.VersionId},
+			{binaryTagETag, replica.ETag},
+		} {
+			if field.value != "" {
+				location = appendField(location, field.tag, []byte(field.value))
+			}
+		}
+		buf = appendField(buf, binaryTagReplica, location)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func (c *BinaryPointerCodec) Decode(payloadPointer string) (*PayloadS3Pointer, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(payloadPointer))
+	if err != nil || len(buf) < len(binaryPointerMagic) || string(buf[:len(binaryPointerMagic)]) != string(binaryPointerMagic) {
+		log.Println(err)
+		return nil, errors.New("Failed to read the S3Client object pointer from given string")
+	}
+
+	var p PayloadS3Pointer
+	var invalid bool
+	ok := readFields(buf[len(binaryPointerMagic):], func(tag byte, value []byte) {
+		i, _ := binary.Varint(value)
+		switch tag {
+		case binaryTagS3BucketName:
+			p.S3BucketName = string(value)
+		case binaryTagS3Key:
+			p.S3Key = string(value)
+		case binaryTagExpectedConsumers:
+			p.ExpectedConsumers = int(i)
+		case binaryTagReferencesExpireAt:
+			expiresAt := time.Unix(0, i).UTC()
+			p.ReferencesExpireAt = &expiresAt
+		case binaryTagContentAddressed:
+			p.ContentAddressed = i != 0
+		case binaryTagSize:
+			p.Size = i
+		case binaryTagContentType:
+			p.ContentType = string(value)
+		case binaryTagContentEncoding:
+			p.ContentEncoding = string(value)
+		case binaryTagVersionId:
+			p.VersionId = string(value)
+		case binaryTagETag:
+			p.ETag = string(value)
+		case binaryTagRegion:
+			p.Region = string(value)
+		case binaryTagCreatedAt:
+			createdAt := time.Unix(0, i).UTC()
+			p.CreatedAt = &createdAt
+		case binaryTagSHA256:
+			p.SHA256 = string(value)
+		case binaryTagSchemaVersion:
+			p.SchemaVersion = int(i)
+		case binaryTagExpiresAt:
+			expiresAt := time.Unix(0, i).UTC()
+			p.ExpiresAt = &expiresAt
+		case binaryTagReplica:
+			var location PayloadLocation
+			invalid = !readFields(value, func(tag byte, value []byte) {
+				switch tag {
+				case binaryTagS3BucketName:
+					location.S3BucketName = string(value)
+				case binaryTagS3Key:
+					location.S3Key = string(value)
+				case binaryTagRegion:
+					location.Region = string(value)
+				case binaryTagVersionId:
+					location.VersionId = string(value)
+				case binaryTagETag:
+					location.ETag = string(value)
+				}
+			}) || invalid
+			p.Replicas = append(p.Replicas, location)
+		}
+	})
+	if !ok || invalid {
+		return nil, errors.New("Failed to read the S3Client object pointer from given string")
+	}
+	return validate(&p)
+}
+
+func (c *BinaryPointerCodec) Detect(payloadPointer string) bool {
+	prefix := base64.RawURLEncoding.EncodeToString(binaryPointerMagic)
+	return strings.HasPrefix(strings.TrimSpace(payloadPointer), prefix)
+}
+
+// readFields calls fn with the tag and value of every field of buf and reports whether buf could be read.
+func readFields(buf []byte, fn func(tag byte, value []byte)) bool {
+	for len(buf) > 0 {
+		tag := buf[0]
+		length, n := binary.Uvarint(buf[1:])
+		if n <= 0 || uint64(len(buf)-1-n) < length {
+			return false
+		}
+		fn(tag, buf[1+n:1+n+int(length)])
+		buf = buf[1+n+int(length):]
+	}
+	return true
+}
+
+func appendField(buf []byte, tag byte, value []byte) []byte {
+	buf = append(buf, tag)
+	buf = append(buf, uvarint(uint64(len(value)))...)
+	return append(buf, value...)
+}
+
+func uvarint(x uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, x)]
+}
+
+func varint(x int64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutVarint(buf, x)]
+}
@@ -0,0 +1,99 @@
+package payload
+
+import (
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/mocks"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"testing"
+	"time"
+)
+
+func TestPointerCodecsRoundTrip(t *testing.T) {
+	expiresAt := time.Date(2021, 8, 1, 12, 30, 0, 500, time.UTC)
+	createdAt := time.Date(2021, 7, 18, 12, 30, 0, 0, time.UTC)
+	payloadExpiresAt := time.Date(2021, 7, 25, 12, 30, 0, 0, time.UTC)
+	s3Pointer := &PayloadS3Pointer{
+		S3BucketName:       "test-bucket-name",
+		S3Key:              "dir/key with spaces?#%",
+		ExpectedConsumers:  3,
+		ReferencesExpireAt: &expiresAt,
+		ContentAddressed:   true,
+		Size:               1 << 40,
+		ContentType:        "application/json; charset=utf-8",
+		ContentEncoding:    "gzip",
+		VersionId:          "3HL4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY",
+		ETag:               `"d41d8cd98f00b204e9800998ecf8427e"`,
+		Region:             "eu-west-1",
+		CreatedAt:          &createdAt,
+		SHA256:             "83e48a62554d9c19910c15655f463a07fae7e6726d89a4a633bc432877824b2e",
+		SchemaVersion:      PointerSchemaVersion,
+		ExpiresAt:          &payloadExpiresAt,
+		Replicas: []PayloadLocation{
+			{S3BucketName: "secondary-bucket", S3Key: "dir/key with spaces?#%", Region: "us-west-2", VersionId: "v2", ETag: `"etag"`},
+			{S3BucketName: "tertiary-bucket", S3Key: "other"},
+		},
+	}
+
+	for _, codec := range []PointerCodec{&JsonPointerCodec{}, &URIPointerCodec{}, &BinaryPointerCodec{}} {
+		payloadPointer, err := codec.Encode(s3Pointer)
+		assert.Nil(t, err)
+		assert.True(t, codec.Detect(payloadPointer))
+
+		decoded, err := ParsePointer(payloadPointer)
+		assert.Nil(t, err)
+		assert.Equal(t, s3Pointer, decoded, payloadPointer)
+	}
+}
+
+func TestJavaPointerCodec(t *testing.T) {
+	payloadPointer, err := (&JavaPointerCodec{}).Encode(&PayloadS3Pointer{S3BucketName: "test-bucket-name", S3Key: "key", ExpectedConsumers: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, `["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"test-bucket-name","s3Key":"key"}]`, payloadPointer)
+
+	for _, payloadPointer := range []string{
+		payloadPointer,
+		`["com.amazon.sqs.javamessaging.MessageS3Pointer",{"s3BucketName":"test-bucket-name","s3Key":"key"}]`,
+	} {
+		s3Pointer, err := ParsePointer(payloadPointer)
+		assert.Nil(t, err)
+		assert.Equal(t, &PayloadS3Pointer{S3BucketName: "test-bucket-name", S3Key: "key"}, s3Pointer)
+	}
+}
+
+func TestURIPointerCodecFormat(t *testing.T) {
+	payloadPointer, err := (&URIPointerCodec{}).Encode(&PayloadS3Pointer{S3BucketName: "test-bucket-name", S3Key: "dir/key"})
+	assert.Nil(t, err)
+	assert.Equal(t, "s3://test-bucket-name/dir/key", payloadPointer)
+}
+
+func TestParsePointerRejectsInvalidPointers(t *testing.T) {
+	for _, payloadPointer := range []string{
+		"",
+		"IncorrectPointer",
+		`["java.lang.String",{"s3BucketName":"test-bucket-name","s3Key":"key"}]`,
+		`["software.amazon.payloadoffloading.PayloadS3Pointer",{"s3BucketName":"test-bucket-name"}]`,
+		"s3://test-bucket-name",
+		"s3:///key",
+		"s3://test-bucket-name/key?expectedConsumers=x",
+		"UAE",
+		"UAEBBHRlc3Q",
+	} {
+		_, err := ParsePointer(payloadPointer)
+		assert.NotNil(t, err, payloadPointer)
+	}
+}
+
+func TestStoreOriginalPayloadUsesConfiguredCodec(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
+	mockS3Dao.EXPECT().StoreTextInS3WithOptions(s3BucketName, anyS3Key, anyPayload, gomock.Any()).Return(s3.StoreResult{}, nil)
+	store := &S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao, PointerCodec: &URIPointerCodec{}, Clock: anyClock}
+
+	payloadPointer, err := store.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "s3://test-bucket-name/AnyS3key?createdAt=2021-08-09T14%3A30%3A00Z&schemaVersion=2"+
+		"&sha256=83e48a62554d9c19910c15655f463a07fae7e6726d89a4a633bc432877824b2e&size=10", payloadPointer)
+}
@@ -0,0 +1,41 @@
+package payload
+
+import (
+	"errors"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"log"
+)
+
+// ObjectAlreadyExistsError is returned by the store methods of an S3BackedPayloadStore with CreateOnly set when the
+// key is already in use.
+type ObjectAlreadyExistsError = s3.ObjectAlreadyExistsError
+
+// ObjectModifiedError is returned by ReplaceOriginalPayload when the payload has been replaced or deleted by someone
+// else since the pointer was created.
+type ObjectModifiedError = s3.ObjectModifiedError
+
+// ReplaceOriginalPayload overwrites the payload payloadPointer refers to and returns the pointer to the new payload.
+// The object is only replaced while it still has the ETag recorded in the pointer, so concurrent replacements of the
+// same payload cannot silently overwrite each other: all but one fail with an *ObjectModifiedError.
+func (bps *S3BackedPayloadStore) ReplaceOriginalPayload(payloadPointer, payload string) (string, error) {
+	s3Pointer, err := ParsePointer(payloadPointer)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	if s3Pointer.ETag == "" {
+		err := errors.New("The S3Client object pointer has no ETag to replace the payload conditionally.")
+		log.Println(err)
+		return "", err
+	}
+	if s3Pointer.S3BucketName != bps.S3BucketName {
+		err := errors.New("The S3Client object pointer refers to another bucket.")
+		log.Println(err)
+		return "", err
+	}
+
+	options := bps.storeOptions()
+	options.IfNoneMatch = ""
+	options.IfMatch = s3Pointer.ETag
+	return bps.storeObject(payload, s3Pointer.S3Key, options)
+}
@@ -0,0 +1,61 @@
+package payload_test
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/inmemory"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"testing"
+)
+
+func TestCreateOnlyStoreDoesNotOverwrite(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	payloadStore.CreateOnly = true
+
+	_, err := payloadStore.StoreOriginalPayloadForS3Key("first", anyS3Key)
+	assert.NoError(t, err)
+	_, err = payloadStore.StoreOriginalPayloadForS3Key("second", anyS3Key)
+
+	var existsError *payload.ObjectAlreadyExistsError
+	assert.True(t, errors.As(err, &existsError))
+	actualPayload, _ := dao.Object(s3BucketName, anyS3Key)
+	assert.Equal(t, "first", actualPayload)
+}
+
+func TestCreateOnlyStoreDeduplicates(t *testing.T) {
+	payloadStore, _ := inmemory.NewPayloadStore(s3BucketName)
+	payloadStore.CreateOnly = true
+	payloadStore.Deduplicate = true
+
+	_, err := payloadStore.StoreOriginalPayload(anyPayload)
+	assert.NoError(t, err)
+	_, err = payloadStore.StoreOriginalPayload(anyPayload)
+	assert.NoError(t, err)
+}
+
+func TestReplaceOriginalPayload(t *testing.T) {
+	payloadStore, _ := inmemory.NewPayloadStore(s3BucketName)
+	payloadStore.CreateOnly = true
+	ptrJson, _ := payloadStore.StoreOriginalPayloadForS3Key("first", anyS3Key)
+
+	replacedPtrJson, err := payloadStore.ReplaceOriginalPayload(ptrJson, "second")
+	assert.NoError(t, err)
+	actualPayload, err := payloadStore.GetOriginalPayload(replacedPtrJson)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", actualPayload)
+
+	// The first pointer no longer matches the object
+	_, err = payloadStore.ReplaceOriginalPayload(ptrJson, "third")
+	var modifiedError *payload.ObjectModifiedError
+	assert.True(t, errors.As(err, &modifiedError))
+	actualPayload, _ = payloadStore.GetOriginalPayload(replacedPtrJson)
+	assert.Equal(t, "second", actualPayload)
+}
+
+func TestReplaceOriginalPayloadRequiresETag(t *testing.T) {
+	payloadStore, _ := inmemory.NewPayloadStore(s3BucketName)
+
+	_, err := payloadStore.ReplaceOriginalPayload(`{"s3BucketName":"test-bucket-name","s3Key":"AnyS3key"}`, anyPayload)
+
+	assert.Error(t, err)
+}
@@ -0,0 +1,36 @@
+package payload
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// PayloadExpiredError is returned when a payload is retrieved after the ExpiresAt time of its pointer. S3 may have
+// deleted the object already, or will delete it soon.
+type PayloadExpiredError struct {
+	S3BucketName string
+	S3Key        string
+	ExpiredAt    time.Time
+}
+
+func (e *PayloadExpiredError) Error() string {
+	return fmt.Sprintf("The S3Client object expired at %s, Bucket name: %s, Object key: %s.", e.ExpiredAt.Format(time.RFC3339), e.S3BucketName, e.S3Key)
+}
+
+// IsPayloadExpired reports whether err is caused by a *PayloadExpiredError.
+func IsPayloadExpired(err error) bool {
+	var expiredError *PayloadExpiredError
+	return errors.As(err, &expiredError)
+}
+
+// checkExpiry returns a *PayloadExpiredError when the expiry time of s3Pointer has passed.
+func (bps *S3BackedPayloadStore) checkExpiry(s3Pointer *PayloadS3Pointer) error {
+	if s3Pointer.ExpiresAt == nil || now(bps.Clock).Before(*s3Pointer.ExpiresAt) {
+		return nil
+	}
+	err := &PayloadExpiredError{S3BucketName: s3Pointer.S3BucketName, S3Key: s3Pointer.S3Key, ExpiredAt: *s3Pointer.ExpiresAt}
+	log.Println(err)
+	return err
+}
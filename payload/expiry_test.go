@@ -0,0 +1,98 @@
+package payload_test
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/inmemory"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"testing"
+	"time"
+)
+
+func TestStoreWithTTLTagsObjectsAndExpiresPointers(t *testing.T) {
+	clock := time.Date(2021, 8, 9, 14, 30, 0, 0, time.UTC)
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	payloadStore.TTL = 36 * time.Hour
+	payloadStore.Clock = func() time.Time { return clock }
+
+	payloadPointer, err := payloadStore.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+	assert.NoError(t, err)
+
+	s3Pointer, err := payload.ParsePointer(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, clock.Add(36*time.Hour), *s3Pointer.ExpiresAt)
+	options, ok := dao.Options(s3BucketName, anyS3Key)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{s3.ExpiryClassTagKey: "2d"}, options.Tags)
+
+	clock = clock.Add(36*time.Hour - time.Nanosecond)
+	actualPayload, err := payloadStore.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+
+	clock = clock.Add(time.Nanosecond)
+	calls := dao.Calls(inmemory.GetTextFromS3)
+	_, err = payloadStore.GetOriginalPayload(payloadPointer)
+	assert.True(t, payload.IsPayloadExpired(err), err)
+	assert.Equal(t, calls, dao.Calls(inmemory.GetTextFromS3))
+
+	_, err = payloadStore.GetOriginalPayloads([]string{payloadPointer})
+	assert.True(t, payload.IsPayloadExpired(err.(*payload.BatchError).Errors[0]))
+}
+
+func TestPointersWithoutTTLDoNotExpire(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+
+	payloadPointer, err := payloadStore.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+	assert.NoError(t, err)
+
+	s3Pointer, _ := payload.ParsePointer(payloadPointer)
+	assert.Nil(t, s3Pointer.ExpiresAt)
+	options, _ := dao.Options(s3BucketName, anyS3Key)
+	assert.Empty(t, options.Tags)
+}
+
+func TestDeduplicatedStoreRefreshesReusedObjects(t *testing.T) {
+	clock := time.Date(2021, 8, 9, 14, 30, 0, 0, time.UTC)
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	payloadStore.Deduplicate = true
+	payloadStore.TTL = 24 * time.Hour
+	payloadStore.Clock = func() time.Time { return clock }
+	_, err := payloadStore.StoreOriginalPayload(anyPayload)
+	assert.NoError(t, err)
+
+	// The reused object is tagged like the new pointer
+	clock = clock.Add(20 * time.Hour)
+	payloadStore.TTL = 7 * 24 * time.Hour
+	payloadPointer, err := payloadStore.StoreOriginalPayload(anyPayload)
+	assert.NoError(t, err)
+	s3Pointer, _ := payload.ParsePointer(payloadPointer)
+	assert.True(t, s3Pointer.ContentAddressed)
+	assert.Equal(t, clock.Add(7*24*time.Hour), *s3Pointer.ExpiresAt)
+	assert.Equal(t, 1, dao.Calls(inmemory.CopyObjectInS3WithOptions))
+	options, _ := dao.Options(s3BucketName, s3Pointer.S3Key)
+	assert.Equal(t, map[string]string{s3.ExpiryClassTagKey: "7d"}, options.Tags)
+
+	// An object that cannot be refreshed is stored again
+	dao.FailNext(inmemory.CopyObjectInS3WithOptions, errors.New("injected"))
+	_, err = payloadStore.StoreOriginalPayload(anyPayload)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, dao.Calls(inmemory.StoreTextInS3WithOptions))
+
+	payloadStore.PointerCodec = &payload.JavaPointerCodec{}
+	_, err = payloadStore.StoreOriginalPayload(anyPayload)
+	assert.Error(t, err)
+}
+
+func TestValidateRejectsNegativeTTL(t *testing.T) {
+	payloadStore, _ := inmemory.NewPayloadStore(s3BucketName)
+	assert.NoError(t, payloadStore.Validate())
+
+	payloadStore.TTL = -time.Hour
+	assert.Error(t, payloadStore.Validate())
+
+	payloadStore.TTL = 0
+	payloadStore.ReferenceExpiry = -time.Hour
+	assert.Error(t, payloadStore.Validate())
+}
@@ -0,0 +1,198 @@
+package payload
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// DefaultHealthCheckTimeout is the time HealthCheck waits for S3 when S3BackedPayloadStore.HealthCheckTimeout is not set.
+const DefaultHealthCheckTimeout = 5 * time.Second
+
+// HealthCheckKeyPrefix is the prefix of the keys of the canary objects written by HealthCheck.
+const HealthCheckKeyPrefix = "healthcheck/"
+
+// HealthErrorClass tells which step of a health check failed.
+type HealthErrorClass string
+
+const (
+	HealthErrorTimeout          HealthErrorClass = "timeout"
+	HealthErrorBucketNotFound   HealthErrorClass = "bucket_not_found"
+	HealthErrorBucketCheck      HealthErrorClass = "bucket_check_failed"
+	HealthErrorStore            HealthErrorClass = "store_failed"
+	HealthErrorRead             HealthErrorClass = "read_failed"
+	HealthErrorPayloadMismatch  HealthErrorClass = "payload_mismatch"
+	HealthErrorDelete           HealthErrorClass = "delete_failed"
+	HealthErrorContextCancelled HealthErrorClass = "cancelled"
+)
+
+// HealthStatus is the result of a health check. ErrorClass and Err are empty when the store is healthy.
+type HealthStatus struct {
+	Healthy      bool
+	S3BucketName string
+	// ReadOnly is set when only the existence of the bucket was checked
+	ReadOnly   bool
+	Latency    time.Duration
+	ErrorClass HealthErrorClass
+	Err        error
+}
+
+// HealthChecker is implemented by the payload stores that can check whether offloading works.
+type HealthChecker interface {
+	HealthCheck(ctx context.Context) HealthStatus
+}
+
+// healthProbe is a health check probe of S3, shared by the health checks made while it is in flight.
+type healthProbe struct {
+	done       chan struct{}
+	errorClass HealthErrorClass
+	err        error
+}
+
+// HealthCheck stores, reads back and deletes a small canary object under HealthCheckKeyPrefix, or only checks that the
+// bucket exists when HealthCheckReadOnly is set. It gives up after HealthCheckTimeout, in which case a canary object may
+// be left behind. The S3 calls cannot be cancelled, so a single probe runs at a time: health checks made while a probe
+// is in flight, for example one that timed out, wait for its result instead of starting another.
+func (bps *S3BackedPayloadStore) HealthCheck(ctx context.Context) HealthStatus {
+	timeout := bps.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	status := HealthStatus{S3BucketName: bps.S3BucketName, ReadOnly: bps.HealthCheckReadOnly}
+	start := time.Now()
+	var errorClass HealthErrorClass
+	err := ctx.Err()
+	if err == nil {
+		probe := bps.probe()
+		select {
+		case <-probe.done:
+			errorClass, err = probe.errorClass, probe.err
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	status.Latency = time.Since(start)
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		status.ErrorClass, status.Err = HealthErrorTimeout, err
+	case errors.Is(err, context.Canceled):
+		status.ErrorClass, status.Err = HealthErrorContextCancelled, err
+	case err != nil:
+		status.ErrorClass, status.Err = errorClass, err
+	default:
+		status.Healthy = true
+	}
+	if err != nil {
+		log.Printf("S3Client health check failed, Bucket name: %s, Error class: %s, Error: %v.", bps.S3BucketName, status.ErrorClass, err)
+	}
+	return status
+}
+
+// probe returns the probe in flight, or starts one.
+func (bps *S3BackedPayloadStore) probe() *healthProbe {
+	bps.healthMu.Lock()
+	defer bps.healthMu.Unlock()
+	if bps.healthProbe != nil {
+		return bps.healthProbe
+	}
+	probe := &healthProbe{done: make(chan struct{})}
+	bps.healthProbe = probe
+	go func() {
+		if bps.HealthCheckReadOnly {
+			probe.errorClass, probe.err = bps.checkBucket()
+		} else {
+			probe.errorClass, probe.err = bps.checkCanary()
+		}
+		bps.healthMu.Lock()
+		bps.healthProbe = nil
+		bps.healthMu.Unlock()
+		close(probe.done)
+	}()
+	return probe
+}
+
+func (bps *S3BackedPayloadStore) checkBucket() (HealthErrorClass, error) {
+	exists, err := bps.S3Dao.DoesBucketExistInS3(bps.S3BucketName)
+	if err != nil {
+		return HealthErrorBucketCheck, err
+	}
+	if !exists {
+		return HealthErrorBucketNotFound, errors.New("The S3Client bucket does not exist")
+	}
+	return "", nil
+}
+
+func (bps *S3BackedPayloadStore) checkCanary() (HealthErrorClass, error) {
+	uuid, err := (&UUIDKeyGenerator{}).GenerateKey()
+	if err != nil {
+		return HealthErrorStore, err
+	}
+	s3Key := HealthCheckKeyPrefix + uuid
+	canary := fmt.Sprintf("health check %s", now(bps.Clock).UTC().Format(time.RFC3339Nano))
+
+	result, err := bps.S3Dao.StoreTextInS3WithOptions(bps.S3BucketName, s3Key, canary, bps.storeOptions())
+	if err != nil {
+		return HealthErrorStore, err
+	}
+	payload, err := bps.S3Dao.GetTextFromS3Version(bps.S3BucketName, s3Key, result.VersionId)
+	if err != nil {
+		return HealthErrorRead, err
+	}
+	if payload != canary {
+		return HealthErrorPayloadMismatch, errors.New("The S3Client object read differs from the one stored")
+	}
+	// Deleting the stored version leaves no delete marker behind on versioned buckets
+	err = bps.S3Dao.DeletePayloadVersionFromS3(bps.S3BucketName, s3Key, result.VersionId)
+	if err != nil {
+		return HealthErrorDelete, err
+	}
+	return "", nil
+}
+
+// healthResponse is the JSON body written by HealthHandler.
+type healthResponse struct {
+	Healthy      bool             `json:"healthy"`
+	S3BucketName string           `json:"s3BucketName"`
+	ReadOnly     bool             `json:"readOnly,omitempty"`
+	LatencyMs    float64          `json:"latencyMs"`
+	ErrorClass   HealthErrorClass `json:"errorClass,omitempty"`
+	Error        string           `json:"error,omitempty"`
+}
+
+// HealthHandler returns an http.Handler running a health check per request, for example as a Kubernetes readiness
+// probe. It responds with 200 OK when the check succeeds and 503 Service Unavailable otherwise, the body describes the
+// result in JSON.
+func HealthHandler(checker HealthChecker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := checker.HealthCheck(r.Context())
+		response := healthResponse{
+			Healthy:      status.Healthy,
+			S3BucketName: status.S3BucketName,
+			ReadOnly:     status.ReadOnly,
+			LatencyMs:    float64(status.Latency) / float64(time.Millisecond),
+			ErrorClass:   status.ErrorClass,
+		}
+		if status.Err != nil {
+			response.Error = status.Err.Error()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if status.Healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if r.Method != http.MethodHead {
+			_ = json.NewEncoder(w).Encode(response)
+		}
+	})
+}
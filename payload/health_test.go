@@ -0,0 +1,134 @@
+package payload_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/inmemory"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckWritesReadsAndDeletesCanary(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+
+	status := payloadStore.HealthCheck(context.Background())
+
+	assert.True(t, status.Healthy)
+	assert.NoError(t, status.Err)
+	assert.Equal(t, s3BucketName, status.S3BucketName)
+	assert.Equal(t, 1, dao.Calls(inmemory.StoreTextInS3))
+	assert.Equal(t, 1, dao.Calls(inmemory.GetTextFromS3))
+	assert.Equal(t, 1, dao.Calls(inmemory.DeletePayloadFromS3))
+	assert.Empty(t, dao.Keys(s3BucketName))
+}
+
+func TestHealthCheckReportsFailedStep(t *testing.T) {
+	for _, test := range []struct {
+		op         inmemory.Operation
+		errorClass payload.HealthErrorClass
+	}{
+		{inmemory.StoreTextInS3WithOptions, payload.HealthErrorStore},
+		{inmemory.GetTextFromS3Version, payload.HealthErrorRead},
+		{inmemory.DeletePayloadVersionFromS3, payload.HealthErrorDelete},
+	} {
+		payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+		dao.FailNext(test.op, errors.New("injected"))
+
+		status := payloadStore.HealthCheck(context.Background())
+
+		assert.False(t, status.Healthy, test.op)
+		assert.Equal(t, test.errorClass, status.ErrorClass, test.op)
+		assert.Error(t, status.Err, test.op)
+	}
+}
+
+func TestHealthCheckReadOnly(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	payloadStore.HealthCheckReadOnly = true
+
+	status := payloadStore.HealthCheck(context.Background())
+	assert.True(t, status.Healthy)
+	assert.True(t, status.ReadOnly)
+	assert.Equal(t, 1, dao.Calls(inmemory.DoesBucketExistInS3))
+	assert.Equal(t, 0, dao.Calls(inmemory.StoreTextInS3))
+
+	dao.FailNext(inmemory.DoesBucketExistInS3, errors.New("injected"))
+	status = payloadStore.HealthCheck(context.Background())
+	assert.Equal(t, payload.HealthErrorBucketCheck, status.ErrorClass)
+}
+
+// slowS3Dao delays every store by delay
+type slowS3Dao struct {
+	*inmemory.S3Dao
+	delay time.Duration
+}
+
+func (dao *slowS3Dao) StoreTextInS3WithOptions(s3BucketName, s3Key, payloadContentStr string, options s3.StoreOptions) (s3.StoreResult, error) {
+	time.Sleep(dao.delay)
+	return dao.S3Dao.StoreTextInS3WithOptions(s3BucketName, s3Key, payloadContentStr, options)
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	payloadStore := &payload.S3BackedPayloadStore{
+		S3BucketName:       s3BucketName,
+		S3Dao:              &slowS3Dao{S3Dao: inmemory.NewS3Dao(), delay: 200 * time.Millisecond},
+		HealthCheckTimeout: 10 * time.Millisecond,
+	}
+
+	status := payloadStore.HealthCheck(context.Background())
+
+	assert.False(t, status.Healthy)
+	assert.Equal(t, payload.HealthErrorTimeout, status.ErrorClass)
+	assert.True(t, status.Latency < 200*time.Millisecond)
+}
+
+func TestHealthCheckRunsOneProbeAtATime(t *testing.T) {
+	dao := inmemory.NewS3Dao()
+	payloadStore := &payload.S3BackedPayloadStore{
+		S3BucketName:       s3BucketName,
+		S3Dao:              &slowS3Dao{S3Dao: dao, delay: 100 * time.Millisecond},
+		HealthCheckTimeout: 10 * time.Millisecond,
+	}
+
+	for i := 0; i < 3; i++ {
+		status := payloadStore.HealthCheck(context.Background())
+		assert.Equal(t, payload.HealthErrorTimeout, status.ErrorClass)
+	}
+	// The checks that timed out share the probe still in flight
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, 1, dao.Calls(inmemory.StoreTextInS3WithOptions))
+
+	payloadStore.HealthCheckTimeout = time.Second
+	status := payloadStore.HealthCheck(context.Background())
+	assert.True(t, status.Healthy)
+	assert.Equal(t, 2, dao.Calls(inmemory.StoreTextInS3WithOptions))
+}
+
+func TestHealthHandler(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	handler := payload.HealthHandler(payloadStore)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	var body map[string]interface{}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	assert.Equal(t, true, body["healthy"])
+	assert.Equal(t, s3BucketName, body["s3BucketName"])
+
+	dao.FailNext(inmemory.StoreTextInS3WithOptions, errors.New("injected"))
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	assert.Equal(t, false, body["healthy"])
+	assert.Equal(t, "store_failed", body["errorClass"])
+	assert.Equal(t, "injected", body["error"])
+}
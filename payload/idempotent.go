@@ -0,0 +1,119 @@
+package payload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"log"
+	"time"
+)
+
+// IdempotentKeyPrefix is the prefix of the keys used by StoreOriginalPayloadWithIdempotencyKey.
+const IdempotentKeyPrefix = "idempotent/"
+
+// Names of the object metadata of idempotently stored payloads. They hold the hex encoded SHA-256 checksum of the
+// payload and the CreatedAt and ExpiresAt times of its pointer, so a retry returns the same pointer.
+const (
+	checksumMetadataKey  = "sha256"
+	createdAtMetadataKey = "created-at"
+	// ExpiresAtMetadataKey is also set on shared payloads stored with a TTL
+	ExpiresAtMetadataKey = "expires-at"
+)
+
+// IdempotencyConflictError is returned by StoreOriginalPayloadWithIdempotencyKey when the idempotency key has already
+// been used for a different payload.
+type IdempotencyConflictError struct {
+	IdempotencyKey string
+	S3Key          string
+}
+
+func (e *IdempotencyConflictError) Error() string {
+	return fmt.Sprintf("The idempotency key %s has been used for another payload, Object key: %s.", e.IdempotencyKey, e.S3Key)
+}
+
+// IdempotentS3Key returns the S3 key StoreOriginalPayloadWithIdempotencyKey stores the payload of idempotencyKey under.
+// The key is hashed, so any string can be used as idempotency key.
+func IdempotentS3Key(idempotencyKey string) string {
+	sum := sha256.Sum256([]byte(idempotencyKey))
+	return IdempotentKeyPrefix + hex.EncodeToString(sum[:])
+}
+
+// StoreOriginalPayloadWithIdempotencyKey stores payload under a key derived from idempotencyKey, for example a message
+// id chosen by the producer. When the store is retried with the same idempotency key and payload, for example after a
+// timeout, no new object is created and a pointer to the stored object is returned. Reusing the idempotency key for
+// another payload fails with an *IdempotencyConflictError.
+func (bps *S3BackedPayloadStore) StoreOriginalPayloadWithIdempotencyKey(payload, idempotencyKey string) (string, error) {
+	if idempotencyKey == "" {
+		err := errors.New("The idempotency key must not be empty.")
+		log.Println(err)
+		return "", err
+	}
+	s3Key := IdempotentS3Key(idempotencyKey)
+	sum := sha256.Sum256([]byte(payload))
+	checksum := hex.EncodeToString(sum[:])
+
+	s3Pointer := bps.newPointer(s3Key, payload, s3.StoreResult{})
+	options := bps.storeOptions()
+	options.IfNoneMatch = s3.IfNoneMatchAny
+	options.Metadata = map[string]string{
+		checksumMetadataKey:  checksum,
+		createdAtMetadataKey: s3Pointer.CreatedAt.Format(time.RFC3339Nano),
+	}
+	if s3Pointer.ExpiresAt != nil {
+		options.Metadata[ExpiresAtMetadataKey] = s3Pointer.ExpiresAt.Format(time.RFC3339Nano)
+	}
+	result, err := bps.putObject(payload, s3Key, options)
+	if err == nil {
+		s3Pointer.VersionId, s3Pointer.ETag = result.VersionId, result.ETag
+		return bps.encodePointer(&s3Pointer)
+	}
+	if !s3.IsObjectAlreadyExists(err) {
+		return "", err
+	}
+
+	metadata, err := bps.S3Dao.GetObjectMetadataFromS3(bps.S3BucketName, s3Key)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	if metadata == nil {
+		err := errors.New("The S3Client object stored with the idempotency key has been deleted.")
+		log.Println(err)
+		return "", err
+	}
+	storedChecksum, ok := metadata.Metadata[checksumMetadataKey]
+	if !ok {
+		// Stored without checksum, compare the payloads themselves
+		storedPayload, err := bps.S3Dao.GetTextFromS3(bps.S3BucketName, s3Key)
+		if err != nil {
+			log.Println(err)
+			return "", err
+		}
+		storedSum := sha256.Sum256([]byte(storedPayload))
+		storedChecksum = hex.EncodeToString(storedSum[:])
+	}
+	if storedChecksum != checksum {
+		err := &IdempotencyConflictError{IdempotencyKey: idempotencyKey, S3Key: s3Key}
+		log.Println(err)
+		return "", err
+	}
+
+	log.Printf("S3Client object already stored with the idempotency key, Bucket name: %s, Object key: %s.", bps.S3BucketName, s3Key) // info
+
+	// Rebuild the pointer returned by the first store, objects stored without the times are dated by their last change
+	createdAt, err := time.Parse(time.RFC3339Nano, metadata.Metadata[createdAtMetadataKey])
+	recorded := err == nil
+	if !recorded {
+		createdAt = metadata.LastModified.UTC()
+	}
+	s3Pointer = bps.newPointerAt(s3Key, payload, s3.StoreResult{ETag: metadata.ETag, VersionId: metadata.VersionId}, createdAt)
+	if recorded {
+		s3Pointer.ExpiresAt = nil
+		if expiresAt, err := time.Parse(time.RFC3339Nano, metadata.Metadata[ExpiresAtMetadataKey]); err == nil {
+			s3Pointer.ExpiresAt = &expiresAt
+		}
+	}
+	return bps.encodePointer(&s3Pointer)
+}
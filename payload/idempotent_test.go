@@ -0,0 +1,63 @@
+package payload_test
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/inmemory"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"testing"
+	"time"
+)
+
+func TestIdempotentStoreRetryReturnsSameObject(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	payloadStore.TTL = time.Hour
+	clock := time.Date(2021, 8, 9, 14, 30, 0, 123456789, time.UTC)
+	payloadStore.Clock = func() time.Time { return clock }
+
+	firstPtrJson, err := payloadStore.StoreOriginalPayloadWithIdempotencyKey(anyPayload, "message-1")
+	assert.NoError(t, err)
+	clock = clock.Add(time.Minute)
+	retriedPtrJson, err := payloadStore.StoreOriginalPayloadWithIdempotencyKey(anyPayload, "message-1")
+	assert.NoError(t, err)
+
+	assert.Equal(t, firstPtrJson, retriedPtrJson)
+	first, _ := payload.FromJson(firstPtrJson)
+	assert.Equal(t, payload.IdempotentS3Key("message-1"), first.S3Key)
+	assert.Equal(t, []string{first.S3Key}, dao.Keys(s3BucketName))
+	assert.Equal(t, 2, dao.Calls(inmemory.StoreTextInS3WithOptions))
+}
+
+func TestIdempotentStoreRejectsReusedKey(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	payloadStore.StoreOriginalPayloadWithIdempotencyKey(anyPayload, "message-1")
+
+	_, err := payloadStore.StoreOriginalPayloadWithIdempotencyKey("other payload", "message-1")
+
+	var conflictError *payload.IdempotencyConflictError
+	assert.True(t, errors.As(err, &conflictError))
+	actualPayload, _ := dao.Object(s3BucketName, payload.IdempotentS3Key("message-1"))
+	assert.Equal(t, anyPayload, actualPayload)
+}
+
+func TestIdempotentStoreComparesPayloadsStoredWithoutChecksum(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	dao.StoreTextInS3(s3BucketName, payload.IdempotentS3Key("message-1"), anyPayload)
+
+	_, err := payloadStore.StoreOriginalPayloadWithIdempotencyKey(anyPayload, "message-1")
+	assert.NoError(t, err)
+	_, err = payloadStore.StoreOriginalPayloadWithIdempotencyKey("other payload", "message-1")
+	assert.Error(t, err)
+}
+
+func TestIdempotentStoreOnS3Failure(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	payloadStore.StoreOriginalPayloadWithIdempotencyKey(anyPayload, "message-1")
+	dao.FailNext(inmemory.GetObjectMetadataFromS3, errors.New("S3Client Exception"))
+
+	_, err := payloadStore.StoreOriginalPayloadWithIdempotencyKey(anyPayload, "message-1")
+
+	assert.Error(t, err)
+	assert.False(t, s3.IsObjectAlreadyExists(err))
+}
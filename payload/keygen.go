@@ -0,0 +1,159 @@
+package payload
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/google/uuid"
+	"strings"
+	"time"
+)
+
+// KeyGenerator generates the S3 keys used by StoreOriginalPayload.
+type KeyGenerator interface {
+	GenerateKey() (string, error)
+}
+
+// UUIDKeyGenerator generates random (version 4) UUIDs. It is the default KeyGenerator.
+type UUIDKeyGenerator struct{}
+
+func (g *UUIDKeyGenerator) GenerateKey() (string, error) {
+	key, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	return key.String(), nil
+}
+
+// UUIDv7KeyGenerator generates time-ordered (version 7) UUIDs, so keys sort by creation time.
+type UUIDv7KeyGenerator struct {
+	// Clock is optional and defaults to time.Now
+	Clock func() time.Time
+}
+
+func (g *UUIDv7KeyGenerator) GenerateKey() (string, error) {
+	var key uuid.UUID
+	if _, err := rand.Read(key[6:]); err != nil {
+		return "", err
+	}
+	ms := uint64(now(g.Clock).UnixNano() / int64(time.Millisecond))
+	key[0] = byte(ms >> 40)
+	key[1] = byte(ms >> 32)
+	key[2] = byte(ms >> 24)
+	key[3] = byte(ms >> 16)
+	key[4] = byte(ms >> 8)
+	key[5] = byte(ms)
+	key[6] = key[6]&0x0f | 0x70 // version 7
+	key[8] = key[8]&0x3f | 0x80 // RFC 4122 variant
+	return key.String(), nil
+}
+
+// ULIDKeyGenerator generates ULIDs: 26 character, lexicographically time-sortable identifiers.
+type ULIDKeyGenerator struct {
+	// Clock is optional and defaults to time.Now
+	Clock func() time.Time
+}
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g *ULIDKeyGenerator) GenerateKey() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+	ms := uint64(now(g.Clock).UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+
+	// 26 base32 characters hold 130 bits, the two most significant bits are always zero
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+	var key [26]byte
+	for i := 25; i >= 0; i-- {
+		key[i] = crockfordBase32[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(key[:]), nil
+}
+
+// DatePartitionedKeyGenerator prefixes the keys of Next with the creation time, by default as yyyy/mm/dd/hh/ in UTC.
+type DatePartitionedKeyGenerator struct {
+	// Next is optional and defaults to UUIDKeyGenerator
+	Next KeyGenerator
+	// Layout is optional and defaults to "2006/01/02/15/"
+	Layout string
+	// Clock is optional and defaults to time.Now
+	Clock func() time.Time
+}
+
+func (g *DatePartitionedKeyGenerator) GenerateKey() (string, error) {
+	key, err := next(g.Next).GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	layout := g.Layout
+	if layout == "" {
+		layout = "2006/01/02/15/"
+	}
+	return now(g.Clock).UTC().Format(layout) + key, nil
+}
+
+// HashPrefixKeyGenerator prefixes the keys of Next with the first hex characters of their SHA-256 hash, spreading keys
+// evenly over S3 partitions.
+type HashPrefixKeyGenerator struct {
+	// Next is optional and defaults to UUIDKeyGenerator
+	Next KeyGenerator
+	// Length is the number of hex characters in the prefix, it is optional and defaults to 4
+	Length int
+}
+
+func (g *HashPrefixKeyGenerator) GenerateKey() (string, error) {
+	key, err := next(g.Next).GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	length := g.Length
+	if length <= 0 {
+		length = 4
+	}
+	if length > sha256.Size*2 {
+		length = sha256.Size * 2
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:length] + "/" + key, nil
+}
+
+// PrefixKeyGenerator prefixes the keys of Next with a fixed prefix, such as a tenant or service name.
+type PrefixKeyGenerator struct {
+	Prefix string
+	// Next is optional and defaults to UUIDKeyGenerator
+	Next KeyGenerator
+}
+
+func (g *PrefixKeyGenerator) GenerateKey() (string, error) {
+	key, err := next(g.Next).GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	prefix := g.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + key, nil
+}
+
+func next(g KeyGenerator) KeyGenerator {
+	if g == nil {
+		return &UUIDKeyGenerator{}
+	}
+	return g
+}
+
+func now(clock func() time.Time) time.Time {
+	if clock == nil {
+		return time.Now()
+	}
+	return clock()
+}
@@ -0,0 +1,125 @@
+package payload
+
+import (
+	"errors"
+	"github.com/golang/mock/gomock"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/mocks"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var fixedTime = time.Date(2021, time.August, 9, 14, 30, 0, 0, time.UTC)
+
+func fixedClock() time.Time {
+	return fixedTime
+}
+
+type staticKeyGenerator struct {
+	key string
+	err error
+}
+
+func (g *staticKeyGenerator) GenerateKey() (string, error) {
+	return g.key, g.err
+}
+
+func TestUUIDv7KeyGenerator(t *testing.T) {
+	key, err := (&UUIDv7KeyGenerator{Clock: fixedClock}).GenerateKey()
+	assert.NoError(t, err)
+
+	parsed, err := uuid.Parse(key)
+	assert.NoError(t, err)
+	assert.Equal(t, uuid.Version(7), parsed.Version())
+	assert.Equal(t, uuid.RFC4122, parsed.Variant())
+	// The first 48 bits hold the unix time in milliseconds
+	assert.Equal(t, "017b2b52", key[:8])
+}
+
+func TestULIDKeyGeneratorIsTimeSortable(t *testing.T) {
+	clock := fixedTime
+	generator := &ULIDKeyGenerator{Clock: func() time.Time { return clock }}
+
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key, err := generator.GenerateKey()
+		assert.NoError(t, err)
+		assert.Regexp(t, regexp.MustCompile("^[0-9A-HJKMNP-TV-Z]{26}$"), key)
+		keys = append(keys, key)
+		clock = clock.Add(time.Millisecond)
+	}
+
+	assert.True(t, sort.StringsAreSorted(keys))
+	assert.Equal(t, "01FCNN40J0", keys[0][:10])
+}
+
+func TestDatePartitionedKeyGenerator(t *testing.T) {
+	generator := &DatePartitionedKeyGenerator{Next: &staticKeyGenerator{key: anyS3Key}, Clock: fixedClock}
+
+	key, err := generator.GenerateKey()
+
+	assert.NoError(t, err)
+	assert.Equal(t, "2021/08/09/14/"+anyS3Key, key)
+}
+
+func TestHashPrefixKeyGenerator(t *testing.T) {
+	generator := &HashPrefixKeyGenerator{Next: &staticKeyGenerator{key: anyS3Key}, Length: 2}
+
+	key, err := generator.GenerateKey()
+
+	assert.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile("^[0-9a-f]{2}/"+anyS3Key+"$"), key)
+	again, _ := generator.GenerateKey()
+	assert.Equal(t, key, again)
+}
+
+func TestComposedKeyGenerators(t *testing.T) {
+	generator := &PrefixKeyGenerator{
+		Prefix: "tenant-a",
+		Next:   &DatePartitionedKeyGenerator{Clock: fixedClock},
+	}
+
+	key, err := generator.GenerateKey()
+
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, "tenant-a/2021/08/09/14/"))
+	_, err = uuid.Parse(strings.TrimPrefix(key, "tenant-a/2021/08/09/14/"))
+	assert.NoError(t, err)
+}
+
+func TestStoreOriginalPayloadUsesKeyGenerator(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
+
+	mockS3Dao.EXPECT().StoreTextInS3WithOptions(s3BucketName, "service/"+anyS3Key, anyPayload, gomock.Any()).Times(1)
+
+	payloadStore := S3BackedPayloadStore{
+		S3BucketName: s3BucketName,
+		S3Dao:        mockS3Dao,
+		KeyGenerator: &PrefixKeyGenerator{Prefix: "service/", Next: &staticKeyGenerator{key: anyS3Key}},
+		Clock:        anyClock,
+	}
+	actualPayloadPointer, err := payloadStore.StoreOriginalPayload(anyPayload)
+	assert.NoError(t, err)
+
+	expectedPayloadPointer := storedPayloadPointer("service/" + anyS3Key)
+	ptrJson, _ := expectedPayloadPointer.ToJson()
+	assert.Equal(t, ptrJson, actualPayloadPointer)
+}
+
+func TestStoreOriginalPayloadOnKeyGeneratorFailure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
+
+	mockS3Dao.EXPECT().StoreTextInS3WithOptions(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+	expectedError := errors.New("entropy exhausted")
+	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao, KeyGenerator: &staticKeyGenerator{err: expectedError}}
+	_, err := payloadStore.StoreOriginalPayload(anyPayload)
+
+	assert.Equal(t, expectedError, err)
+}
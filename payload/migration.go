@@ -0,0 +1,317 @@
+package payload
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"github.com/threehook/aws-payload-offloading-go/util"
+	"io"
+	"log"
+	"strings"
+)
+
+// DefaultMigrationBatchSize is the number of pointers MigratePointerStream migrates at a time when
+// PayloadMigrator.BatchSize is not set.
+const DefaultMigrationBatchSize = 1000
+
+// PayloadMigrator copies payloads to another bucket, possibly in another region, and rewrites their pointers. Payloads
+// keep their keys, so a MigratingPayloadStore can find the copy of a payload from a pointer to the original.
+//
+// Only the payloads are copied. The acknowledgements of payloads shared by several consumers stay in the source bucket.
+type PayloadMigrator struct {
+	// S3Dao copies the objects, it must be able to read the source buckets and write the target bucket. Its
+	// ServerSideEncryptionStrategy encrypts the copies, when it has none they are encrypted like the originals.
+	S3Dao            s3.S3DaoClientI
+	TargetBucketName string
+	// TargetRegion is optional, it is recorded in the rewritten pointers
+	TargetRegion string
+	// PointerCodec is optional, by default rewritten pointers are encoded in the format of the original pointers
+	PointerCodec PointerCodec
+	// Concurrency is the number of objects copied at a time, it is optional and defaults to s3.DefaultBatchConcurrency
+	Concurrency int
+	// BatchSize is optional and defaults to DefaultMigrationBatchSize
+	BatchSize int
+}
+
+// MigratePayload copies the payload of payloadPointer to the target bucket and returns the pointer to the copy.
+func (pm *PayloadMigrator) MigratePayload(payloadPointer string) (string, error) {
+	s3Pointer, err := ParsePointer(payloadPointer)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	result, err := pm.S3Dao.CopyObjectInS3(s3Pointer.S3BucketName, s3Pointer.S3Key, s3Pointer.VersionId, pm.TargetBucketName, s3Pointer.S3Key)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	log.Printf("S3Client object copied, Bucket name: %s, Target bucket name: %s, Object key: %s.", s3Pointer.S3BucketName, pm.TargetBucketName, s3Pointer.S3Key) // info
+
+	migrated := migratedPointer(s3Pointer, pm.TargetBucketName, pm.TargetRegion, result)
+	codec := pm.PointerCodec
+	if codec == nil {
+		codec = detectCodec(payloadPointer)
+	}
+	newPointer, err := codec.Encode(migrated)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	return newPointer, nil
+}
+
+// MigratePayloads migrates a batch of payloads and returns the new pointers indexed like payloadPointers. When some of
+// the payloads could not be migrated the error is a *BatchError.
+func (pm *PayloadMigrator) MigratePayloads(payloadPointers []string) ([]string, error) {
+	concurrency := pm.Concurrency
+	if concurrency <= 0 {
+		concurrency = s3.DefaultBatchConcurrency
+	}
+	newPointers := make([]string, len(payloadPointers))
+	errs := util.RunConcurrently(len(payloadPointers), concurrency, func(i int) error {
+		var err error
+		newPointers[i], err = pm.MigratePayload(payloadPointers[i])
+		return err
+	})
+	return newPointers, s3.NewBatchError(errs)
+}
+
+// PointerMapping maps a pointer to the pointer of its migrated payload. Error is set instead of NewPointer when the
+// payload could not be migrated.
+type PointerMapping struct {
+	OldPointer string `json:"oldPointer"`
+	NewPointer string `json:"newPointer,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// MigratePointerStream reads pointers from r, one per line, migrates their payloads and writes a PointerMapping per
+// pointer to w as JSON lines, in the order of the pointers. It returns the number of payloads that could not be
+// migrated, and stops early only when r or w fail or ctx is done.
+func (pm *PayloadMigrator) MigratePointerStream(ctx context.Context, r io.Reader, w io.Writer) (int, error) {
+	batchSize := pm.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultMigrationBatchSize
+	}
+	scanner := bufio.NewScanner(r)
+	// Pointers may be JSON with long keys
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	failed := 0
+	var batch []string
+	flush := func() error {
+		newPointers, err := pm.MigratePayloads(batch)
+		errs := itemErrors(err, len(batch))
+		for i, oldPointer := range batch {
+			mapping := PointerMapping{OldPointer: oldPointer, NewPointer: newPointers[i]}
+			if errs[i] != nil {
+				failed++
+				mapping.Error = errs[i].Error()
+			}
+			if err := encoder.Encode(mapping); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		batch = append(batch, line)
+		if len(batch) == batchSize {
+			if err := ctx.Err(); err != nil {
+				return failed, err
+			}
+			if err := flush(); err != nil {
+				return failed, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return failed, err
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return failed, err
+		}
+	}
+	return failed, nil
+}
+
+// BucketMigrationReport describes the objects copied by MigrateBucket. Skipped counts the acknowledgements and health
+// check objects, which are not copied. Failed holds the error of every key that could not be copied.
+type BucketMigrationReport struct {
+	Copied  int
+	Skipped int
+	Failed  map[string]error
+}
+
+// MigrateBucket copies the current version of every payload under prefix in the source bucket to the same key in the
+// target bucket, so pointers can be migrated lazily by a MigratingPayloadStore. The objects are listed page by page and
+// the payloads of each page are copied before listing the next. It stops early with the error of ctx when ctx is done,
+// the report then covers the work done so far.
+func (pm *PayloadMigrator) MigrateBucket(ctx context.Context, sourceBucketName, prefix string) (*BucketMigrationReport, error) {
+	concurrency := pm.Concurrency
+	if concurrency <= 0 {
+		concurrency = s3.DefaultBatchConcurrency
+	}
+	report := &BucketMigrationReport{Failed: make(map[string]error)}
+	err := pm.S3Dao.ListObjectPagesInS3(sourceBucketName, prefix, func(page []s3.ObjectSummary) bool {
+		var keys []string
+		for _, summary := range page {
+			if strings.Contains(summary.Key, AcknowledgementKeyInfix) || strings.HasPrefix(summary.Key, HealthCheckKeyPrefix) {
+				report.Skipped++
+				continue
+			}
+			keys = append(keys, summary.Key)
+		}
+		errs := util.RunConcurrently(len(keys), concurrency, func(i int) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			_, err := pm.S3Dao.CopyObjectInS3(sourceBucketName, keys[i], "", pm.TargetBucketName, keys[i])
+			return err
+		})
+		for i, err := range errs {
+			if err != nil {
+				report.Failed[keys[i]] = err
+			} else {
+				report.Copied++
+			}
+		}
+		return ctx.Err() == nil
+	})
+	if err != nil {
+		log.Println(err)
+		return report, err
+	}
+	log.Printf("S3Client objects copied, Bucket name: %s, Target bucket name: %s, Number of objects: %d, Number of failures: %d.", sourceBucketName, pm.TargetBucketName, report.Copied, len(report.Failed)) // info
+
+	if err := ctx.Err(); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// migratedPointer returns s3Pointer pointing to the copy of its payload in another bucket.
+func migratedPointer(s3Pointer *PayloadS3Pointer, s3BucketName, region string, result s3.StoreResult) *PayloadS3Pointer {
+	migrated := *s3Pointer
+	migrated.S3BucketName = s3BucketName
+	migrated.Region = region
+	migrated.VersionId = result.VersionId
+	migrated.ETag = result.ETag
+	return &migrated
+}
+
+// detectCodec returns the codec of the format of payloadPointer.
+func detectCodec(payloadPointer string) PointerCodec {
+	for _, codec := range DefaultPointerCodecs {
+		if codec.Detect(payloadPointer) {
+			return codec
+		}
+	}
+	return &JsonPointerCodec{}
+}
+
+// MigratingPayloadStore serves payloads during the cutover from the bucket of Source to the bucket of Target. New
+// payloads are stored in Target. Pointers to the source bucket are read from the same key in the target bucket first
+// and from the source bucket when the payload has not been copied yet, and deletes remove both copies. Payloads shared
+// by several consumers are released on both copies, see ReleaseOriginalPayload.
+type MigratingPayloadStore struct {
+	Source *S3BackedPayloadStore
+	Target *S3BackedPayloadStore
+}
+
+var _ PayloadStore = (*MigratingPayloadStore)(nil)
+
+func (mps *MigratingPayloadStore) StoreOriginalPayload(payload string) (string, error) {
+	return mps.Target.StoreOriginalPayload(payload)
+}
+
+func (mps *MigratingPayloadStore) StoreOriginalPayloadForS3Key(payload, s3Key string) (string, error) {
+	return mps.Target.StoreOriginalPayloadForS3Key(payload, s3Key)
+}
+
+func (mps *MigratingPayloadStore) GetOriginalPayload(payloadPointer string) (string, error) {
+	return mps.GetOriginalPayloadWithContext(context.Background(), payloadPointer)
+}
+
+// GetOriginalPayloadWithContext is GetOriginalPayload returning early with the error of ctx when it is done before the
+// payload has been read.
+func (mps *MigratingPayloadStore) GetOriginalPayloadWithContext(ctx context.Context, payloadPointer string) (string, error) {
+	targetPointer, err := mps.targetPointer(payloadPointer)
+	if err != nil || targetPointer == "" {
+		return mps.Target.GetOriginalPayloadWithContext(ctx, payloadPointer)
+	}
+	originalPayload, err := mps.Target.GetOriginalPayloadWithContext(ctx, targetPointer)
+	if err == nil || IsPayloadExpired(err) || ctx.Err() != nil {
+		return originalPayload, err
+	}
+
+	log.Printf("S3Client object not read from the target bucket, reading it from the source bucket, Bucket name: %s.", mps.Source.S3BucketName) // info
+	return mps.Source.GetOriginalPayloadWithContext(ctx, payloadPointer)
+}
+
+func (mps *MigratingPayloadStore) DeleteOriginalPayload(payloadPointer string) error {
+	return mps.ReleaseOriginalPayload(payloadPointer, "")
+}
+
+// ReleaseOriginalPayload is S3BackedPayloadStore.ReleaseOriginalPayload on both copies of a payload of the source
+// bucket. Both copies are released with the same consumer id, the ConsumerId of Target or else of Source when
+// consumerId is empty, so every consumer counts once in each bucket. Acknowledgements are not copied, a copy whose
+// consumers partly released the original before it was copied is deleted once its references expire.
+func (mps *MigratingPayloadStore) ReleaseOriginalPayload(payloadPointer, consumerId string) error {
+	targetPointer, err := mps.targetPointer(payloadPointer)
+	if err != nil || targetPointer == "" {
+		return mps.Target.ReleaseOriginalPayload(payloadPointer, consumerId)
+	}
+	if consumerId == "" {
+		consumerId = mps.Target.ConsumerId
+	}
+	if consumerId == "" {
+		consumerId = mps.Source.ConsumerId
+	}
+	targetErr := mps.Target.ReleaseOriginalPayload(targetPointer, consumerId)
+	if err := mps.Source.ReleaseOriginalPayload(payloadPointer, consumerId); err != nil {
+		return err
+	}
+	return targetErr
+}
+
+func (mps *MigratingPayloadStore) StoreOriginalPayloads(payloads []string) ([]string, error) {
+	return mps.Target.StoreOriginalPayloads(payloads)
+}
+
+func (mps *MigratingPayloadStore) GetOriginalPayloads(payloadPointers []string) ([]string, error) {
+	return GetEach(mps, payloadPointers, s3.DefaultBatchConcurrency)
+}
+
+func (mps *MigratingPayloadStore) DeleteOriginalPayloads(payloadPointers []string) error {
+	return DeleteEach(mps, payloadPointers, s3.DefaultBatchConcurrency)
+}
+
+// targetPointer returns the pointer to the copy of a payload of the source bucket in the target bucket, or "" when
+// payloadPointer does not point to the source bucket.
+func (mps *MigratingPayloadStore) targetPointer(payloadPointer string) (string, error) {
+	s3Pointer, err := ParsePointer(payloadPointer)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	if s3Pointer.S3BucketName != mps.Source.S3BucketName || mps.Source.S3BucketName == mps.Target.S3BucketName {
+		return "", nil
+	}
+	// The version and ETag of the copy are not known
+	migrated := migratedPointer(s3Pointer, mps.Target.S3BucketName, mps.Target.Region, s3.StoreResult{})
+	targetPointer, err := migrated.ToJson()
+	if err != nil {
+		return "", errors.New("Failed to rewrite the S3Client object pointer")
+	}
+	return targetPointer, nil
+}
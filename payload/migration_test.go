@@ -0,0 +1,151 @@
+package payload_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/inmemory"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"strings"
+	"testing"
+)
+
+const targetBucketName = "target-bucket-name"
+
+func TestMigratePointerStream(t *testing.T) {
+	sourceStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	sourceStore.PointerCodec = &payload.URIPointerCodec{}
+	dao.EnableVersioning(targetBucketName)
+	var pointers []string
+	for _, p := range []string{"first", "second", "third"} {
+		payloadPointer, err := sourceStore.StoreOriginalPayload(p)
+		assert.NoError(t, err)
+		pointers = append(pointers, payloadPointer)
+	}
+	pointers = append(pointers, `{"s3BucketName":"test-bucket-name","s3Key":"missing"}`)
+
+	migrator := &payload.PayloadMigrator{S3Dao: dao, TargetBucketName: targetBucketName, TargetRegion: "eu-west-1", BatchSize: 2}
+	var out bytes.Buffer
+	failed, err := migrator.MigratePointerStream(context.Background(), strings.NewReader(strings.Join(pointers, "\n")+"\n\n"), &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, failed)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 4)
+	targetStore := &payload.S3BackedPayloadStore{S3BucketName: targetBucketName, S3Dao: dao}
+	for i, line := range lines {
+		var mapping payload.PointerMapping
+		assert.NoError(t, json.Unmarshal([]byte(line), &mapping))
+		assert.Equal(t, pointers[i], mapping.OldPointer)
+		if i == 3 {
+			assert.Empty(t, mapping.NewPointer)
+			assert.NotEmpty(t, mapping.Error)
+			continue
+		}
+		assert.True(t, strings.HasPrefix(mapping.NewPointer, "s3://"+targetBucketName+"/"), mapping.NewPointer)
+		s3Pointer, err := payload.ParsePointer(mapping.NewPointer)
+		assert.NoError(t, err)
+		assert.Equal(t, "eu-west-1", s3Pointer.Region)
+		assert.NotEmpty(t, s3Pointer.VersionId)
+
+		originalPayload, err := targetStore.GetOriginalPayload(mapping.NewPointer)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"first", "second", "third"}[i], originalPayload)
+	}
+}
+
+func TestMigratingPayloadStoreFallsBackToSource(t *testing.T) {
+	sourceStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	targetStore := &payload.S3BackedPayloadStore{S3BucketName: targetBucketName, S3Dao: dao}
+	store := &payload.MigratingPayloadStore{Source: sourceStore, Target: targetStore}
+	oldPointer, err := sourceStore.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+	assert.NoError(t, err)
+
+	// Not copied yet
+	actualPayload, err := store.GetOriginalPayload(oldPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+	assert.Equal(t, 2, dao.Calls(inmemory.GetTextFromS3))
+
+	migrator := &payload.PayloadMigrator{S3Dao: dao, TargetBucketName: targetBucketName}
+	report, err := migrator.MigrateBucket(context.Background(), s3BucketName, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Copied)
+	assert.Empty(t, report.Failed)
+
+	// Copied, the source is not read anymore
+	assert.NoError(t, dao.DeletePayloadFromS3(s3BucketName, anyS3Key))
+	actualPayloads, err := store.GetOriginalPayloads([]string{oldPointer})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{anyPayload}, actualPayloads)
+
+	// New payloads go to the target
+	newPointer, err := store.StoreOriginalPayload(anyPayload)
+	assert.NoError(t, err)
+	s3Pointer, _ := payload.ParsePointer(newPointer)
+	assert.Equal(t, targetBucketName, s3Pointer.S3BucketName)
+}
+
+func TestMigratingPayloadStoreDeletesBothCopies(t *testing.T) {
+	sourceStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	targetStore := &payload.S3BackedPayloadStore{S3BucketName: targetBucketName, S3Dao: dao}
+	store := &payload.MigratingPayloadStore{Source: sourceStore, Target: targetStore}
+	oldPointer, _ := sourceStore.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+	_, err := (&payload.PayloadMigrator{S3Dao: dao, TargetBucketName: targetBucketName}).MigratePayload(oldPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, dao.Len())
+
+	assert.NoError(t, store.DeleteOriginalPayload(oldPointer))
+	assert.Equal(t, 0, dao.Len())
+}
+
+func TestMigrateBucketSkipsBookkeepingObjects(t *testing.T) {
+	sourceStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	sourceStore.ConsumerId = "queue-a"
+	dao.ListPageSize = 2
+	for _, p := range []string{"first", "second"} {
+		_, err := sourceStore.StoreOriginalPayload(p)
+		assert.NoError(t, err)
+	}
+	sharedPointer, _ := sourceStore.StoreOriginalPayloadForConsumers(anyPayload, 2)
+	assert.NoError(t, sourceStore.DeleteOriginalPayload(sharedPointer))
+	assert.NoError(t, dao.StoreTextInS3(s3BucketName, payload.HealthCheckKeyPrefix+"probe", "health check"))
+
+	listCalls := dao.Calls(inmemory.ListObjectsInS3)
+
+	migrator := &payload.PayloadMigrator{S3Dao: dao, TargetBucketName: targetBucketName}
+	report, err := migrator.MigrateBucket(context.Background(), s3BucketName, "")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Copied)
+	assert.Equal(t, 2, report.Skipped)
+	assert.Empty(t, report.Failed)
+	assert.Len(t, dao.Keys(targetBucketName), 3)
+	assert.Equal(t, 1, dao.Calls(inmemory.ListObjectPagesInS3))
+	assert.Equal(t, listCalls, dao.Calls(inmemory.ListObjectsInS3))
+}
+
+func TestMigratingPayloadStoreReleasesSharedPayloadsOnBothCopies(t *testing.T) {
+	sourceStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	targetStore := &payload.S3BackedPayloadStore{S3BucketName: targetBucketName, S3Dao: dao}
+	store := &payload.MigratingPayloadStore{Source: sourceStore, Target: targetStore}
+	oldPointer, _ := sourceStore.StoreOriginalPayloadForConsumers(anyPayload, 2)
+	_, err := (&payload.PayloadMigrator{S3Dao: dao, TargetBucketName: targetBucketName}).MigratePayload(oldPointer)
+	assert.NoError(t, err)
+
+	// Without a consumer id neither copy is released
+	assert.Error(t, store.DeleteOriginalPayload(oldPointer))
+	assert.Equal(t, 2, dao.Len())
+
+	assert.NoError(t, store.ReleaseOriginalPayload(oldPointer, "queue-a"))
+	assert.Len(t, dao.Keys(s3BucketName), 2)
+	assert.Len(t, dao.Keys(targetBucketName), 2)
+	actualPayload, err := store.GetOriginalPayload(oldPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+
+	targetStore.ConsumerId = "queue-b"
+	assert.NoError(t, store.DeleteOriginalPayload(oldPointer))
+	assert.Equal(t, 0, dao.Len())
+}
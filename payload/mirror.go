@@ -0,0 +1,504 @@
+package payload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultUnhealthyPeriod is how long a MirroringPayloadStore reads from the other bucket after a read failed, when
+// MirroringPayloadStore.UnhealthyPeriod is not set.
+const DefaultUnhealthyPeriod = 30 * time.Second
+
+// DefaultMaxHedgedReads is the number of hedged reads a MirroringPayloadStore runs at a time when
+// MirroringPayloadStore.MaxHedgedReads is not set.
+const DefaultMaxHedgedReads = 16
+
+// MirroringPayloadStore writes every payload to the buckets of Primary and Secondary concurrently, under the same key,
+// and records both locations in the pointer. Reads go to the bucket that is healthy, preferring the location in the
+// pointer, and fail over to the other copies, optionally hedging slow reads. Deletes remove all copies.
+//
+// The key, pointer format and optional fields of Primary are used for the payloads, except for Deduplicate, which is
+// not supported. The stores may use S3Daos for different regions. A payload written to fewer than Quorum buckets is
+// left to the garbage collector. Validate checks the configuration, it is meant to run at startup.
+type MirroringPayloadStore struct {
+	Primary   *S3BackedPayloadStore
+	Secondary *S3BackedPayloadStore
+	// Quorum is the number of buckets a payload must be written to before a store succeeds, 1 or 2. It is optional and
+	// defaults to 2.
+	Quorum int
+	// Async makes the store methods return as soon as Quorum writes succeeded, instead of waiting for both writes. The
+	// remaining write continues in the background, Flush waits for it. Pointers only record the copies written before the
+	// store returned, set ReplicaBuckets to read the copies written in the background.
+	Async bool
+	// OnMirrorError is optional, it is called with the errors of the writes that failed although the store succeeded,
+	// whether they failed before or after the store returned
+	OnMirrorError func(s3BucketName, s3Key string, err error)
+	// UnhealthyPeriod is optional and defaults to DefaultUnhealthyPeriod. A bucket is unhealthy after a read failed
+	// because S3 was unavailable, see s3.IsUnavailable, not after a read was rejected, for example for a missing key.
+	UnhealthyPeriod time.Duration
+	// Clock is optional and defaults to time.Now, it times the UnhealthyPeriod
+	Clock func() time.Time
+	// HedgeDelay is optional. When it is set and a read has not completed after HedgeDelay, the next copy of the payload
+	// is read as well and the first payload read is returned. By default the next copy is read only when a read fails.
+	HedgeDelay time.Duration
+	// MaxHedgedReads is optional and defaults to DefaultMaxHedgedReads. The S3 reads cannot be cancelled, a read that
+	// lost to another copy runs to completion in the background, so no more hedged reads are started while
+	// MaxHedgedReads of them are running.
+	MaxHedgedReads int
+	// ReplicaBuckets is optional, it maps a bucket to the buckets holding copies of its payloads under the same keys. The
+	// copies are read and deleted like the replicas recorded in pointers, for example for pointers written before
+	// mirroring or for buckets replicated by S3.
+	ReplicaBuckets map[string][]string
+	// ReplicaStores are the stores of the buckets in ReplicaBuckets other than the buckets of Primary and Secondary, by
+	// bucket name. The copies in a bucket are read and deleted by its store.
+	ReplicaStores map[string]*S3BackedPayloadStore
+
+	mu        sync.Mutex
+	unhealthy map[string]time.Time // per bucket, the time until which reads prefer other buckets
+	hedged    int                  // the hedged reads running
+
+	pendingMu sync.Mutex
+	pending   int        // the writes and reports running in the background
+	idle      *sync.Cond // broadcast when pending drops to zero
+}
+
+var _ PayloadStore = (*MirroringPayloadStore)(nil)
+
+// InvalidMirrorError is returned by MirroringPayloadStore.Validate when the stores cannot be used.
+type InvalidMirrorError struct {
+	Problems []string
+}
+
+func (e *InvalidMirrorError) Error() string {
+	return fmt.Sprintf("The payload mirror is invalid, Problems: %s.", strings.Join(e.Problems, "; "))
+}
+
+// Validate checks that Primary and Secondary have a bucket and S3Dao, and that every bucket in ReplicaBuckets has a
+// store. All problems found are reported in a single *InvalidMirrorError.
+func (mps *MirroringPayloadStore) Validate() error {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, named := range []struct {
+		name  string
+		store *S3BackedPayloadStore
+	}{{"primary", mps.Primary}, {"secondary", mps.Secondary}} {
+		switch {
+		case named.store == nil:
+			report("there is no %s store", named.name)
+		case named.store.S3BucketName == "":
+			report("the %s store has no bucket", named.name)
+		case named.store.S3Dao == nil:
+			report("the %s store has no S3Dao", named.name)
+		case named.store.Deduplicate:
+			report("the %s store deduplicates payloads", named.name)
+		case named.store.TTL < 0:
+			report("the %s store has a negative TTL", named.name)
+		}
+	}
+	if len(problems) == 0 && mps.Primary.S3BucketName == mps.Secondary.S3BucketName {
+		report("the primary and secondary stores share bucket %s", mps.Primary.S3BucketName)
+	}
+
+	s3BucketNames := make([]string, 0, len(mps.ReplicaStores))
+	for s3BucketName := range mps.ReplicaStores {
+		s3BucketNames = append(s3BucketNames, s3BucketName)
+	}
+	sort.Strings(s3BucketNames)
+	for _, s3BucketName := range s3BucketNames {
+		store := mps.ReplicaStores[s3BucketName]
+		switch {
+		case store == nil:
+			report("replica bucket %s has no store", s3BucketName)
+		case store.S3BucketName != s3BucketName:
+			report("the store of replica bucket %s is for bucket %s", s3BucketName, store.S3BucketName)
+		case store.S3Dao == nil:
+			report("the store of replica bucket %s has no S3Dao", s3BucketName)
+		}
+	}
+
+	s3BucketNames = s3BucketNames[:0]
+	for s3BucketName, replicaBucketNames := range mps.ReplicaBuckets {
+		s3BucketNames = append(s3BucketNames, s3BucketName)
+		s3BucketNames = append(s3BucketNames, replicaBucketNames...)
+	}
+	sort.Strings(s3BucketNames)
+	for i, s3BucketName := range s3BucketNames {
+		if i > 0 && s3BucketName == s3BucketNames[i-1] {
+			continue
+		}
+		if mps.bucketStore(s3BucketName) == nil {
+			report("bucket %s has no store", s3BucketName)
+		}
+	}
+
+	if len(problems) > 0 {
+		err := &InvalidMirrorError{Problems: problems}
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// mirrorWrite is the result of the write of a payload to one bucket.
+type mirrorWrite struct {
+	store  *S3BackedPayloadStore
+	result s3.StoreResult
+	err    error
+}
+
+func (mps *MirroringPayloadStore) StoreOriginalPayload(payload string) (string, error) {
+	s3Key, err := next(mps.Primary.KeyGenerator).GenerateKey()
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	return mps.StoreOriginalPayloadForS3Key(payload, s3Key)
+}
+
+func (mps *MirroringPayloadStore) StoreOriginalPayloadForS3Key(payload, s3Key string) (string, error) {
+	quorum := mps.Quorum
+	if quorum < 1 || quorum > 2 {
+		quorum = 2
+	}
+	stores := []*S3BackedPayloadStore{mps.Primary, mps.Secondary}
+	writes := make(chan mirrorWrite, len(stores))
+	for _, store := range stores {
+		store := store
+		mps.begin()
+		go func() {
+			defer mps.end()
+			result, err := store.S3Dao.StoreTextInS3WithOptions(store.S3BucketName, s3Key, payload, store.storeOptions())
+			if err == nil && store.Cache != nil {
+				store.Cache.Invalidate(store.S3BucketName, s3Key)
+			}
+			writes <- mirrorWrite{store, result, err}
+		}()
+	}
+
+	// Collect the writes, asynchronous stores only until the outcome is known
+	var written, failed []mirrorWrite
+	for len(written)+len(failed) < len(stores) {
+		if mps.Async && (len(written) >= quorum || len(failed) > len(stores)-quorum) {
+			break
+		}
+		write := <-writes
+		if write.err != nil {
+			log.Println(write.err)
+			failed = append(failed, write)
+		} else {
+			written = append(written, write)
+		}
+	}
+	remaining := len(stores) - len(written) - len(failed)
+	if remaining > 0 {
+		mps.begin()
+		go func() {
+			defer mps.end()
+			mps.reportLateWrites(writes, remaining, s3Key)
+		}()
+	}
+	if len(written) < quorum {
+		return "", failed[0].err
+	}
+	log.Printf("S3Client object mirrored, Object key: %s, Number of copies: %d.", s3Key, len(written)) // info
+	for _, write := range failed {
+		mps.reportMirrorError(write, s3Key)
+	}
+
+	// The first write of the primary, or of the secondary when the primary failed, is the location of the pointer
+	main := written[0]
+	for _, write := range written {
+		if write.store == mps.Primary {
+			main = write
+		}
+	}
+	s3Pointer := main.store.newPointer(s3Key, payload, main.result)
+	for _, write := range written {
+		if write.store != main.store {
+			s3Pointer.Replicas = append(s3Pointer.Replicas, PayloadLocation{
+				S3BucketName: write.store.S3BucketName,
+				S3Key:        s3Key,
+				Region:       write.store.Region,
+				VersionId:    write.result.VersionId,
+				ETag:         write.result.ETag,
+			})
+		}
+	}
+	return mps.Primary.encodePointer(&s3Pointer)
+}
+
+// reportLateWrites waits for the writes still running after a store returned and reports their failures.
+func (mps *MirroringPayloadStore) reportLateWrites(writes <-chan mirrorWrite, n int, s3Key string) {
+	for i := 0; i < n; i++ {
+		if write := <-writes; write.err != nil {
+			mps.reportMirrorError(write, s3Key)
+		}
+	}
+}
+
+// reportMirrorError reports a write that failed although the store succeeded.
+func (mps *MirroringPayloadStore) reportMirrorError(write mirrorWrite, s3Key string) {
+	log.Printf("S3Client object not mirrored, Bucket name: %s, Object key: %s.", write.store.S3BucketName, s3Key) // warn
+	if mps.OnMirrorError != nil {
+		mps.OnMirrorError(write.store.S3BucketName, s3Key, write.err)
+	}
+}
+
+// Flush waits for the writes continuing in the background after asynchronous stores returned, and for their failures
+// to be reported to OnMirrorError.
+func (mps *MirroringPayloadStore) Flush() {
+	mps.pendingMu.Lock()
+	defer mps.pendingMu.Unlock()
+	for mps.pending > 0 {
+		mps.idleCond().Wait()
+	}
+}
+
+func (mps *MirroringPayloadStore) begin() {
+	mps.pendingMu.Lock()
+	defer mps.pendingMu.Unlock()
+	mps.pending++
+}
+
+func (mps *MirroringPayloadStore) end() {
+	mps.pendingMu.Lock()
+	defer mps.pendingMu.Unlock()
+	mps.pending--
+	if mps.pending == 0 {
+		mps.idleCond().Broadcast()
+	}
+}
+
+// idleCond returns the condition Flush waits on, pendingMu must be held.
+func (mps *MirroringPayloadStore) idleCond() *sync.Cond {
+	if mps.idle == nil {
+		mps.idle = sync.NewCond(&mps.pendingMu)
+	}
+	return mps.idle
+}
+
+func (mps *MirroringPayloadStore) GetOriginalPayload(payloadPointer string) (string, error) {
+	return mps.GetOriginalPayloadWithContext(context.Background(), payloadPointer)
+}
+
+// locationRead is the result of the read of a payload from one location.
+type locationRead struct {
+	location PayloadLocation
+	payload  string
+	err      error
+}
+
+// GetOriginalPayloadWithContext reads the payload from the first healthy location of the pointer. The next location is
+// read when the read fails, or when it takes longer than HedgeDelay, and the first payload read is returned. The reads
+// still running then, or when ctx is done, complete in the background.
+func (mps *MirroringPayloadStore) GetOriginalPayloadWithContext(ctx context.Context, payloadPointer string) (string, error) {
+	s3Pointer, err := ParsePointer(payloadPointer)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	locations := mps.readOrder(mps.locations(s3Pointer))
+
+	reads := make(chan locationRead, len(locations))
+	started := 0
+	var hedge <-chan time.Time
+	readNext := func(hedged bool) {
+		location := locations[started]
+		started++
+		go func() {
+			if hedged {
+				defer mps.endHedge()
+			}
+			originalPayload, err := mps.getAt(s3Pointer, location)
+			reads <- locationRead{location, originalPayload, err}
+		}()
+		hedge = nil
+		if mps.HedgeDelay > 0 && started < len(locations) {
+			hedge = time.After(mps.HedgeDelay)
+		}
+	}
+
+	readNext(false)
+	var lastErr error
+	for completed := 0; completed < started; {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-hedge:
+			hedge = nil
+			if !mps.beginHedge() {
+				log.Printf("S3Client object read is slow, too many hedged reads to read another copy, Object key: %s.", s3Pointer.S3Key) // warn
+				continue
+			}
+			log.Printf("S3Client object read is slow, reading another copy, Bucket name: %s, Object key: %s.", locations[started].S3BucketName, s3Pointer.S3Key) // info
+			readNext(true)
+		case read := <-reads:
+			completed++
+			if read.err == nil {
+				return read.payload, nil
+			}
+			if IsPayloadExpired(read.err) {
+				return "", read.err
+			}
+			if s3.IsUnavailable(read.err) {
+				mps.markUnhealthy(read.location.S3BucketName)
+			}
+			lastErr = read.err
+			if started < len(locations) {
+				readNext(false)
+			}
+		}
+	}
+	return "", lastErr
+}
+
+// getAt reads the payload of s3Pointer from one of its locations.
+func (mps *MirroringPayloadStore) getAt(s3Pointer *PayloadS3Pointer, location PayloadLocation) (string, error) {
+	store, err := mps.storeFor(location.S3BucketName)
+	if err != nil {
+		return "", err
+	}
+	locationPointer, err := s3Pointer.At(location).ToJson()
+	if err != nil {
+		return "", err
+	}
+	return store.GetOriginalPayload(locationPointer)
+}
+
+// beginHedge reports whether another hedged read may start, and counts it when it may.
+func (mps *MirroringPayloadStore) beginHedge() bool {
+	max := mps.MaxHedgedReads
+	if max <= 0 {
+		max = DefaultMaxHedgedReads
+	}
+	mps.mu.Lock()
+	defer mps.mu.Unlock()
+	if mps.hedged >= max {
+		return false
+	}
+	mps.hedged++
+	return true
+}
+
+func (mps *MirroringPayloadStore) endHedge() {
+	mps.mu.Lock()
+	defer mps.mu.Unlock()
+	mps.hedged--
+}
+
+func (mps *MirroringPayloadStore) DeleteOriginalPayload(payloadPointer string) error {
+	s3Pointer, err := ParsePointer(payloadPointer)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	var firstErr error
+	for _, location := range mps.locations(s3Pointer) {
+		store, err := mps.storeFor(location.S3BucketName)
+		var locationPointer string
+		if err == nil {
+			locationPointer, err = s3Pointer.At(location).ToJson()
+		}
+		if err == nil {
+			err = store.DeleteOriginalPayload(locationPointer)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (mps *MirroringPayloadStore) StoreOriginalPayloads(payloads []string) ([]string, error) {
+	return StoreEach(mps, payloads, s3.DefaultBatchConcurrency)
+}
+
+func (mps *MirroringPayloadStore) GetOriginalPayloads(payloadPointers []string) ([]string, error) {
+	return GetEach(mps, payloadPointers, s3.DefaultBatchConcurrency)
+}
+
+func (mps *MirroringPayloadStore) DeleteOriginalPayloads(payloadPointers []string) error {
+	return DeleteEach(mps, payloadPointers, s3.DefaultBatchConcurrency)
+}
+
+// storeFor returns the store of the given bucket, pointers to buckets without a store are rejected.
+func (mps *MirroringPayloadStore) storeFor(s3BucketName string) (*S3BackedPayloadStore, error) {
+	store := mps.bucketStore(s3BucketName)
+	if store == nil {
+		err := errors.New("The S3Client bucket is not a bucket of the payload mirror")
+		log.Println(err)
+		return nil, err
+	}
+	return store, nil
+}
+
+// bucketStore returns the store of the given bucket: Primary, Secondary or the one in ReplicaStores, or nil when the
+// bucket has none.
+func (mps *MirroringPayloadStore) bucketStore(s3BucketName string) *S3BackedPayloadStore {
+	switch {
+	case mps.Primary != nil && s3BucketName == mps.Primary.S3BucketName:
+		return mps.Primary
+	case mps.Secondary != nil && s3BucketName == mps.Secondary.S3BucketName:
+		return mps.Secondary
+	}
+	return mps.ReplicaStores[s3BucketName]
+}
+
+// locations returns the locations of s3Pointer followed by the copies in its ReplicaBuckets that it does not record.
+func (mps *MirroringPayloadStore) locations(s3Pointer *PayloadS3Pointer) []PayloadLocation {
+	locations := s3Pointer.Locations()
+	for _, s3BucketName := range mps.ReplicaBuckets[s3Pointer.S3BucketName] {
+		recorded := false
+		for _, location := range locations {
+			recorded = recorded || location.S3BucketName == s3BucketName
+		}
+		if !recorded {
+			location := PayloadLocation{S3BucketName: s3BucketName, S3Key: s3Pointer.S3Key}
+			if store := mps.bucketStore(s3BucketName); store != nil {
+				location.Region = store.Region
+			}
+			locations = append(locations, location)
+		}
+	}
+	return locations
+}
+
+// readOrder returns locations with the ones in unhealthy buckets moved to the end.
+func (mps *MirroringPayloadStore) readOrder(locations []PayloadLocation) []PayloadLocation {
+	mps.mu.Lock()
+	defer mps.mu.Unlock()
+	now := now(mps.Clock)
+	var healthy, unhealthy []PayloadLocation
+	for _, location := range locations {
+		if until, ok := mps.unhealthy[location.S3BucketName]; ok && now.Before(until) {
+			unhealthy = append(unhealthy, location)
+		} else {
+			healthy = append(healthy, location)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (mps *MirroringPayloadStore) markUnhealthy(s3BucketName string) {
+	period := mps.UnhealthyPeriod
+	if period <= 0 {
+		period = DefaultUnhealthyPeriod
+	}
+	mps.mu.Lock()
+	defer mps.mu.Unlock()
+	if mps.unhealthy == nil {
+		mps.unhealthy = make(map[string]time.Time)
+	}
+	mps.unhealthy[s3BucketName] = now(mps.Clock).Add(period)
+	log.Printf("S3Client bucket marked unhealthy, Bucket name: %s.", s3BucketName) // warn
+}
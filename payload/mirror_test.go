@@ -0,0 +1,357 @@
+package payload_test
+
+import (
+	"errors"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/inmemory"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+const secondaryBucketName = "secondary-bucket-name"
+
+func newMirroringPayloadStore() (*payload.MirroringPayloadStore, *inmemory.S3Dao, *inmemory.S3Dao) {
+	primary, primaryDao := inmemory.NewPayloadStore(s3BucketName)
+	primary.Region = "eu-west-1"
+	secondary, secondaryDao := inmemory.NewPayloadStore(secondaryBucketName)
+	secondary.Region = "eu-central-1"
+	return &payload.MirroringPayloadStore{Primary: primary, Secondary: secondary}, primaryDao, secondaryDao
+}
+
+// s3Error returns the error of an S3 response with the given HTTP status
+func s3Error(status int) error {
+	return &awshttp.ResponseError{ResponseError: &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+		Err:      errors.New(http.StatusText(status)),
+	}}
+}
+
+func TestMirroringPayloadStoreWritesBothBuckets(t *testing.T) {
+	store, primaryDao, secondaryDao := newMirroringPayloadStore()
+
+	payloadPointer, err := store.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+	assert.NoError(t, err)
+
+	s3Pointer, err := payload.ParsePointer(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, s3BucketName, s3Pointer.S3BucketName)
+	assert.Equal(t, "eu-west-1", s3Pointer.Region)
+	assert.Equal(t, []payload.PayloadLocation{{
+		S3BucketName: secondaryBucketName,
+		S3Key:        anyS3Key,
+		Region:       "eu-central-1",
+		ETag:         `"08269d3d09c23249009e7126d1b56ed0"`,
+	}}, s3Pointer.Replicas)
+	for _, dao := range []*inmemory.S3Dao{primaryDao, secondaryDao} {
+		assert.Equal(t, 1, dao.Len())
+	}
+
+	assert.NoError(t, store.DeleteOriginalPayload(payloadPointer))
+	assert.Equal(t, 0, primaryDao.Len())
+	assert.Equal(t, 0, secondaryDao.Len())
+}
+
+func TestMirroringPayloadStoreReplicaStores(t *testing.T) {
+	store, primaryDao, _ := newMirroringPayloadStore()
+	replica, replicaDao := inmemory.NewPayloadStore("replica-bucket-name")
+	store.ReplicaBuckets = map[string][]string{s3BucketName: {"replica-bucket-name"}}
+	store.ReplicaStores = map[string]*payload.S3BackedPayloadStore{"replica-bucket-name": replica}
+	assert.NoError(t, store.Validate())
+	payloadPointer, _ := store.Primary.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+	_, _ = replica.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+
+	// The copy is read by the store of its bucket
+	primaryDao.FailNext(inmemory.GetTextFromS3, s3Error(http.StatusServiceUnavailable))
+	actualPayload, err := store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+	assert.Equal(t, 1, replicaDao.Calls(inmemory.GetTextFromS3))
+
+	assert.NoError(t, store.DeleteOriginalPayload(payloadPointer))
+	assert.Equal(t, 0, replicaDao.Len())
+}
+
+func TestMirroringPayloadStoreValidate(t *testing.T) {
+	store, _, _ := newMirroringPayloadStore()
+	assert.NoError(t, store.Validate())
+
+	other, _ := inmemory.NewPayloadStore("other-bucket-name")
+	store.ReplicaBuckets = map[string][]string{"old-bucket-name": {s3BucketName, "unknown-bucket-name"}}
+	store.ReplicaStores = map[string]*payload.S3BackedPayloadStore{"replica-bucket-name": other}
+	err := store.Validate()
+	var invalidMirrorError *payload.InvalidMirrorError
+	assert.True(t, errors.As(err, &invalidMirrorError))
+	assert.Equal(t, []string{
+		"the store of replica bucket replica-bucket-name is for bucket other-bucket-name",
+		"bucket old-bucket-name has no store",
+		"bucket unknown-bucket-name has no store",
+	}, invalidMirrorError.Problems)
+
+	// Pointers to buckets without a store are rejected
+	payloadPointer, _ := other.StoreOriginalPayload(anyPayload)
+	_, err = store.GetOriginalPayload(payloadPointer)
+	assert.Error(t, err)
+}
+
+func TestMirroringPayloadStoreReadsHealthyBucket(t *testing.T) {
+	store, primaryDao, secondaryDao := newMirroringPayloadStore()
+	clock := time.Date(2021, 8, 9, 14, 30, 0, 0, time.UTC)
+	store.Clock = func() time.Time { return clock }
+	payloadPointer, _ := store.StoreOriginalPayload(anyPayload)
+
+	primaryDao.FailNext(inmemory.GetTextFromS3, s3Error(http.StatusServiceUnavailable))
+	actualPayload, err := store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+	assert.Equal(t, 1, secondaryDao.Calls(inmemory.GetTextFromS3))
+
+	// The primary is skipped while it is unhealthy
+	actualPayloads, err := store.GetOriginalPayloads([]string{payloadPointer})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{anyPayload}, actualPayloads)
+	assert.Equal(t, 1, primaryDao.Calls(inmemory.GetTextFromS3))
+	assert.Equal(t, 2, secondaryDao.Calls(inmemory.GetTextFromS3))
+
+	clock = clock.Add(payload.DefaultUnhealthyPeriod)
+	_, err = store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, primaryDao.Calls(inmemory.GetTextFromS3))
+}
+
+func TestMirroringPayloadStoreStaysHealthyOnRejectedReads(t *testing.T) {
+	store, primaryDao, secondaryDao := newMirroringPayloadStore()
+	payloadPointer, _ := store.StoreOriginalPayload(anyPayload)
+
+	// A missing key fails over without marking the primary unhealthy
+	primaryDao.FailNext(inmemory.GetTextFromS3, s3Error(http.StatusNotFound))
+	actualPayload, err := store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+	assert.Equal(t, 1, secondaryDao.Calls(inmemory.GetTextFromS3))
+
+	_, err = store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, primaryDao.Calls(inmemory.GetTextFromS3))
+	assert.Equal(t, 1, secondaryDao.Calls(inmemory.GetTextFromS3))
+
+	// So does throttling
+	primaryDao.FailNext(inmemory.GetTextFromS3, s3Error(http.StatusTooManyRequests))
+	_, err = store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	_, err = store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, primaryDao.Calls(inmemory.GetTextFromS3))
+	assert.Equal(t, 3, secondaryDao.Calls(inmemory.GetTextFromS3))
+}
+
+func TestMirroringPayloadStoreQuorum(t *testing.T) {
+	store, _, secondaryDao := newMirroringPayloadStore()
+	var mirrorErrs []string
+	store.OnMirrorError = func(s3BucketName, s3Key string, err error) {
+		mirrorErrs = append(mirrorErrs, s3BucketName+"/"+s3Key+": "+err.Error())
+	}
+
+	// A failed store is not reported
+	secondaryDao.FailNext(inmemory.StoreTextInS3WithOptions, errors.New("injected"))
+	_, err := store.StoreOriginalPayload(anyPayload)
+	assert.Error(t, err)
+	assert.Empty(t, mirrorErrs)
+
+	store.Quorum = 1
+	secondaryDao.FailNext(inmemory.StoreTextInS3WithOptions, errors.New("injected"))
+	payloadPointer, err := store.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+	assert.NoError(t, err)
+	s3Pointer, _ := payload.ParsePointer(payloadPointer)
+	assert.Empty(t, s3Pointer.Replicas)
+	assert.Equal(t, []string{secondaryBucketName + "/" + anyS3Key + ": injected"}, mirrorErrs)
+}
+
+func TestMirroringPayloadStoreAsync(t *testing.T) {
+	store, primaryDao, _ := newMirroringPayloadStore()
+	slowDao := &slowS3Dao{S3Dao: inmemory.NewS3Dao(), delay: 50 * time.Millisecond}
+	store.Secondary.S3Dao = slowDao
+	store.Quorum = 1
+	store.Async = true
+	var mu sync.Mutex
+	var mirrorErrs []error
+	store.OnMirrorError = func(s3BucketName, s3Key string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		mirrorErrs = append(mirrorErrs, err)
+	}
+
+	payloadPointer, err := store.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+	assert.NoError(t, err)
+	// The copy still being written is not recorded
+	s3Pointer, _ := payload.ParsePointer(payloadPointer)
+	assert.Empty(t, s3Pointer.Replicas)
+	assert.Equal(t, 1, primaryDao.Len())
+	assert.Equal(t, 0, slowDao.Len())
+
+	store.Flush()
+	assert.Equal(t, 1, slowDao.Len())
+	store.ReplicaBuckets = map[string][]string{s3BucketName: {secondaryBucketName}}
+	primaryDao.FailNext(inmemory.GetTextFromS3, s3Error(http.StatusServiceUnavailable))
+	actualPayload, err := store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+
+	slowDao.FailNext(inmemory.StoreTextInS3WithOptions, errors.New("injected"))
+	_, err = store.StoreOriginalPayload(anyPayload)
+	assert.NoError(t, err)
+	store.Flush()
+	assert.Len(t, mirrorErrs, 1)
+}
+
+func TestMirroringPayloadStoreFlushDuringStores(t *testing.T) {
+	store, primaryDao, secondaryDao := newMirroringPayloadStore()
+	store.Quorum = 1
+	store.Async = true
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := store.StoreOriginalPayload(anyPayload)
+			assert.NoError(t, err)
+		}()
+		go func() {
+			defer wg.Done()
+			store.Flush()
+		}()
+	}
+	wg.Wait()
+	store.Flush()
+	assert.Equal(t, 8, primaryDao.Len())
+	assert.Equal(t, 8, secondaryDao.Len())
+}
+
+// slowReadS3Dao delays every read by delay
+type slowReadS3Dao struct {
+	*inmemory.S3Dao
+	delay time.Duration
+}
+
+func (dao *slowReadS3Dao) GetTextFromS3(s3BucketName, s3Key string) (string, error) {
+	time.Sleep(dao.delay)
+	return dao.S3Dao.GetTextFromS3(s3BucketName, s3Key)
+}
+
+func (dao *slowReadS3Dao) GetTextFromS3Version(s3BucketName, s3Key, versionId string) (string, error) {
+	time.Sleep(dao.delay)
+	return dao.S3Dao.GetTextFromS3Version(s3BucketName, s3Key, versionId)
+}
+
+func TestMirroringPayloadStoreHedgesSlowReads(t *testing.T) {
+	store, primaryDao, secondaryDao := newMirroringPayloadStore()
+	payloadPointer, _ := store.StoreOriginalPayload(anyPayload)
+	store.Primary.S3Dao = &slowReadS3Dao{S3Dao: primaryDao, delay: 200 * time.Millisecond}
+	store.HedgeDelay = 10 * time.Millisecond
+
+	start := time.Now()
+	actualPayload, err := store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+	assert.True(t, time.Since(start) < 200*time.Millisecond)
+	assert.Equal(t, 1, secondaryDao.Calls(inmemory.GetTextFromS3))
+
+	// Without hedging the slow read completes
+	store.HedgeDelay = 0
+	actualPayload, err = store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+	assert.Equal(t, 1, secondaryDao.Calls(inmemory.GetTextFromS3))
+}
+
+func TestMirroringPayloadStoreCapsHedgedReads(t *testing.T) {
+	store, primaryDao, secondaryDao := newMirroringPayloadStore()
+	payloadPointer, _ := store.StoreOriginalPayload(anyPayload)
+	store.Primary.S3Dao = &slowReadS3Dao{S3Dao: primaryDao, delay: 300 * time.Millisecond}
+	store.Secondary.S3Dao = &slowReadS3Dao{S3Dao: secondaryDao, delay: 100 * time.Millisecond}
+	store.HedgeDelay = 10 * time.Millisecond
+	store.MaxHedgedReads = 1
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := store.GetOriginalPayload(payloadPointer)
+		assert.NoError(t, err)
+	}()
+	time.Sleep(30 * time.Millisecond)
+
+	// The hedged read of the first read is still running, so the second read waits for the primary
+	actualPayload, err := store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+	wg.Wait()
+	assert.Equal(t, 1, secondaryDao.Calls(inmemory.GetTextFromS3))
+}
+
+func TestMirroringPayloadStoreHedgedReadFailsOver(t *testing.T) {
+	store, primaryDao, secondaryDao := newMirroringPayloadStore()
+	payloadPointer, _ := store.StoreOriginalPayload(anyPayload)
+	store.HedgeDelay = time.Hour
+
+	primaryDao.FailNext(inmemory.GetTextFromS3, errors.New("injected"))
+	actualPayload, err := store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+	assert.Equal(t, 1, secondaryDao.Calls(inmemory.GetTextFromS3))
+
+	primaryDao.FailNext(inmemory.GetTextFromS3, errors.New("injected"))
+	secondaryDao.FailNext(inmemory.GetTextFromS3, errors.New("injected"))
+	_, err = store.GetOriginalPayload(payloadPointer)
+	assert.Error(t, err)
+}
+
+func TestMirroringPayloadStoreReplicaBuckets(t *testing.T) {
+	store, primaryDao, secondaryDao := newMirroringPayloadStore()
+	store.ReplicaBuckets = map[string][]string{s3BucketName: {secondaryBucketName}}
+	// Pointers written by the primary alone record no replicas
+	payloadPointer, _ := store.Primary.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+	_, _ = store.Secondary.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+
+	primaryDao.FailNext(inmemory.GetTextFromS3, errors.New("injected"))
+	actualPayload, err := store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+	assert.Equal(t, 1, secondaryDao.Calls(inmemory.GetTextFromS3))
+
+	assert.NoError(t, store.DeleteOriginalPayload(payloadPointer))
+	assert.Equal(t, 0, primaryDao.Len())
+	assert.Equal(t, 0, secondaryDao.Len())
+}
+
+func TestOnlyMirroringPayloadStoreFailsOverToReplicas(t *testing.T) {
+	store, primaryDao, secondaryDao := newMirroringPayloadStore()
+	payloadPointer, err := store.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+	assert.NoError(t, err)
+	routing, err := payload.NewRoutingPayloadStore(&payload.TenantRouter{DefaultRoute: "primary"},
+		map[string]*payload.S3BackedPayloadStore{"primary": store.Primary})
+	assert.NoError(t, err)
+
+	// The replica recorded in the pointer is ignored by the plain and the routing store
+	for _, plain := range []payload.PayloadStore{store.Primary, routing} {
+		primaryDao.FailNext(inmemory.GetTextFromS3, s3Error(http.StatusServiceUnavailable))
+		_, err = plain.GetOriginalPayload(payloadPointer)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 0, secondaryDao.Calls(inmemory.GetTextFromS3))
+
+	primaryDao.FailNext(inmemory.GetTextFromS3, s3Error(http.StatusServiceUnavailable))
+	actualPayload, err := store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+	assert.Equal(t, 1, secondaryDao.Calls(inmemory.GetTextFromS3))
+
+	assert.NoError(t, routing.DeleteOriginalPayload(payloadPointer))
+	assert.Equal(t, 0, primaryDao.Len())
+	assert.Equal(t, 1, secondaryDao.Len())
+}
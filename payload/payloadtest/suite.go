@@ -0,0 +1,257 @@
+// Package payloadtest provides a conformance test suite for payload.PayloadStore implementations.
+package payloadtest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// StoreFactory returns a new, empty PayloadStore for a single test. Cleanup should be registered with t.Cleanup.
+type StoreFactory func(t *testing.T) payload.PayloadStore
+
+// LargePayloadSize is the size of the payload used by the large payload test.
+const LargePayloadSize = 8 * 1024 * 1024
+
+// RunPayloadStoreSuite verifies that the stores returned by factory honour the PayloadStore contract, using the
+// semantics of S3BackedPayloadStore as the reference.
+func RunPayloadStoreSuite(t *testing.T, factory StoreFactory) {
+	t.Run("RoundTrip", func(t *testing.T) { testRoundTrip(t, factory(t)) })
+	t.Run("UniqueKeys", func(t *testing.T) { testUniqueKeys(t, factory(t)) })
+	t.Run("ExplicitKey", func(t *testing.T) { testExplicitKey(t, factory(t)) })
+	t.Run("ExplicitKeyOverwrite", func(t *testing.T) { testExplicitKeyOverwrite(t, factory(t)) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, factory(t)) })
+	t.Run("DeleteTwice", func(t *testing.T) { testDeleteTwice(t, factory(t)) })
+	t.Run("MissingObject", func(t *testing.T) { testMissingObject(t, factory(t)) })
+	t.Run("InvalidPointer", func(t *testing.T) { testInvalidPointer(t, factory(t)) })
+	t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, factory(t)) })
+	t.Run("LargePayload", func(t *testing.T) { testLargePayload(t, factory(t)) })
+	t.Run("Batch", func(t *testing.T) { testBatch(t, factory(t)) })
+	t.Run("BatchPartialFailure", func(t *testing.T) { testBatchPartialFailure(t, factory(t)) })
+}
+
+func testRoundTrip(t *testing.T, store payload.PayloadStore) {
+	for _, original := range []string{"AnyPayload", "{\"json\": [1, 2, 3]}", "Grüße, 世界 🚀", "line 1\nline 2\r\n\ttabbed"} {
+		pointer := mustStore(t, store, original)
+		assertPayload(t, store, pointer, original)
+	}
+}
+
+func testUniqueKeys(t *testing.T, store payload.PayloadStore) {
+	first := mustStore(t, store, "AnyPayload")
+	second := mustStore(t, store, "AnyPayload")
+	if first == second {
+		t.Fatalf("Expected different pointers for separately stored payloads, but both are '%s'", first)
+	}
+	assertPayload(t, store, first, "AnyPayload")
+	assertPayload(t, store, second, "AnyPayload")
+}
+
+func testExplicitKey(t *testing.T, store payload.PayloadStore) {
+	pointer, err := store.StoreOriginalPayloadForS3Key("AnyPayload", "conformance/AnyS3Key")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: '%v'", err)
+	}
+	if !strings.Contains(pointer, "AnyS3Key") {
+		t.Errorf("Expected the pointer '%s' to refer to the explicit key", pointer)
+	}
+	assertPayload(t, store, pointer, "AnyPayload")
+}
+
+func testExplicitKeyOverwrite(t *testing.T, store payload.PayloadStore) {
+	first, err := store.StoreOriginalPayloadForS3Key("FirstPayload", "AnyS3Key")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: '%v'", err)
+	}
+	second, err := store.StoreOriginalPayloadForS3Key("SecondPayload", "AnyS3Key")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: '%v'", err)
+	}
+	assertPayload(t, store, second, "SecondPayload")
+	if first == second {
+		assertPayload(t, store, first, "SecondPayload")
+	}
+}
+
+func testDelete(t *testing.T, store payload.PayloadStore) {
+	pointer := mustStore(t, store, "AnyPayload")
+	other := mustStore(t, store, "OtherPayload")
+
+	if err := store.DeleteOriginalPayload(pointer); err != nil {
+		t.Fatalf("Expected no error, but got: '%v'", err)
+	}
+	if _, err := store.GetOriginalPayload(pointer); err == nil {
+		t.Errorf("Expected an error reading a deleted payload")
+	}
+	assertPayload(t, store, other, "OtherPayload")
+}
+
+func testDeleteTwice(t *testing.T, store payload.PayloadStore) {
+	pointer := mustStore(t, store, "AnyPayload")
+
+	if err := store.DeleteOriginalPayload(pointer); err != nil {
+		t.Fatalf("Expected no error, but got: '%v'", err)
+	}
+	if err := store.DeleteOriginalPayload(pointer); err != nil {
+		t.Errorf("Expected deleting a deleted payload to succeed, but got: '%v'", err)
+	}
+}
+
+func testMissingObject(t *testing.T, store payload.PayloadStore) {
+	pointer, err := store.StoreOriginalPayloadForS3Key("AnyPayload", "MissingS3Key")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: '%v'", err)
+	}
+	if err := store.DeleteOriginalPayload(pointer); err != nil {
+		t.Fatalf("Expected no error, but got: '%v'", err)
+	}
+
+	actualPayload, err := store.GetOriginalPayload(pointer)
+	if err == nil {
+		t.Errorf("Expected an error reading a missing payload, but got '%s'", actualPayload)
+	}
+}
+
+func testInvalidPointer(t *testing.T, store payload.PayloadStore) {
+	for _, pointer := range []string{"", "IncorrectPointer", "{", "[]", "{}"} {
+		if _, err := store.GetOriginalPayload(pointer); err == nil {
+			t.Errorf("Expected an error reading invalid pointer '%s'", pointer)
+		}
+		if err := store.DeleteOriginalPayload(pointer); err == nil {
+			t.Errorf("Expected an error deleting invalid pointer '%s'", pointer)
+		}
+	}
+}
+
+func testConcurrency(t *testing.T, store payload.PayloadStore) {
+	const workers = 16
+	const iterations = 10
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*iterations)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				original := fmt.Sprintf("Payload %d-%d", w, i)
+				pointer, err := store.StoreOriginalPayload(original)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				actualPayload, err := store.GetOriginalPayload(pointer)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				if actualPayload != original {
+					errs <- fmt.Errorf("Expected payload '%s', but got '%s'", original, actualPayload)
+					continue
+				}
+				if err := store.DeleteOriginalPayload(pointer); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func testLargePayload(t *testing.T, store payload.PayloadStore) {
+	original := strings.Repeat("0123456789abcdef", LargePayloadSize/16)
+	pointer := mustStore(t, store, original)
+	assertPayload(t, store, pointer, original)
+}
+
+func testBatch(t *testing.T, store payload.PayloadStore) {
+	payloads := make([]string, 25)
+	for i := range payloads {
+		payloads[i] = fmt.Sprintf("Payload %d", i)
+	}
+
+	pointers, err := store.StoreOriginalPayloads(payloads)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: '%v'", err)
+	}
+	if len(pointers) != len(payloads) {
+		t.Fatalf("Expected %d pointers, but got %d", len(payloads), len(pointers))
+	}
+	for i, pointer := range pointers {
+		assertPayload(t, store, pointer, payloads[i])
+	}
+
+	actualPayloads, err := store.GetOriginalPayloads(pointers)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: '%v'", err)
+	}
+	for i := range payloads {
+		if actualPayloads[i] != payloads[i] {
+			t.Errorf("Expected payload '%s' at index %d, but got '%s'", payloads[i], i, actualPayloads[i])
+		}
+	}
+
+	if err := store.DeleteOriginalPayloads(pointers); err != nil {
+		t.Fatalf("Expected no error, but got: '%v'", err)
+	}
+	for _, pointer := range pointers {
+		if _, err := store.GetOriginalPayload(pointer); err == nil {
+			t.Errorf("Expected an error reading deleted payload '%s'", pointer)
+		}
+	}
+}
+
+func testBatchPartialFailure(t *testing.T, store payload.PayloadStore) {
+	pointer := mustStore(t, store, "AnyPayload")
+
+	actualPayloads, err := store.GetOriginalPayloads([]string{pointer, "IncorrectPointer"})
+	var batchError *payload.BatchError
+	if !errors.As(err, &batchError) {
+		t.Fatalf("Expected a *payload.BatchError, but got: '%v'", err)
+	}
+	if batchError.Err(0) != nil || batchError.Err(1) == nil {
+		t.Errorf("Expected only the incorrect pointer to fail, but got: '%v'", batchError.Errors)
+	}
+	if len(actualPayloads) != 2 || actualPayloads[0] != "AnyPayload" {
+		t.Errorf("Expected the payload of the correct pointer, but got: '%v'", actualPayloads)
+	}
+
+	err = store.DeleteOriginalPayloads([]string{"IncorrectPointer", pointer})
+	if !errors.As(err, &batchError) {
+		t.Fatalf("Expected a *payload.BatchError, but got: '%v'", err)
+	}
+	if batchError.Err(0) == nil || batchError.Err(1) != nil {
+		t.Errorf("Expected only the incorrect pointer to fail, but got: '%v'", batchError.Errors)
+	}
+	if _, err := store.GetOriginalPayload(pointer); err == nil {
+		t.Errorf("Expected the correct pointer to be deleted")
+	}
+}
+
+func mustStore(t *testing.T, store payload.PayloadStore, original string) string {
+	t.Helper()
+	pointer, err := store.StoreOriginalPayload(original)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: '%v'", err)
+	}
+	return pointer
+}
+
+func assertPayload(t *testing.T, store payload.PayloadStore, pointer, expected string) {
+	t.Helper()
+	actualPayload, err := store.GetOriginalPayload(pointer)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: '%v'", err)
+	}
+	if actualPayload != expected {
+		t.Errorf("Expected payload of %d bytes, but got %d bytes: '%.64s'", len(expected), len(actualPayload), actualPayload)
+	}
+}
@@ -0,0 +1,60 @@
+package payloadtest
+
+import (
+	"github.com/threehook/aws-payload-offloading-go/inmemory"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"github.com/threehook/aws-payload-offloading-go/s3/s3test"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+const s3BucketName = "test-bucket-name"
+
+func TestMain(m *testing.M) {
+	// Suppress logging in unit tests
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func TestS3BackedPayloadStore(t *testing.T) {
+	RunPayloadStoreSuite(t, func(t *testing.T) payload.PayloadStore {
+		server := s3test.NewServer(s3BucketName)
+		t.Cleanup(server.Close)
+		return &payload.S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: &s3.S3Dao{S3Client: server.Client()}}
+	})
+}
+
+func TestInMemoryPayloadStore(t *testing.T) {
+	RunPayloadStoreSuite(t, func(t *testing.T) payload.PayloadStore {
+		store, _ := inmemory.NewPayloadStore(s3BucketName)
+		return store
+	})
+}
+
+func TestCachedPayloadStore(t *testing.T) {
+	RunPayloadStoreSuite(t, func(t *testing.T) payload.PayloadStore {
+		store, _ := inmemory.NewPayloadStore(s3BucketName)
+		store.Cache = payload.NewPayloadCache(64*1024*1024, 0)
+		return store
+	})
+}
+
+func TestURIPointerPayloadStore(t *testing.T) {
+	RunPayloadStoreSuite(t, func(t *testing.T) payload.PayloadStore {
+		store, _ := inmemory.NewPayloadStore(s3BucketName)
+		store.PointerCodec = &payload.URIPointerCodec{}
+		return store
+	})
+}
+
+func TestVersionedS3BackedPayloadStore(t *testing.T) {
+	RunPayloadStoreSuite(t, func(t *testing.T) payload.PayloadStore {
+		server := s3test.NewServer(s3BucketName)
+		server.EnableVersioning(s3BucketName)
+		t.Cleanup(server.Close)
+		return &payload.S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: &s3.S3Dao{S3Client: server.Client()}}
+	})
+}
@@ -4,14 +4,77 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"time"
 )
 
 type PayloadS3Pointer struct {
 	// private static final Logger LOG = LoggerFactory.getLogger(PayloadS3Pointer.class);
 	S3BucketName string `json:"s3BucketName"`
 	S3Key        string `json:"s3Key"`
+	// ExpectedConsumers is set when the payload is shared by several consumers, see StoreOriginalPayloadForConsumers
+	ExpectedConsumers int `json:"expectedConsumers,omitempty"`
+	// ReferencesExpireAt is the time after which a shared payload may be deleted by any consumer
+	ReferencesExpireAt *time.Time `json:"referencesExpireAt,omitempty"`
+	// ContentAddressed is set when the key was derived from the payload and the object may be shared by other
+	// pointers, see S3BackedPayloadStore.Deduplicate. Such objects are not deleted with the pointer.
+	ContentAddressed bool `json:"contentAddressed,omitempty"`
+
+	// The fields below describe the stored payload so consumers can inspect it before downloading. They are all
+	// optional, pointers written before they were added only hold the bucket name and key.
+	Size            int64      `json:"size,omitempty"`
+	ContentType     string     `json:"contentType,omitempty"`
+	ContentEncoding string     `json:"contentEncoding,omitempty"`
+	VersionId       string     `json:"versionId,omitempty"`
+	ETag            string     `json:"eTag,omitempty"`
+	Region          string     `json:"region,omitempty"`
+	CreatedAt       *time.Time `json:"createdAt,omitempty"`
+	// SHA256 is the hex encoded SHA-256 checksum of the payload
+	SHA256        string `json:"sha256,omitempty"`
+	SchemaVersion int    `json:"schemaVersion,omitempty"`
+	// ExpiresAt is set when the payload was stored with a TTL, the payload cannot be retrieved after this time
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Replicas are the other locations of the payload, for example written by a MirroringPayloadStore. Only the
+	// MirroringPayloadStore reads and deletes them, the other stores use the location of the pointer alone.
+	Replicas []PayloadLocation `json:"replicas,omitempty"`
+}
+
+// PayloadLocation is a copy of a payload in another bucket.
+type PayloadLocation struct {
+	S3BucketName string `json:"s3BucketName"`
+	S3Key        string `json:"s3Key"`
+	Region       string `json:"region,omitempty"`
+	VersionId    string `json:"versionId,omitempty"`
+	ETag         string `json:"eTag,omitempty"`
+}
+
+// Locations returns the location of the payload followed by its Replicas.
+func (psp *PayloadS3Pointer) Locations() []PayloadLocation {
+	locations := []PayloadLocation{{
+		S3BucketName: psp.S3BucketName,
+		S3Key:        psp.S3Key,
+		Region:       psp.Region,
+		VersionId:    psp.VersionId,
+		ETag:         psp.ETag,
+	}}
+	return append(locations, psp.Replicas...)
+}
+
+// At returns the pointer to the copy of the payload at location, without replicas.
+func (psp *PayloadS3Pointer) At(location PayloadLocation) *PayloadS3Pointer {
+	p := *psp
+	p.S3BucketName = location.S3BucketName
+	p.S3Key = location.S3Key
+	p.Region = location.Region
+	p.VersionId = location.VersionId
+	p.ETag = location.ETag
+	p.Replicas = nil
+	return &p
 }
 
+// PointerSchemaVersion is the SchemaVersion of the pointers created by this package. Pointers without a SchemaVersion
+// are version 1 and only hold the bucket name and key.
+const PointerSchemaVersion = 2
+
 //func NewPayloadS3Pointer(s3BucketName string, s3Key string) *PayloadS3Pointer {
 //	return &PayloadS3Pointer{
 //		S3BucketName: s3BucketName,
@@ -36,5 +99,10 @@ func FromJson(s3PointerJson string) (*PayloadS3Pointer, error) {
 		log.Println(err)
 		return nil, errors.New("Failed to read the S3Client object pointer from given string")
 	}
+	if p.S3BucketName == "" || p.S3Key == "" {
+		err := errors.New("The S3Client object pointer does not contain a bucket name and key")
+		log.Println(err)
+		return nil, err
+	}
 	return &p, nil
 }
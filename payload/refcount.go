@@ -0,0 +1,164 @@
+package payload
+
+import (
+	"errors"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"log"
+	"strconv"
+	"time"
+)
+
+// DefaultReferenceExpiry is the maximum SQS message retention period, after which no consumer can still hold a pointer.
+const DefaultReferenceExpiry = 14 * 24 * time.Hour
+
+// AcknowledgementKeyInfix separates the key of a shared payload from the ids of the consumers that have released it
+// in the keys of their acknowledgements.
+const AcknowledgementKeyInfix = ".acks/"
+
+// Names of the object metadata of shared payloads. They hold the number of expected consumers and the
+// ReferencesExpireAt time of the pointer, so the payload can be told apart from an orphan without the pointer.
+const (
+	ExpectedConsumersMetadataKey  = "expected-consumers"
+	ReferencesExpireAtMetadataKey = "references-expire-at"
+)
+
+// acknowledgementPrefix returns the prefix of the objects recording which consumers have released a shared payload.
+func acknowledgementPrefix(s3Key string) string {
+	return s3Key + AcknowledgementKeyInfix
+}
+
+// StoreOriginalPayloadForConsumers stores a payload that will be delivered to the given number of consumers, for example
+// when an SNS topic fans the pointer out to several SQS queues. The expected number of consumers is recorded in the
+// pointer and DeleteOriginalPayload only deletes the payload once every consumer has released it, or once the
+// ReferenceExpiry has passed.
+//
+// Consumers that never release the payload would leave it behind, so the payload and the acknowledgements of the
+// consumers are tagged with the s3.ExpiryClass of the ReferenceExpiry, or of the TTL when it is shorter. S3 deletes them
+// when the bucket has the lifecycle rules for the ExpiryTTLs of the store, see s3.InstallExpiryRules.
+func (bps *S3BackedPayloadStore) StoreOriginalPayloadForConsumers(payload string, consumers int) (string, error) {
+	if consumers < 1 {
+		err := errors.New("The number of consumers must be at least 1.")
+		log.Println(err)
+		return "", err
+	}
+	if consumers == 1 {
+		return bps.StoreOriginalPayload(payload)
+	}
+
+	s3Key, err := next(bps.KeyGenerator).GenerateKey()
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	createdAt := now(bps.Clock).UTC()
+	referencesExpireAt := createdAt.Add(bps.referenceExpiry())
+	options := bps.sharedStoreOptions()
+	options.Metadata = map[string]string{
+		ExpectedConsumersMetadataKey:  strconv.Itoa(consumers),
+		ReferencesExpireAtMetadataKey: referencesExpireAt.Format(time.RFC3339Nano),
+	}
+	if bps.TTL > 0 {
+		options.Metadata[ExpiresAtMetadataKey] = createdAt.Add(bps.TTL).Format(time.RFC3339Nano)
+	}
+	result, err := bps.S3Dao.StoreTextInS3WithOptions(bps.S3BucketName, s3Key, payload, options)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+
+	log.Printf("S3Client object created for %d consumers, Bucket name: %s, Object key: %s.", consumers, bps.S3BucketName, s3Key) // info
+
+	s3Pointer := bps.newPointerAt(s3Key, payload, result, createdAt)
+	s3Pointer.ExpectedConsumers = consumers
+	s3Pointer.ReferencesExpireAt = &referencesExpireAt
+	return bps.encodePointer(&s3Pointer)
+}
+
+// ReleaseOriginalPayload records that consumerId no longer needs the payload and deletes it when all expected consumers
+// have released it. Releasing a payload twice with the same consumerId counts once. An empty consumerId stands for the
+// ConsumerId of the store, shared payloads cannot be released without one. For pointers without expected consumers it
+// behaves like DeleteOriginalPayload.
+func (bps *S3BackedPayloadStore) ReleaseOriginalPayload(payloadPointer, consumerId string) error {
+	s3Pointer, err := ParsePointer(payloadPointer)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if s3Pointer.ExpectedConsumers <= 1 {
+		return bps.DeleteOriginalPayload(payloadPointer)
+	}
+	if consumerId == "" {
+		consumerId = bps.ConsumerId
+	}
+	return bps.releaseSharedPayload(s3Pointer, consumerId)
+}
+
+func (bps *S3BackedPayloadStore) releaseSharedPayload(s3Pointer *PayloadS3Pointer, consumerId string) error {
+	s3BucketName := s3Pointer.S3BucketName
+	s3Key := s3Pointer.S3Key
+	if consumerId == "" {
+		// Without a consumer id a redelivered message would count as another consumer
+		err := errors.New("A shared payload cannot be released without a consumer id")
+		log.Println(err)
+		return err
+	}
+	prefix := acknowledgementPrefix(s3Key)
+
+	expired := s3Pointer.ReferencesExpireAt != nil && now(bps.Clock).After(*s3Pointer.ReferencesExpireAt)
+	if !expired {
+		options := s3.StoreOptions{Tags: bps.sharedStoreOptions().Tags}
+		if _, err := bps.S3Dao.StoreTextInS3WithOptions(s3BucketName, prefix+consumerId, "", options); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+
+	acknowledgements, err := bps.S3Dao.ListObjectsInS3(s3BucketName, prefix)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if !expired && len(acknowledgements) < s3Pointer.ExpectedConsumers {
+		log.Printf("S3Client object released by %d of %d consumers, Bucket name: %s, Object key: %s.", len(acknowledgements), s3Pointer.ExpectedConsumers, s3BucketName, s3Key) // info
+		return nil
+	}
+
+	if err := bps.deleteObject(s3Pointer); err != nil {
+		return err
+	}
+	for _, acknowledgement := range acknowledgements {
+		if err := bps.deleteObject(&PayloadS3Pointer{S3BucketName: s3BucketName, S3Key: acknowledgement.Key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bps *S3BackedPayloadStore) referenceExpiry() time.Duration {
+	if bps.ReferenceExpiry <= 0 {
+		return DefaultReferenceExpiry
+	}
+	return bps.ReferenceExpiry
+}
+
+// sharedStoreOptions returns the store options of shared payloads and their acknowledgements, tagged so S3 deletes them
+// when the consumers do not.
+func (bps *S3BackedPayloadStore) sharedStoreOptions() s3.StoreOptions {
+	options := bps.storeOptions()
+	if bps.TTL <= 0 || bps.TTL > bps.referenceExpiry() {
+		options.Tags = map[string]string{s3.ExpiryClassTagKey: s3.ExpiryClass(bps.referenceExpiry())}
+	}
+	return options
+}
+
+// ExpiryTTLs returns the TTLs the objects of the store are tagged with, an expiry lifecycle rule is needed for each of
+// them, see s3.InstallExpiryRules and config.BucketSettings.ExpiryTTLs.
+func (bps *S3BackedPayloadStore) ExpiryTTLs() []time.Duration {
+	if bps.TTL > 0 && bps.TTL <= bps.referenceExpiry() {
+		return []time.Duration{bps.TTL}
+	}
+	if bps.TTL > 0 {
+		return []time.Duration{bps.TTL, bps.referenceExpiry()}
+	}
+	return []time.Duration{bps.referenceExpiry()}
+}
@@ -0,0 +1,126 @@
+package payload_test
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/inmemory"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"testing"
+	"time"
+)
+
+const (
+	s3BucketName = "test-bucket-name"
+	anyS3Key     = "AnyS3key"
+	anyPayload   = "AnyPayload"
+)
+
+func TestSharedPayloadIsDeletedAfterAllConsumersReleaseIt(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+
+	ptrJson, err := payloadStore.StoreOriginalPayloadForConsumers(anyPayload, 3)
+	assert.NoError(t, err)
+	s3Pointer, _ := payload.FromJson(ptrJson)
+	assert.Equal(t, 3, s3Pointer.ExpectedConsumers)
+	assert.NotNil(t, s3Pointer.ReferencesExpireAt)
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, payloadStore.ReleaseOriginalPayload(ptrJson, fmt.Sprintf("consumer-%d", i)))
+		actualPayload, err := payloadStore.GetOriginalPayload(ptrJson)
+		assert.NoError(t, err)
+		assert.Equal(t, anyPayload, actualPayload)
+	}
+	// A redelivery to the same consumer does not count twice
+	assert.NoError(t, payloadStore.ReleaseOriginalPayload(ptrJson, "consumer-1"))
+	_, err = payloadStore.GetOriginalPayload(ptrJson)
+	assert.NoError(t, err)
+
+	assert.NoError(t, payloadStore.ReleaseOriginalPayload(ptrJson, "consumer-2"))
+	_, err = payloadStore.GetOriginalPayload(ptrJson)
+	assert.Error(t, err)
+	assert.Equal(t, 0, dao.Len())
+}
+
+func TestDeleteOriginalPayloadReleasesSharedPayload(t *testing.T) {
+	producer, dao := inmemory.NewPayloadStore(s3BucketName)
+	ptrJson, _ := producer.StoreOriginalPayloadForConsumers(anyPayload, 2)
+
+	first := &payload.S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: dao, ConsumerId: "queue-a"}
+	second := &payload.S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: dao, ConsumerId: "queue-b"}
+
+	assert.NoError(t, first.DeleteOriginalPayload(ptrJson))
+	actualPayload, err := second.GetOriginalPayload(ptrJson)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+
+	assert.NoError(t, second.DeleteOriginalPayload(ptrJson))
+	assert.Equal(t, 0, dao.Len())
+}
+
+func TestExpiredSharedPayloadIsDeletedByAnyConsumer(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	clock := time.Date(2021, 8, 9, 14, 30, 0, 0, time.UTC)
+	payloadStore.Clock = func() time.Time { return clock }
+	payloadStore.ReferenceExpiry = time.Hour
+
+	ptrJson, _ := payloadStore.StoreOriginalPayloadForConsumers(anyPayload, 5)
+	s3Pointer, _ := payload.FromJson(ptrJson)
+	assert.Equal(t, clock.Add(time.Hour), *s3Pointer.ReferencesExpireAt)
+
+	assert.NoError(t, payloadStore.ReleaseOriginalPayload(ptrJson, "consumer-0"))
+	assert.Equal(t, 2, dao.Len())
+
+	clock = clock.Add(time.Hour + time.Second)
+	assert.NoError(t, payloadStore.ReleaseOriginalPayload(ptrJson, "consumer-1"))
+	assert.Equal(t, 0, dao.Len())
+}
+
+func TestSharedPayloadRequiresConsumerId(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	ptrJson, _ := payloadStore.StoreOriginalPayloadForConsumers(anyPayload, 2)
+
+	assert.Error(t, payloadStore.ReleaseOriginalPayload(ptrJson, ""))
+	assert.Error(t, payloadStore.DeleteOriginalPayload(ptrJson))
+	assert.Equal(t, 1, dao.Len())
+
+	payloadStore.ConsumerId = "queue-a"
+	assert.NoError(t, payloadStore.ReleaseOriginalPayload(ptrJson, ""))
+	assert.Equal(t, 2, dao.Len())
+}
+
+func TestSharedPayloadAndAcknowledgementsAreTaggedForExpiry(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	payloadStore.ReferenceExpiry = 3 * 24 * time.Hour
+	ptrJson, _ := payloadStore.StoreOriginalPayloadForConsumers(anyPayload, 2)
+	assert.NoError(t, payloadStore.ReleaseOriginalPayload(ptrJson, "queue-a"))
+
+	s3Pointer, _ := payload.ParsePointer(ptrJson)
+	expiryTags := map[string]string{s3.ExpiryClassTagKey: s3.ExpiryClass(3 * 24 * time.Hour)}
+	for _, s3Key := range []string{s3Pointer.S3Key, s3Pointer.S3Key + ".acks/queue-a"} {
+		options, ok := dao.Options(s3BucketName, s3Key)
+		assert.True(t, ok, s3Key)
+		assert.Equal(t, expiryTags, options.Tags, s3Key)
+	}
+	assert.Equal(t, []time.Duration{3 * 24 * time.Hour}, payloadStore.ExpiryTTLs())
+
+	// A shorter TTL expires the shared payload first
+	payloadStore.TTL = 24 * time.Hour
+	ptrJson, _ = payloadStore.StoreOriginalPayloadForConsumers(anyPayload, 2)
+	s3Pointer, _ = payload.ParsePointer(ptrJson)
+	options, _ := dao.Options(s3BucketName, s3Pointer.S3Key)
+	assert.Equal(t, map[string]string{s3.ExpiryClassTagKey: s3.ExpiryClass(24 * time.Hour)}, options.Tags)
+	assert.Equal(t, []time.Duration{24 * time.Hour}, payloadStore.ExpiryTTLs())
+}
+
+func TestStoreOriginalPayloadForSingleConsumer(t *testing.T) {
+	payloadStore, _ := inmemory.NewPayloadStore(s3BucketName)
+
+	ptrJson, err := payloadStore.StoreOriginalPayloadForConsumers(anyPayload, 1)
+	assert.NoError(t, err)
+	s3Pointer, _ := payload.FromJson(ptrJson)
+	assert.Equal(t, 0, s3Pointer.ExpectedConsumers)
+
+	_, err = payloadStore.StoreOriginalPayloadForConsumers(anyPayload, 0)
+	assert.Error(t, err)
+}
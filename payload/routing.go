@@ -0,0 +1,299 @@
+package payload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/threehook/aws-payload-offloading-go/s3"
+	"log"
+	"sort"
+	"strings"
+)
+
+// RouteRequest describes a payload to a Router.
+type RouteRequest struct {
+	// TenantId is empty when the payload is stored without a tenant
+	TenantId string
+	S3Key    string
+	Size     int
+}
+
+// Router picks the route a payload is stored by.
+type Router interface {
+	// Route returns the name of the route of the payload
+	Route(request RouteRequest) string
+	// RouteNames returns the names of all routes Route may return, so they can be validated
+	RouteNames() []string
+}
+
+// TenantRouter routes the payloads of each tenant in Tenants to its route, and the other payloads to DefaultRoute.
+type TenantRouter struct {
+	Tenants      map[string]string
+	DefaultRoute string
+}
+
+func (tr *TenantRouter) Route(request RouteRequest) string {
+	if route, ok := tr.Tenants[request.TenantId]; ok {
+		return route
+	}
+	return tr.DefaultRoute
+}
+
+func (tr *TenantRouter) RouteNames() []string {
+	names := []string{tr.DefaultRoute}
+	for _, route := range tr.Tenants {
+		names = append(names, route)
+	}
+	return names
+}
+
+// SizeClass routes the payloads of at most MaxSize bytes.
+type SizeClass struct {
+	MaxSize int
+	Route   string
+}
+
+// SizeClassRouter routes a payload by the first of Classes it fits in, and payloads larger than every class to
+// DefaultRoute. Classes should be ordered by increasing MaxSize.
+type SizeClassRouter struct {
+	Classes      []SizeClass
+	DefaultRoute string
+}
+
+func (scr *SizeClassRouter) Route(request RouteRequest) string {
+	for _, class := range scr.Classes {
+		if request.Size <= class.MaxSize {
+			return class.Route
+		}
+	}
+	return scr.DefaultRoute
+}
+
+func (scr *SizeClassRouter) RouteNames() []string {
+	names := []string{scr.DefaultRoute}
+	for _, class := range scr.Classes {
+		names = append(names, class.Route)
+	}
+	return names
+}
+
+// HashRouter spreads payloads over Routes by rendezvous hashing of the tenant id, or of the key for payloads without a
+// tenant. The payloads of a tenant share a route, and adding or removing a route only moves the payloads from or to
+// that route.
+type HashRouter struct {
+	Routes []string
+}
+
+func (hr *HashRouter) Route(request RouteRequest) string {
+	key := request.TenantId
+	if key == "" {
+		key = request.S3Key
+	}
+	var route string
+	var highest uint64
+	for i, name := range hr.Routes {
+		hash := sha256.Sum256([]byte(name + "\x00" + key))
+		if weight := binary.BigEndian.Uint64(hash[:8]); i == 0 || weight > highest {
+			route, highest = name, weight
+		}
+	}
+	return route
+}
+
+func (hr *HashRouter) RouteNames() []string {
+	return hr.Routes
+}
+
+// InvalidRoutesError is returned by RoutingPayloadStore.Validate when the routes cannot be used.
+type InvalidRoutesError struct {
+	Problems []string
+}
+
+func (e *InvalidRoutesError) Error() string {
+	return fmt.Sprintf("The payload routes are invalid, Problems: %s.", strings.Join(e.Problems, "; "))
+}
+
+// RoutingPayloadStore stores each payload by the route its Router picks, in the bucket of the route store and with the
+// encryption and ACL of its S3Dao. Payloads are read and deleted by the route store of the bucket in their pointer,
+// pointers to buckets of no route are rejected. Like the route stores, it does not fail over to the Replicas of a
+// pointer, route to a MirroringPayloadStore for that.
+//
+// The route stores generate no keys, so Deduplicate is not supported.
+type RoutingPayloadStore struct {
+	Router Router
+	// Routes are the stores of the routes by name, several routes may share a bucket and then share its store. The
+	// stores can be built from the storage configurations of the routes by config.RouteConfigs.NewRoutingPayloadStore.
+	Routes map[string]*S3BackedPayloadStore
+	// This field is optional, when not set StoreOriginalPayload uses random UUIDs as keys
+	KeyGenerator KeyGenerator
+}
+
+var _ PayloadStore = (*RoutingPayloadStore)(nil)
+
+// NewRoutingPayloadStore returns a RoutingPayloadStore after validating its routes.
+func NewRoutingPayloadStore(router Router, routes map[string]*S3BackedPayloadStore) (*RoutingPayloadStore, error) {
+	rps := &RoutingPayloadStore{Router: router, Routes: routes}
+	if err := rps.Validate(); err != nil {
+		return nil, err
+	}
+	return rps, nil
+}
+
+// Validate checks that the Router has routes, that every route it may pick has a store with a bucket and S3Dao, and
+// that routes sharing a bucket share its store, which reads and deletes the payloads of the bucket. All problems found
+// are reported in a single *InvalidRoutesError.
+func (rps *RoutingPayloadStore) Validate() error {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	names := make([]string, 0, len(rps.Routes))
+	for name := range rps.Routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		store := rps.Routes[name]
+		switch {
+		case store == nil:
+			report("route %s has no store", name)
+		case store.S3BucketName == "":
+			report("route %s has no bucket", name)
+		case store.S3Dao == nil:
+			report("route %s has no S3Dao", name)
+		case store.Deduplicate:
+			report("route %s deduplicates payloads", name)
+		case store.TTL < 0:
+			report("route %s has a negative TTL", name)
+		}
+	}
+	bucketRoutes := make(map[string]string)
+	for _, name := range names {
+		store := rps.Routes[name]
+		if store == nil || store.S3BucketName == "" {
+			continue
+		}
+		first, ok := bucketRoutes[store.S3BucketName]
+		if !ok {
+			bucketRoutes[store.S3BucketName] = name
+		} else if rps.Routes[first] != store {
+			report("routes %s and %s share bucket %s but not its store", first, name, store.S3BucketName)
+		}
+	}
+
+	if rps.Router == nil {
+		report("there is no router")
+	} else if len(rps.Router.RouteNames()) == 0 {
+		report("the router has no routes")
+	} else {
+		reported := make(map[string]bool)
+		for _, name := range rps.Router.RouteNames() {
+			if _, ok := rps.Routes[name]; !ok && !reported[name] {
+				reported[name] = true
+				report("route %q does not exist", name)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		err := &InvalidRoutesError{Problems: problems}
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+func (rps *RoutingPayloadStore) StoreOriginalPayload(payload string) (string, error) {
+	return rps.StoreOriginalPayloadForTenant("", payload)
+}
+
+// StoreOriginalPayloadForTenant stores payload by the route of the tenant.
+func (rps *RoutingPayloadStore) StoreOriginalPayloadForTenant(tenantId, payload string) (string, error) {
+	s3Key, err := next(rps.KeyGenerator).GenerateKey()
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	return rps.store(RouteRequest{TenantId: tenantId, S3Key: s3Key, Size: len(payload)}, payload)
+}
+
+func (rps *RoutingPayloadStore) StoreOriginalPayloadForS3Key(payload, s3Key string) (string, error) {
+	return rps.store(RouteRequest{S3Key: s3Key, Size: len(payload)}, payload)
+}
+
+func (rps *RoutingPayloadStore) store(request RouteRequest, payload string) (string, error) {
+	if rps.Router == nil {
+		err := errors.New("There is no payload router")
+		log.Println(err)
+		return "", err
+	}
+	name := rps.Router.Route(request)
+	store := rps.Routes[name]
+	if store == nil {
+		err := errors.New("The payload route does not exist")
+		log.Println(err)
+		return "", err
+	}
+	log.Printf("S3Client object routed, Route: %s, Bucket name: %s, Object key: %s.", name, store.S3BucketName, request.S3Key) // info
+	return store.StoreOriginalPayloadForS3Key(payload, request.S3Key)
+}
+
+func (rps *RoutingPayloadStore) GetOriginalPayload(payloadPointer string) (string, error) {
+	return rps.GetOriginalPayloadWithContext(context.Background(), payloadPointer)
+}
+
+// GetOriginalPayloadWithContext is GetOriginalPayload returning early with the error of ctx when it is done before the
+// payload has been read.
+func (rps *RoutingPayloadStore) GetOriginalPayloadWithContext(ctx context.Context, payloadPointer string) (string, error) {
+	store, err := rps.storeFor(payloadPointer)
+	if err != nil {
+		return "", err
+	}
+	return store.GetOriginalPayloadWithContext(ctx, payloadPointer)
+}
+
+func (rps *RoutingPayloadStore) DeleteOriginalPayload(payloadPointer string) error {
+	store, err := rps.storeFor(payloadPointer)
+	if err != nil {
+		return err
+	}
+	return store.DeleteOriginalPayload(payloadPointer)
+}
+
+func (rps *RoutingPayloadStore) StoreOriginalPayloads(payloads []string) ([]string, error) {
+	return StoreEach(rps, payloads, s3.DefaultBatchConcurrency)
+}
+
+func (rps *RoutingPayloadStore) GetOriginalPayloads(payloadPointers []string) ([]string, error) {
+	return GetEach(rps, payloadPointers, s3.DefaultBatchConcurrency)
+}
+
+func (rps *RoutingPayloadStore) DeleteOriginalPayloads(payloadPointers []string) error {
+	return DeleteEach(rps, payloadPointers, s3.DefaultBatchConcurrency)
+}
+
+// storeFor returns the route store of the bucket of payloadPointer. Routes sharing the bucket share its store, see
+// Validate, otherwise the store of the route with the first name is returned.
+func (rps *RoutingPayloadStore) storeFor(payloadPointer string) (*S3BackedPayloadStore, error) {
+	s3Pointer, err := ParsePointer(payloadPointer)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	var store *S3BackedPayloadStore
+	var storeName string
+	for name, route := range rps.Routes {
+		if route != nil && route.S3BucketName == s3Pointer.S3BucketName && (store == nil || name < storeName) {
+			store, storeName = route, name
+		}
+	}
+	if store == nil {
+		err := errors.New("The S3Client bucket of the pointer is not the bucket of a payload route")
+		log.Println(err)
+		return nil, err
+	}
+	return store, nil
+}
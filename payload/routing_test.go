@@ -0,0 +1,162 @@
+package payload_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/inmemory"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"testing"
+	"time"
+)
+
+func newRoutes(names ...string) (map[string]*payload.S3BackedPayloadStore, *inmemory.S3Dao) {
+	dao := inmemory.NewS3Dao()
+	routes := make(map[string]*payload.S3BackedPayloadStore)
+	for _, name := range names {
+		routes[name] = &payload.S3BackedPayloadStore{S3BucketName: name + "-bucket", S3Dao: dao}
+	}
+	return routes, dao
+}
+
+func bucketOf(t *testing.T, payloadPointer string) string {
+	s3Pointer, err := payload.ParsePointer(payloadPointer)
+	assert.NoError(t, err)
+	return s3Pointer.S3BucketName
+}
+
+func TestRoutingPayloadStoreRoutesByTenant(t *testing.T) {
+	routes, dao := newRoutes("shared", "tenant-a")
+	router := &payload.TenantRouter{Tenants: map[string]string{"a": "tenant-a"}, DefaultRoute: "shared"}
+	store, err := payload.NewRoutingPayloadStore(router, routes)
+	assert.NoError(t, err)
+
+	tenantPointer, err := store.StoreOriginalPayloadForTenant("a", anyPayload)
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant-a-bucket", bucketOf(t, tenantPointer))
+	otherPointer, err := store.StoreOriginalPayloadForTenant("b", anyPayload)
+	assert.NoError(t, err)
+	assert.Equal(t, "shared-bucket", bucketOf(t, otherPointer))
+
+	for _, payloadPointer := range []string{tenantPointer, otherPointer} {
+		actualPayload, err := store.GetOriginalPayload(payloadPointer)
+		assert.NoError(t, err)
+		assert.Equal(t, anyPayload, actualPayload)
+	}
+	assert.NoError(t, store.DeleteOriginalPayloads([]string{tenantPointer, otherPointer}))
+	assert.Equal(t, 0, dao.Len())
+}
+
+func TestRoutingPayloadStoreRoutesBySizeClass(t *testing.T) {
+	routes, _ := newRoutes("small", "large")
+	routes["large"].ContentEncoding = "gzip"
+	router := &payload.SizeClassRouter{Classes: []payload.SizeClass{{MaxSize: 10, Route: "small"}}, DefaultRoute: "large"}
+	store, err := payload.NewRoutingPayloadStore(router, routes)
+	assert.NoError(t, err)
+
+	payloadPointers, err := store.StoreOriginalPayloads([]string{"tiny", "more than ten bytes"})
+	assert.NoError(t, err)
+	assert.Equal(t, "small-bucket", bucketOf(t, payloadPointers[0]))
+	assert.Equal(t, "large-bucket", bucketOf(t, payloadPointers[1]))
+
+	actualPayloads, err := store.GetOriginalPayloads(payloadPointers)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tiny", "more than ten bytes"}, actualPayloads)
+}
+
+func TestHashRouterIsConsistent(t *testing.T) {
+	router := &payload.HashRouter{Routes: []string{"shard-0", "shard-1", "shard-2"}}
+	counts := make(map[string]int)
+	before := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before[key] = router.Route(payload.RouteRequest{S3Key: key})
+		counts[before[key]]++
+	}
+	for _, route := range router.Routes {
+		assert.True(t, counts[route] > 50, route)
+	}
+	assert.Equal(t, router.Route(payload.RouteRequest{TenantId: "a", S3Key: "key-1"}), router.Route(payload.RouteRequest{TenantId: "a", S3Key: "key-2"}))
+
+	// Adding a shard only moves payloads to it
+	router.Routes = append(router.Routes, "shard-3")
+	for key, route := range before {
+		if after := router.Route(payload.RouteRequest{S3Key: key}); after != route {
+			assert.Equal(t, "shard-3", after)
+		}
+	}
+}
+
+func TestRoutingPayloadStoreRejectsPointersToOtherBuckets(t *testing.T) {
+	routes, _ := newRoutes("shared")
+	store, err := payload.NewRoutingPayloadStore(&payload.HashRouter{Routes: []string{"shared"}}, routes)
+	assert.NoError(t, err)
+	otherStore, _ := inmemory.NewPayloadStore("other-bucket")
+	payloadPointer, _ := otherStore.StoreOriginalPayload(anyPayload)
+
+	_, err = store.GetOriginalPayload(payloadPointer)
+	assert.Error(t, err)
+	assert.Error(t, store.DeleteOriginalPayload(payloadPointer))
+}
+
+func TestRoutingPayloadStoreValidate(t *testing.T) {
+	routes, _ := newRoutes("shared", "deduplicated")
+	routes["deduplicated"].Deduplicate = true
+	routes["shared"].TTL = -time.Hour
+	routes["unconfigured"] = &payload.S3BackedPayloadStore{S3BucketName: "unconfigured-bucket"}
+	router := &payload.TenantRouter{Tenants: map[string]string{"a": "tenant-a", "b": "tenant-a"}, DefaultRoute: "shared"}
+
+	_, err := payload.NewRoutingPayloadStore(router, routes)
+
+	var routesError *payload.InvalidRoutesError
+	assert.True(t, errors.As(err, &routesError))
+	assert.Equal(t, []string{
+		"route deduplicated deduplicates payloads",
+		"route shared has a negative TTL",
+		"route unconfigured has no S3Dao",
+		`route "tenant-a" does not exist`,
+	}, routesError.Problems)
+}
+
+func TestRoutingPayloadStoreValidateRejectsRoutersWithoutRoutes(t *testing.T) {
+	routes, _ := newRoutes("shared")
+
+	_, err := payload.NewRoutingPayloadStore(&payload.HashRouter{}, routes)
+
+	var routesError *payload.InvalidRoutesError
+	assert.True(t, errors.As(err, &routesError))
+	assert.Equal(t, []string{"the router has no routes"}, routesError.Problems)
+}
+
+func TestRoutingPayloadStoreValidateRequiresSharedBucketsToShareStores(t *testing.T) {
+	routes, dao := newRoutes("shared")
+	routes["tenant-a"] = &payload.S3BackedPayloadStore{S3BucketName: "shared-bucket", S3Dao: dao}
+	router := &payload.TenantRouter{Tenants: map[string]string{"a": "tenant-a"}, DefaultRoute: "shared"}
+
+	_, err := payload.NewRoutingPayloadStore(router, routes)
+
+	var routesError *payload.InvalidRoutesError
+	assert.True(t, errors.As(err, &routesError))
+	assert.Equal(t, []string{"routes shared and tenant-a share bucket shared-bucket but not its store"}, routesError.Problems)
+
+	routes["tenant-a"] = routes["shared"]
+	_, err = payload.NewRoutingPayloadStore(router, routes)
+	assert.NoError(t, err)
+}
+
+func TestUnvalidatedRoutingPayloadStoreFailsWithoutRouterOrRouteStore(t *testing.T) {
+	routes, _ := newRoutes("shared")
+	payloadPointer, _ := routes["shared"].StoreOriginalPayload(anyPayload)
+	routes["empty"] = nil
+
+	store := &payload.RoutingPayloadStore{Routes: routes}
+	_, err := store.StoreOriginalPayload(anyPayload)
+	assert.Error(t, err)
+	actualPayload, err := store.GetOriginalPayload(payloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+
+	store.Router = &payload.HashRouter{Routes: []string{"empty"}}
+	_, err = store.StoreOriginalPayload(anyPayload)
+	assert.Error(t, err)
+}
@@ -1,9 +1,15 @@
 package payload
 
 import (
-	"github.com/google/uuid"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/threehook/aws-payload-offloading-go/s3"
 	"log"
+	"sync"
+	"time"
 )
 
 type PayloadStore interface {
@@ -21,63 +27,332 @@ type PayloadStore interface {
 	// DeleteOriginalPayload deletes the original payload using the given payloadPointer. The pointer must have been
 	// obtained using StoreOriginalPayload
 	DeleteOriginalPayload(payloadPointer string) error
+
+	// StoreOriginalPayloads stores a batch of payloads and returns their pointers indexed like payloads. When some of
+	// the payloads could not be stored the error is a *BatchError.
+	StoreOriginalPayloads(payloads []string) ([]string, error)
+
+	// GetOriginalPayloads retrieves a batch of payloads indexed like payloadPointers. When some of the payloads could
+	// not be retrieved the error is a *BatchError.
+	GetOriginalPayloads(payloadPointers []string) ([]string, error)
+
+	// DeleteOriginalPayloads deletes a batch of payloads. When some of the payloads could not be deleted the error is
+	// a *BatchError.
+	DeleteOriginalPayloads(payloadPointers []string) error
 }
 
 type S3BackedPayloadStore struct {
 	S3BucketName string
 	S3Dao        s3.S3DaoClientI
+	// This field is optional, when not set StoreOriginalPayload uses random UUIDs as keys
+	KeyGenerator KeyGenerator
+	// Deduplicate makes StoreOriginalPayload derive the key from the SHA-256 hash of the payload and skip the upload
+	// when an object with that key already exists, the object is then copied onto itself so its lifecycle expiry and
+	// TTL restart with the new pointer. Such content addressed objects may be shared by many pointers, so
+	// DeleteOriginalPayload leaves them in place. They are deleted by the lifecycle rule of
+	// s3.ContentAddressedExpiryRule, see config.BucketSettings.ContentAddressedRetention. The JavaPointerCodec cannot
+	// record that a pointer is content addressed, so it cannot be used.
+	Deduplicate bool
+	// ConsumerId identifies this consumer when it releases payloads shared by several consumers. Without it such payloads
+	// cannot be released, as a redelivered message would release the payload again.
+	ConsumerId string
+	// ReferenceExpiry is how long payloads shared by several consumers are retained when not every consumer releases
+	// them. It is optional and defaults to DefaultReferenceExpiry.
+	ReferenceExpiry time.Duration
+	// This field is optional, it is set only when retrieved payloads should be cached
+	Cache *PayloadCache
+	// This field is optional, it is set only when concurrent retrievals of the same object should share one S3 request
+	Coalescer *ReadCoalescer
+	// PointerCodec encodes the pointers returned by the store methods. It is optional and defaults to JsonPointerCodec.
+	// Pointers in any format of DefaultPointerCodecs are accepted on read.
+	PointerCodec PointerCodec
+	// These fields are optional, ContentType and ContentEncoding are set on the stored objects and all three are
+	// recorded in the pointers
+	ContentType     string
+	ContentEncoding string
+	Region          string
+	// Clock is optional and defaults to time.Now, it sets the CreatedAt time of pointers
+	Clock func() time.Time
+	// CreateOnly makes the store methods fail with an *ObjectAlreadyExistsError instead of overwriting an existing
+	// object. Use ReplaceOriginalPayload to deliberately replace a payload.
+	CreateOnly bool
+	// DeleteAllVersions makes DeleteOriginalPayload permanently delete every version of the object on versioned
+	// buckets. Otherwise the version in the pointer is deleted, or a delete marker is added when the pointer has none.
+	DeleteAllVersions bool
+	// TTL is optional, when set the stored objects are tagged with their s3.ExpiryClass and the pointers expire after
+	// TTL. S3 only deletes the objects when the bucket has the matching lifecycle rules, see s3.InstallExpiryRules.
+	TTL time.Duration
+	// HealthCheckReadOnly makes HealthCheck only check that the bucket exists, for stores without write access
+	HealthCheckReadOnly bool
+	// HealthCheckTimeout is optional and defaults to DefaultHealthCheckTimeout
+	HealthCheckTimeout time.Duration
+
+	healthMu    sync.Mutex
+	healthProbe *healthProbe // the health check probe in flight, if any
+}
+
+// ContentAddressedKeyPrefix is the prefix of the keys used by S3BackedPayloadStore when Deduplicate is set.
+const ContentAddressedKeyPrefix = s3.ContentAddressedKeyPrefix
+
+// Validate checks that the store has a bucket and S3Dao, and that its TTL and ReferenceExpiry are not negative. S3
+// lifecycle rules cannot expire objects after a negative TTL, a zero TTL stores payloads without one. It is meant to
+// run at startup.
+func (bps *S3BackedPayloadStore) Validate() error {
+	var err error
+	switch {
+	case bps.S3BucketName == "":
+		err = errors.New("The payload store has no S3Client bucket")
+	case bps.S3Dao == nil:
+		err = errors.New("The payload store has no S3Dao")
+	case bps.TTL < 0:
+		err = fmt.Errorf("The TTL of the payload store cannot be negative, TTL: %s.", bps.TTL)
+	case bps.ReferenceExpiry < 0:
+		err = fmt.Errorf("The reference expiry of the payload store cannot be negative, Reference expiry: %s.", bps.ReferenceExpiry)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+	return err
 }
 
 func (bps *S3BackedPayloadStore) StoreOriginalPayload(payload string) (string, error) {
-	s3Key := uuid.New().String()
+	if bps.Deduplicate {
+		return bps.storeContentAddressedPayload(payload)
+	}
+	s3Key, err := next(bps.KeyGenerator).GenerateKey()
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
 	return bps.StoreOriginalPayloadForS3Key(payload, s3Key)
 }
 
 func (bps *S3BackedPayloadStore) StoreOriginalPayloadForS3Key(payload, s3Key string) (string, error) {
-	if err := bps.S3Dao.StoreTextInS3(bps.S3BucketName, s3Key, payload); err != nil {
-		log.Println(err)
+	return bps.storeObject(payload, s3Key, bps.storeOptions())
+}
+
+func (bps *S3BackedPayloadStore) storeObject(payload, s3Key string, options s3.StoreOptions) (string, error) {
+	result, err := bps.putObject(payload, s3Key, options)
+	if err != nil {
 		return "", err
 	}
 
+	// Convert S3Client pointer (bucket name, key, etc) to string
+	s3Pointer := bps.newPointer(s3Key, payload, result)
+	return bps.encodePointer(&s3Pointer)
+}
+
+func (bps *S3BackedPayloadStore) putObject(payload, s3Key string, options s3.StoreOptions) (s3.StoreResult, error) {
+	result, err := bps.S3Dao.StoreTextInS3WithOptions(bps.S3BucketName, s3Key, payload, options)
+	if err != nil {
+		log.Println(err)
+		return s3.StoreResult{}, err
+	}
+	if bps.Cache != nil {
+		// The key may have been used before
+		bps.Cache.Invalidate(bps.S3BucketName, s3Key)
+	}
+
 	log.Printf("S3Client object created, Bucket name: %s, Object key: %s.", bps.S3BucketName, s3Key) // info
+	return result, nil
+}
 
-	// Convert S3Client pointer (bucket name, key, etc) to JSON string
-	s3Pointer := PayloadS3Pointer{bps.S3BucketName, s3Key}
-	json, _ := s3Pointer.ToJson()
+func (bps *S3BackedPayloadStore) storeContentAddressedPayload(payload string) (string, error) {
+	if _, ok := bps.PointerCodec.(*JavaPointerCodec); ok {
+		err := errors.New("Content addressed payloads cannot be stored with Java pointers")
+		log.Println(err)
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(payload))
+	s3Key := ContentAddressedKeyPrefix + hex.EncodeToString(sum[:])
+
+	exists, err := bps.S3Dao.DoesObjectExistInS3(bps.S3BucketName, s3Key)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	options := bps.storeOptions()
+	var result s3.StoreResult
+	if exists {
+		// Restarts the lifecycle expiry of the object, and its TTL when it has one, so it outlives the new pointer
+		result, err = bps.S3Dao.CopyObjectInS3WithOptions(bps.S3BucketName, s3Key, "", bps.S3BucketName, s3Key, options)
+		if err != nil {
+			// The object may have expired since, it is stored again
+			log.Println(err)
+			exists = false
+		} else {
+			log.Printf("S3Client object already exists and is refreshed, Bucket name: %s, Object key: %s.", bps.S3BucketName, s3Key) // info
+		}
+	}
+	if !exists {
+		result, err = bps.putObject(payload, s3Key, options)
+		if s3.IsObjectAlreadyExists(err) {
+			log.Printf("S3Client object stored concurrently, Bucket name: %s, Object key: %s.", bps.S3BucketName, s3Key) // info
+		} else if err != nil {
+			return "", err
+		}
+	}
 
-	return json, nil
+	s3Pointer := bps.newPointer(s3Key, payload, result)
+	s3Pointer.ContentAddressed = true
+	return bps.encodePointer(&s3Pointer)
 }
 
 func (bps *S3BackedPayloadStore) GetOriginalPayload(payloadPointer string) (string, error) {
-	s3Pointer, err := FromJson(payloadPointer)
+	return bps.GetOriginalPayloadWithContext(context.Background(), payloadPointer)
+}
+
+// GetOriginalPayloadWithContext is GetOriginalPayload returning early with the error of ctx when it is done before the
+// payload has been read. When a Coalescer is set, the read of an object is shared by all concurrent callers and is not
+// cancelled when one of them gives up. The payload is only read from the location of the pointer, the Replicas of the
+// pointer may be in buckets of other regions and are left to the MirroringPayloadStore.
+func (bps *S3BackedPayloadStore) GetOriginalPayloadWithContext(ctx context.Context, payloadPointer string) (string, error) {
+	s3Pointer, err := ParsePointer(payloadPointer)
 	if err != nil {
 		log.Println(err)
 		return "", err
 	}
+	if err := bps.checkExpiry(s3Pointer); err != nil {
+		return "", err
+	}
 	s3BucketName := s3Pointer.S3BucketName
 	s3Key := s3Pointer.S3Key
-	originalPayload, err := bps.S3Dao.GetTextFromS3(s3BucketName, s3Key)
-	if err != nil {
-		log.Println(err)
-		return "", err
+	objectKey := versionedKey(s3Pointer)
+	if bps.Cache != nil {
+		if originalPayload, ok := bps.Cache.Get(s3BucketName, objectKey); ok {
+			return originalPayload, nil
+		}
 	}
 
-	log.Printf("S3Client object read, Bucket name: %s, Object key:  %s.", s3BucketName, s3Key) // info
+	read := func() (string, error) {
+		var generation uint64
+		if bps.Cache != nil {
+			generation = bps.Cache.Generation()
+		}
+		var originalPayload string
+		var err error
+		if s3Pointer.VersionId != "" {
+			originalPayload, err = bps.S3Dao.GetTextFromS3Version(s3BucketName, s3Key, s3Pointer.VersionId)
+		} else {
+			originalPayload, err = bps.S3Dao.GetTextFromS3(s3BucketName, s3Key)
+		}
+		if err != nil {
+			log.Println(err)
+			return "", err
+		}
+
+		log.Printf("S3Client object read, Bucket name: %s, Object key:  %s.", s3BucketName, objectKey) // info
 
-	return originalPayload, nil
+		if bps.Cache != nil {
+			bps.Cache.PutUnlessInvalidated(s3BucketName, objectKey, originalPayload, generation)
+		}
+		return originalPayload, nil
+	}
+	if bps.Coalescer != nil {
+		return bps.Coalescer.Do(ctx, s3BucketName, objectKey, read)
+	}
+	return await(ctx, read)
 }
 
 func (bps *S3BackedPayloadStore) DeleteOriginalPayload(payloadPointer string) error {
-	s3Pointer, err := FromJson(payloadPointer)
+	s3Pointer, err := ParsePointer(payloadPointer)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 	s3BucketName := s3Pointer.S3BucketName
 	s3Key := s3Pointer.S3Key
-	if err := bps.S3Dao.DeletePayloadFromS3(s3BucketName, s3Key); err != nil {
+	if bps.Cache != nil {
+		bps.Cache.Invalidate(s3BucketName, versionedKey(s3Pointer))
+	}
+	if s3Pointer.ExpectedConsumers > 1 {
+		return bps.releaseSharedPayload(s3Pointer, bps.ConsumerId)
+	}
+	if s3Pointer.ContentAddressed {
+		// Other pointers may share this object, leave it to the bucket lifecycle rules
+		log.Printf("S3Client object is content addressed and not deleted, Bucket name: %s, Object key: %s.", s3BucketName, s3Key) // info
+		return nil
+	}
+	return bps.deleteObject(s3Pointer)
+}
+
+// deleteObject deletes the object version s3Pointer refers to, or every version of the object when DeleteAllVersions
+// is set.
+func (bps *S3BackedPayloadStore) deleteObject(s3Pointer *PayloadS3Pointer) error {
+	var err error
+	switch {
+	case bps.DeleteAllVersions:
+		err = bps.S3Dao.DeleteAllVersionsFromS3(s3Pointer.S3BucketName, s3Pointer.S3Key)
+	case s3Pointer.VersionId != "":
+		err = bps.S3Dao.DeletePayloadVersionFromS3(s3Pointer.S3BucketName, s3Pointer.S3Key, s3Pointer.VersionId)
+	default:
+		err = bps.S3Dao.DeletePayloadFromS3(s3Pointer.S3BucketName, s3Pointer.S3Key)
+	}
+	if err != nil {
 		log.Println(err)
 		return err
 	}
 	return nil
 }
+
+// versionedKey identifies the object version s3Pointer refers to in the Cache and the Coalescer. Versions are
+// immutable, so overwriting the key only invalidates the entry of the current version.
+func versionedKey(s3Pointer *PayloadS3Pointer) string {
+	if s3Pointer.VersionId == "" {
+		return s3Pointer.S3Key
+	}
+	return s3Pointer.S3Key + "?versionId=" + s3Pointer.VersionId
+}
+
+func (bps *S3BackedPayloadStore) encodePointer(s3Pointer *PayloadS3Pointer) (string, error) {
+	codec := bps.PointerCodec
+	if codec == nil {
+		codec = &JsonPointerCodec{}
+	}
+	payloadPointer, err := codec.Encode(s3Pointer)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	return payloadPointer, nil
+}
+
+func (bps *S3BackedPayloadStore) storeOptions() s3.StoreOptions {
+	options := s3.StoreOptions{ContentType: bps.ContentType, ContentEncoding: bps.ContentEncoding}
+	if bps.CreateOnly {
+		options.IfNoneMatch = s3.IfNoneMatchAny
+	}
+	if bps.TTL > 0 {
+		options.Tags = map[string]string{s3.ExpiryClassTagKey: s3.ExpiryClass(bps.TTL)}
+	}
+	return options
+}
+
+// newPointer returns the pointer to a payload stored under s3Key in the bucket of the store.
+func (bps *S3BackedPayloadStore) newPointer(s3Key, payload string, result s3.StoreResult) PayloadS3Pointer {
+	return bps.newPointerAt(s3Key, payload, result, now(bps.Clock).UTC())
+}
+
+// newPointerAt is newPointer for a payload stored at createdAt.
+func (bps *S3BackedPayloadStore) newPointerAt(s3Key, payload string, result s3.StoreResult, createdAt time.Time) PayloadS3Pointer {
+	sum := sha256.Sum256([]byte(payload))
+	var expiresAt *time.Time
+	if bps.TTL > 0 {
+		t := createdAt.Add(bps.TTL)
+		expiresAt = &t
+	}
+	return PayloadS3Pointer{
+		S3BucketName:    bps.S3BucketName,
+		S3Key:           s3Key,
+		Size:            int64(len(payload)),
+		ContentType:     bps.ContentType,
+		ContentEncoding: bps.ContentEncoding,
+		VersionId:       result.VersionId,
+		ETag:            result.ETag,
+		Region:          bps.Region,
+		CreatedAt:       &createdAt,
+		SHA256:          hex.EncodeToString(sum[:]),
+		SchemaVersion:   PointerSchemaVersion,
+		ExpiresAt:       expiresAt,
+	}
+}
@@ -1,14 +1,18 @@
 package payload
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/threehook/aws-payload-offloading-go/mocks"
+	"github.com/threehook/aws-payload-offloading-go/s3"
 	"io/ioutil"
 	"log"
 	"os"
 	"testing"
+	"time"
 )
 
 const (
@@ -17,6 +21,24 @@ const (
 	anyPayload   = "AnyPayload"
 )
 
+// anyClock is the Clock of stores whose pointers are compared with storedPayloadPointer
+func anyClock() time.Time {
+	return time.Date(2021, 8, 9, 14, 30, 0, 0, time.UTC)
+}
+
+// storedPayloadPointer returns the pointer to anyPayload stored under s3Key by a store using anyClock
+func storedPayloadPointer(s3Key string) *PayloadS3Pointer {
+	createdAt := anyClock()
+	return &PayloadS3Pointer{
+		S3BucketName:  s3BucketName,
+		S3Key:         s3Key,
+		Size:          int64(len(anyPayload)),
+		CreatedAt:     &createdAt,
+		SHA256:        "83e48a62554d9c19910c15655f463a07fae7e6726d89a4a633bc432877824b2e",
+		SchemaVersion: PointerSchemaVersion,
+	}
+}
+
 func TestMain(m *testing.M) {
 	// Suppress logging in unit tests
 	log.SetOutput(ioutil.Discard)
@@ -28,16 +50,16 @@ func TestStoreOriginalPayloadOnSuccess(t *testing.T) {
 	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
 
 	var capturedArgsMap = make(map[string]interface{})
-	mockS3Dao.EXPECT().StoreTextInS3(s3BucketName, gomock.Any(), anyPayload).Do(
-		func(s3BucketName, s3Key, payloadContentStr string) {
+	mockS3Dao.EXPECT().StoreTextInS3WithOptions(s3BucketName, gomock.Any(), anyPayload, gomock.Any()).Do(
+		func(s3BucketName, s3Key, payloadContentStr string, options s3.StoreOptions) {
 			capturedArgsMap["s3Key"] = s3Key
 		},
 	).Times(1)
 
-	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao}
+	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao, Clock: anyClock}
 	actualPayloadPointer, _ := payloadStore.StoreOriginalPayload(anyPayload)
 
-	expectedPayloadPointer := &PayloadS3Pointer{s3BucketName, capturedArgsMap["s3Key"].(string)}
+	expectedPayloadPointer := storedPayloadPointer(capturedArgsMap["s3Key"].(string))
 
 	ptrJson, _ := expectedPayloadPointer.ToJson()
 	assert.Equal(t, ptrJson, actualPayloadPointer)
@@ -47,12 +69,12 @@ func TestStoreOriginalPayloadWithS3KeyOnSuccess(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
 
-	mockS3Dao.EXPECT().StoreTextInS3(s3BucketName, anyS3Key, anyPayload).Times(1)
+	mockS3Dao.EXPECT().StoreTextInS3WithOptions(s3BucketName, anyS3Key, anyPayload, gomock.Any()).Times(1)
 
-	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao}
+	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao, Clock: anyClock}
 	actualPayloadPointer, _ := payloadStore.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
 
-	expectedPayloadPointer := &PayloadS3Pointer{s3BucketName, anyS3Key}
+	expectedPayloadPointer := storedPayloadPointer(anyS3Key)
 
 	ptrJson, _ := expectedPayloadPointer.ToJson()
 	assert.Equal(t, ptrJson, actualPayloadPointer)
@@ -63,30 +85,30 @@ func TestStoreOriginalPayloadDoesAlwaysCreateNewObjects(t *testing.T) {
 	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
 
 	var capturedArgsMap = make(map[string]interface{})
-	firstCall := mockS3Dao.EXPECT().StoreTextInS3(s3BucketName, gomock.Any(), anyPayload)
-	secondCall := mockS3Dao.EXPECT().StoreTextInS3(s3BucketName, gomock.Any(), anyPayload)
+	firstCall := mockS3Dao.EXPECT().StoreTextInS3WithOptions(s3BucketName, gomock.Any(), anyPayload, gomock.Any())
+	secondCall := mockS3Dao.EXPECT().StoreTextInS3WithOptions(s3BucketName, gomock.Any(), anyPayload, gomock.Any())
 
 	gomock.InOrder(
 		firstCall.Do(
-			func(s3BucketName, s3Key, payloadContentStr string) {
+			func(s3BucketName, s3Key, payloadContentStr string, options s3.StoreOptions) {
 				capturedArgsMap["s3Key_1"] = s3Key
 			},
 		),
 		secondCall.Do(
-			func(s3BucketName, s3Key, payloadContentStr string) {
+			func(s3BucketName, s3Key, payloadContentStr string, options s3.StoreOptions) {
 				capturedArgsMap["s3Key_2"] = s3Key
 			},
 		),
 	)
 
-	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao}
+	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao, Clock: anyClock}
 	//Store any payload
 	anyActualPayloadPointer, _ := payloadStore.StoreOriginalPayload(anyPayload)
 	//Store any other payload and validate that the pointers are different
 	anyOtherActualPayloadPointer, _ := payloadStore.StoreOriginalPayload(anyPayload)
 
-	anyExpectedPayloadPointer := &PayloadS3Pointer{s3BucketName, capturedArgsMap["s3Key_1"].(string)}
-	anyOtherExpectedPayloadPointer := &PayloadS3Pointer{s3BucketName, capturedArgsMap["s3Key_2"].(string)}
+	anyExpectedPayloadPointer := storedPayloadPointer(capturedArgsMap["s3Key_1"].(string))
+	anyOtherExpectedPayloadPointer := storedPayloadPointer(capturedArgsMap["s3Key_2"].(string))
 
 	ptrJson, _ := anyExpectedPayloadPointer.ToJson()
 	assert.Equal(t, ptrJson, anyActualPayloadPointer)
@@ -99,7 +121,7 @@ func TestStoreOriginalPayloadOnS3Failure(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
 
-	mockS3Dao.EXPECT().StoreTextInS3(s3BucketName, gomock.Any(), anyPayload).Return(errors.New("Failed to store the message content in an S3Client object.")).Times(1)
+	mockS3Dao.EXPECT().StoreTextInS3WithOptions(s3BucketName, gomock.Any(), anyPayload, gomock.Any()).Return(s3.StoreResult{}, errors.New("Failed to store the message content in an S3Client object.")).Times(1)
 
 	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao}
 	_, err := payloadStore.StoreOriginalPayload(anyPayload)
@@ -187,3 +209,102 @@ func TestDeleteOriginalPayloadIncorrectPointer(t *testing.T) {
 	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao}
 	payloadStore.DeleteOriginalPayload("IncorrectPointer")
 }
+
+func TestStoreOriginalPayloadDeduplicatesContent(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
+
+	sum := sha256.Sum256([]byte(anyPayload))
+	expectedS3Key := ContentAddressedKeyPrefix + hex.EncodeToString(sum[:])
+	var capturedArgsMap = make(map[string]interface{})
+	gomock.InOrder(
+		mockS3Dao.EXPECT().DoesObjectExistInS3(s3BucketName, gomock.Any()).Return(false, nil).Do(
+			func(s3BucketName, s3Key string) {
+				capturedArgsMap["s3Key"] = s3Key
+			},
+		),
+		mockS3Dao.EXPECT().StoreTextInS3WithOptions(s3BucketName, gomock.Any(), anyPayload, gomock.Any()).Times(1),
+		mockS3Dao.EXPECT().DoesObjectExistInS3(s3BucketName, gomock.Any()).Return(true, nil),
+		mockS3Dao.EXPECT().CopyObjectInS3WithOptions(s3BucketName, expectedS3Key, "", s3BucketName, expectedS3Key, gomock.Any()).Times(1),
+	)
+
+	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao, Deduplicate: true, Clock: anyClock}
+	firstPayloadPointer, err := payloadStore.StoreOriginalPayload(anyPayload)
+	assert.NoError(t, err)
+	secondPayloadPointer, err := payloadStore.StoreOriginalPayload(anyPayload)
+	assert.NoError(t, err)
+
+	assert.Equal(t, firstPayloadPointer, secondPayloadPointer)
+	assert.Equal(t, expectedS3Key, capturedArgsMap["s3Key"])
+	s3Pointer, _ := FromJson(firstPayloadPointer)
+	assert.True(t, s3Pointer.ContentAddressed)
+}
+
+func TestStoreOriginalPayloadRecordsObjectMetadata(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
+
+	storeOptions := s3.StoreOptions{ContentType: "application/json", ContentEncoding: "gzip"}
+	storeResult := s3.StoreResult{ETag: `"etag"`, VersionId: "version"}
+	mockS3Dao.EXPECT().StoreTextInS3WithOptions(s3BucketName, anyS3Key, anyPayload, storeOptions).Return(storeResult, nil).Times(1)
+
+	payloadStore := S3BackedPayloadStore{
+		S3BucketName:    s3BucketName,
+		S3Dao:           mockS3Dao,
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		Region:          "eu-west-1",
+		Clock:           anyClock,
+	}
+	actualPayloadPointer, err := payloadStore.StoreOriginalPayloadForS3Key(anyPayload, anyS3Key)
+	assert.NoError(t, err)
+
+	expectedPayloadPointer := storedPayloadPointer(anyS3Key)
+	expectedPayloadPointer.ContentType = "application/json"
+	expectedPayloadPointer.ContentEncoding = "gzip"
+	expectedPayloadPointer.ETag = `"etag"`
+	expectedPayloadPointer.VersionId = "version"
+	expectedPayloadPointer.Region = "eu-west-1"
+	s3Pointer, err := FromJson(actualPayloadPointer)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedPayloadPointer, s3Pointer)
+}
+
+func TestFromJsonReadsPointersWithoutMetadata(t *testing.T) {
+	s3Pointer, err := FromJson(`{"s3BucketName":"test-bucket-name","s3Key":"AnyS3key"}`)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &PayloadS3Pointer{S3BucketName: s3BucketName, S3Key: anyS3Key}, s3Pointer)
+}
+
+func TestStoreOriginalPayloadDeduplicateOnS3Failure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
+
+	mockS3Dao.EXPECT().DoesObjectExistInS3(s3BucketName, gomock.Any()).Return(false, errors.New("S3Client Exception")).Times(1)
+	mockS3Dao.EXPECT().StoreTextInS3WithOptions(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao, Deduplicate: true}
+	_, err := payloadStore.StoreOriginalPayload(anyPayload)
+
+	assert.Equal(t, errors.New("S3Client Exception"), err)
+}
+
+func TestDeleteOriginalPayloadLeavesContentAddressedObjects(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Dao := mocks.NewMockS3DaoClientI(mockCtrl)
+
+	mockS3Dao.EXPECT().DeletePayloadFromS3(s3BucketName, ContentAddressedKeyPrefix+"chosen").Times(1)
+
+	anyPointer := PayloadS3Pointer{S3BucketName: s3BucketName, S3Key: ContentAddressedKeyPrefix + "abc", ContentAddressed: true}
+	payloadStore := S3BackedPayloadStore{S3BucketName: s3BucketName, S3Dao: mockS3Dao}
+	ptrJson, _ := anyPointer.ToJson()
+	err := payloadStore.DeleteOriginalPayload(ptrJson)
+	assert.NoError(t, err)
+
+	// A key chosen by the caller is deleted whatever its prefix
+	chosenPointer := PayloadS3Pointer{S3BucketName: s3BucketName, S3Key: ContentAddressedKeyPrefix + "chosen"}
+	ptrJson, _ = chosenPointer.ToJson()
+	err = payloadStore.DeleteOriginalPayload(ptrJson)
+	assert.NoError(t, err)
+}
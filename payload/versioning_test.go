@@ -0,0 +1,63 @@
+package payload_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/inmemory"
+	"github.com/threehook/aws-payload-offloading-go/payload"
+	"testing"
+)
+
+func TestVersionedPointersSurviveOverwrites(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	dao.EnableVersioning(s3BucketName)
+	payloadStore.Cache = payload.NewPayloadCache(1024, 0)
+
+	firstPtr, err := payloadStore.StoreOriginalPayloadForS3Key("first", anyS3Key)
+	assert.NoError(t, err)
+	secondPtr, err := payloadStore.StoreOriginalPayloadForS3Key("second", anyS3Key)
+	assert.NoError(t, err)
+
+	s3Pointer, err := payload.FromJson(firstPtr)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, s3Pointer.VersionId)
+
+	for _, expected := range []struct{ ptr, payload string }{{firstPtr, "first"}, {secondPtr, "second"}, {firstPtr, "first"}} {
+		actualPayload, err := payloadStore.GetOriginalPayload(expected.ptr)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.payload, actualPayload)
+	}
+	assert.Equal(t, 2, dao.Calls(inmemory.GetTextFromS3Version))
+
+	actualPayloads, err := payloadStore.GetOriginalPayloads([]string{firstPtr, secondPtr})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first", "second"}, actualPayloads)
+}
+
+func TestDeleteOriginalPayloadDeletesPointerVersion(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	dao.EnableVersioning(s3BucketName)
+	firstPtr, _ := payloadStore.StoreOriginalPayloadForS3Key("first", anyS3Key)
+	secondPtr, _ := payloadStore.StoreOriginalPayloadForS3Key("second", anyS3Key)
+
+	assert.NoError(t, payloadStore.DeleteOriginalPayload(firstPtr))
+
+	_, err := payloadStore.GetOriginalPayload(firstPtr)
+	assert.Error(t, err)
+	actualPayload, err := payloadStore.GetOriginalPayload(secondPtr)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", actualPayload)
+	assert.Len(t, dao.Versions(s3BucketName, anyS3Key), 1)
+}
+
+func TestDeleteOriginalPayloadDeletesAllVersions(t *testing.T) {
+	payloadStore, dao := inmemory.NewPayloadStore(s3BucketName)
+	dao.EnableVersioning(s3BucketName)
+	payloadStore.DeleteAllVersions = true
+	payloadStore.StoreOriginalPayloadForS3Key("first", anyS3Key)
+	secondPtr, _ := payloadStore.StoreOriginalPayloadForS3Key("second", anyS3Key)
+
+	assert.NoError(t, payloadStore.DeleteOriginalPayloads([]string{secondPtr}))
+
+	assert.Empty(t, dao.Versions(s3BucketName, anyS3Key))
+	assert.Equal(t, 0, dao.Len())
+}
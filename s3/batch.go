@@ -0,0 +1,49 @@
+package s3
+
+import (
+	"fmt"
+)
+
+// DefaultBatchConcurrency is the number of concurrent requests used by batch operations when none is configured.
+const DefaultBatchConcurrency = 10
+
+// maxDeleteObjectsKeys is the maximum number of keys S3 accepts in a single DeleteObjects request.
+const maxDeleteObjectsKeys = 1000
+
+// BatchError is returned by batch operations when some of the items failed. Errors is indexed like the items of the
+// batch and holds nil for the items that succeeded.
+type BatchError struct {
+	Errors []error
+}
+
+// NewBatchError returns a BatchError for errs, or nil when none of the items failed.
+func NewBatchError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return &BatchError{Errors: errs}
+		}
+	}
+	return nil
+}
+
+func (e *BatchError) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e.Errors {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d of %d batch items failed, first error: %v", failed, len(e.Errors), first)
+}
+
+// Err returns the error of the item at index i, or nil when it succeeded.
+func (e *BatchError) Err(i int) error {
+	if e == nil || i >= len(e.Errors) {
+		return nil
+	}
+	return e.Errors[i]
+}
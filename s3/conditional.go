@@ -0,0 +1,80 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"net/http"
+)
+
+// IfNoneMatchAny is the StoreOptions.IfNoneMatch value that only stores an object when its key does not exist yet.
+const IfNoneMatchAny = "*"
+
+// ObjectAlreadyExistsError is returned when an object is stored with IfNoneMatch and its key already exists.
+type ObjectAlreadyExistsError struct {
+	S3BucketName string
+	S3Key        string
+}
+
+func (e *ObjectAlreadyExistsError) Error() string {
+	return fmt.Sprintf("The S3Client object already exists, Bucket name: %s, Object key: %s.", e.S3BucketName, e.S3Key)
+}
+
+// ObjectModifiedError is returned when an object is stored with IfMatch and the object has been modified or deleted
+// since the ETag was obtained.
+type ObjectModifiedError struct {
+	S3BucketName string
+	S3Key        string
+	ETag         string
+}
+
+func (e *ObjectModifiedError) Error() string {
+	return fmt.Sprintf("The S3Client object does not match ETag %s, Bucket name: %s, Object key: %s.", e.ETag, e.S3BucketName, e.S3Key)
+}
+
+// IsObjectAlreadyExists reports whether err is or wraps an *ObjectAlreadyExistsError.
+func IsObjectAlreadyExists(err error) bool {
+	var existsError *ObjectAlreadyExistsError
+	return errors.As(err, &existsError)
+}
+
+// IsObjectModified reports whether err is or wraps an *ObjectModifiedError.
+func IsObjectModified(err error) bool {
+	var modifiedError *ObjectModifiedError
+	return errors.As(err, &modifiedError)
+}
+
+// conditionalHeaders returns the option functions adding the conditional headers of options to a PutObject request.
+// The SDK version in use has no fields for them.
+func conditionalHeaders(options StoreOptions) []func(*s3.Options) {
+	var optFns []func(*s3.Options)
+	if options.IfNoneMatch != "" {
+		optFns = append(optFns, withHeader("If-None-Match", options.IfNoneMatch))
+	}
+	if options.IfMatch != "" {
+		optFns = append(optFns, withHeader("If-Match", options.IfMatch))
+	}
+	return optFns
+}
+
+func withHeader(name, value string) func(*s3.Options) {
+	return func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, smithyhttp.SetHeaderValue(name, value))
+	}
+}
+
+// conditionalStoreError maps the failure of a conditional PutObject to its typed error, or returns nil when err is not
+// caused by a failed condition.
+func conditionalStoreError(err error, s3BucketName, s3Key string, options StoreOptions) error {
+	status := httpStatusCode(err)
+	// S3 answers 409 ConditionalRequestConflict when a concurrent conditional write of the same key is in progress
+	failed := status == http.StatusPreconditionFailed || status == http.StatusConflict
+	switch {
+	case options.IfNoneMatch != "" && failed:
+		return &ObjectAlreadyExistsError{S3BucketName: s3BucketName, S3Key: s3Key}
+	case options.IfMatch != "" && (failed || status == http.StatusNotFound):
+		return &ObjectModifiedError{S3BucketName: s3BucketName, S3Key: s3Key, ETag: options.IfMatch}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"log"
+	"strings"
+	"time"
+)
+
+// ExpiryClassTagKey is the object tag holding the expiry class of payloads stored with a TTL.
+const ExpiryClassTagKey = "payload-expiry-class"
+
+// expiryRuleIdPrefix starts the ids of the lifecycle rules installed by InstallExpiryRules.
+const expiryRuleIdPrefix = "payload-expiry-"
+
+// ExpiryDays returns the number of days after which S3 expires objects stored with the given positive TTL. S3
+// lifecycle rules count in whole days, so the TTL is rounded up.
+func ExpiryDays(ttl time.Duration) int {
+	return int((ttl + 24*time.Hour - 1) / (24 * time.Hour))
+}
+
+// ExpiryClass returns the value of the ExpiryClassTagKey tag of objects stored with the given TTL, for example "7d".
+func ExpiryClass(ttl time.Duration) string {
+	return fmt.Sprintf("%dd", ExpiryDays(ttl))
+}
+
+// ExpiryRule returns the lifecycle rule expiring the objects tagged with the expiry class of ttl, which must be
+// positive. On versioned buckets the expired objects and the payloads deleted by the store become noncurrent versions,
+// the rule deletes these after the same number of days.
+func ExpiryRule(ttl time.Duration) (types.LifecycleRule, error) {
+	if ttl <= 0 {
+		err := fmt.Errorf("The TTL of an expiry rule must be positive, TTL: %s.", ttl)
+		log.Println(err)
+		return types.LifecycleRule{}, err
+	}
+	class := ExpiryClass(ttl)
+	days := int32(ExpiryDays(ttl))
+	return types.LifecycleRule{
+		ID:                          aws.String(expiryRuleIdPrefix + class),
+		Status:                      types.ExpirationStatusEnabled,
+		Filter:                      &types.LifecycleRuleFilterMemberTag{Value: types.Tag{Key: aws.String(ExpiryClassTagKey), Value: aws.String(class)}},
+		Expiration:                  &types.LifecycleExpiration{Days: days},
+		NoncurrentVersionExpiration: &types.NoncurrentVersionExpiration{NoncurrentDays: days},
+	}, nil
+}
+
+// ExpiredDeleteMarkerRule returns the lifecycle rule removing the delete markers left behind on versioned buckets once
+// the noncurrent versions they hide have expired. S3 does not allow it in the tag filtered rules of ExpiryRule, delete
+// markers have no tags.
+func ExpiredDeleteMarkerRule() types.LifecycleRule {
+	return types.LifecycleRule{
+		ID:         aws.String(expiryRuleIdPrefix + "delete-markers"),
+		Status:     types.ExpirationStatusEnabled,
+		Filter:     &types.LifecycleRuleFilterMemberPrefix{Value: ""},
+		Expiration: &types.LifecycleExpiration{ExpiredObjectDeleteMarker: true},
+	}
+}
+
+// ContentAddressedKeyPrefix is the prefix of the keys of the payloads stored by deduplicating payload stores, which
+// derive the key from the content of the payload.
+const ContentAddressedKeyPrefix = "sha256/"
+
+// ContentAddressedExpiryRule returns the lifecycle rule expiring the objects under ContentAddressedKeyPrefix retention
+// after they were last stored, and their noncurrent versions retention after they were replaced.
+func ContentAddressedExpiryRule(retention time.Duration) (types.LifecycleRule, error) {
+	if retention <= 0 {
+		err := fmt.Errorf("The retention of content addressed payloads must be positive, Retention: %s.", retention)
+		log.Println(err)
+		return types.LifecycleRule{}, err
+	}
+	days := int32(ExpiryDays(retention))
+	return types.LifecycleRule{
+		ID:                          aws.String(fmt.Sprintf("%scontent-addressed-%dd", expiryRuleIdPrefix, days)),
+		Status:                      types.ExpirationStatusEnabled,
+		Filter:                      &types.LifecycleRuleFilterMemberPrefix{Value: ContentAddressedKeyPrefix},
+		Expiration:                  &types.LifecycleExpiration{Days: days},
+		NoncurrentVersionExpiration: &types.NoncurrentVersionExpiration{NoncurrentDays: days},
+	}, nil
+}
+
+// InstallExpiryRules adds a lifecycle rule per TTL to the bucket, so S3 deletes the payloads stored with these TTLs.
+// Other rules of the bucket are kept, expiry rules installed before are replaced. The lifecycle configuration is deleted
+// when no rules remain, S3 rejects a configuration without rules. The TTLs must be positive.
+func InstallExpiryRules(ctx context.Context, client S3SvcClientI, s3BucketName string, ttls ...time.Duration) error {
+	expiryRules := make([]types.LifecycleRule, len(ttls))
+	for i, ttl := range ttls {
+		rule, err := ExpiryRule(ttl)
+		if err != nil {
+			return err
+		}
+		expiryRules[i] = rule
+	}
+	return InstallLifecycleRules(ctx, client, s3BucketName, expiryRules...)
+}
+
+// InstallLifecycleRules is InstallExpiryRules for expiry rules built by ExpiryRule or ContentAddressedExpiryRule. The
+// ExpiredDeleteMarkerRule is installed along with them.
+func InstallLifecycleRules(ctx context.Context, client S3SvcClientI, s3BucketName string, expiryRules ...types.LifecycleRule) error {
+	rules := make([]types.LifecycleRule, 0)
+	configured := false
+	existing, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: &s3BucketName})
+	switch {
+	case err == nil:
+		configured = len(existing.Rules) > 0
+		for _, rule := range existing.Rules {
+			if !strings.HasPrefix(aws.ToString(rule.ID), expiryRuleIdPrefix) {
+				rules = append(rules, rule)
+			}
+		}
+	case !IsNotFound(err):
+		// A bucket without lifecycle configuration answers 404 NoSuchLifecycleConfiguration
+		log.Println(err)
+		return errors.New("Failed to get the lifecycle configuration of the S3Client bucket")
+	}
+
+	if len(expiryRules) > 0 {
+		expiryRules = append(expiryRules, ExpiredDeleteMarkerRule())
+	}
+	installed := make(map[string]bool)
+	for _, rule := range expiryRules {
+		if !installed[*rule.ID] {
+			installed[*rule.ID] = true
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		if !configured {
+			return nil
+		}
+		if _, err := client.DeleteBucketLifecycle(ctx, &s3.DeleteBucketLifecycleInput{Bucket: &s3BucketName}); err != nil {
+			log.Println(err)
+			return errors.New("Failed to delete the lifecycle configuration of the S3Client bucket")
+		}
+		log.Printf("S3Client bucket expiry rules removed, Bucket name: %s.", s3BucketName) // info
+		return nil
+	}
+	_, err = client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 &s3BucketName,
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{Rules: rules},
+	})
+	if err != nil {
+		log.Println(err)
+		return errors.New("Failed to put the lifecycle configuration of the S3Client bucket")
+	}
+	log.Printf("S3Client bucket expiry rules installed, Bucket name: %s, Number of rules: %d.", s3BucketName, len(installed)) // info
+
+	return nil
+}
@@ -4,17 +4,96 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/threehook/aws-payload-offloading-go/encryption"
+	"github.com/threehook/aws-payload-offloading-go/util"
 	"log"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
 type S3DaoClientI interface {
 	GetTextFromS3(s3BucketName, s3Key string) (string, error)
 	StoreTextInS3(s3BucketName, s3Key, payloadContentStr string) error
+	// StoreTextInS3WithOptions is StoreTextInS3 returning the ETag and VersionId of the stored object
+	StoreTextInS3WithOptions(s3BucketName, s3Key, payloadContentStr string, options StoreOptions) (StoreResult, error)
+	// CopyObjectInS3 copies the given version, or the current version when versionId is empty, of an object to another
+	// bucket and key. The copy keeps the metadata and tags of the source object and is encrypted with the
+	// ServerSideEncryptionStrategy of the dao, or like the source object when there is none.
+	CopyObjectInS3(sourceBucketName, sourceKey, versionId, s3BucketName, s3Key string) (StoreResult, error)
+	// CopyObjectInS3WithOptions is CopyObjectInS3 replacing the content type, content encoding, metadata and tags of the
+	// copy with those of options, the store conditions are ignored. An object may be copied onto itself, which restarts
+	// the lifecycle expiry of the object.
+	CopyObjectInS3WithOptions(sourceBucketName, sourceKey, versionId, s3BucketName, s3Key string, options StoreOptions) (StoreResult, error)
 	DeletePayloadFromS3(s3BucketName, s3Key string) error
+	// GetTextFromS3Version and DeletePayloadVersionFromS3 act on the given version of the object, or on the current
+	// version when versionId is empty
+	GetTextFromS3Version(s3BucketName, s3Key, versionId string) (string, error)
+	DeletePayloadVersionFromS3(s3BucketName, s3Key, versionId string) error
+	// DeleteAllVersionsFromS3 permanently deletes every version and delete marker of the object
+	DeleteAllVersionsFromS3(s3BucketName, s3Key string) error
+	DoesObjectExistInS3(s3BucketName, s3Key string) (bool, error)
+	DoesBucketExistInS3(s3BucketName string) (bool, error)
+	// GetObjectMetadataFromS3 returns the metadata of the current version of the object, or nil when it does not exist
+	GetObjectMetadataFromS3(s3BucketName, s3Key string) (*ObjectMetadata, error)
+	ListObjectsInS3(s3BucketName, prefix string) ([]ObjectSummary, error)
+	// ListObjectPagesInS3 calls fn with every page of the objects under prefix, in key order, until fn returns false
+	ListObjectPagesInS3(s3BucketName, prefix string, fn func(page []ObjectSummary) bool) error
+	// GetTextsFromS3 returns the payloads indexed like s3Keys, failures are reported per key by a *BatchError
+	GetTextsFromS3(s3BucketName string, s3Keys []string) ([]string, error)
+	// StoreTextsInS3 stores payloadContentStrs under the keys with the same index and returns the results indexed alike,
+	// failures are reported per key by a *BatchError
+	StoreTextsInS3(s3BucketName string, s3Keys, payloadContentStrs []string, options StoreOptions) ([]StoreResult, error)
+	// DeletePayloadsFromS3 deletes the objects with the given keys, failures are reported per key by a *BatchError
+	DeletePayloadsFromS3(s3BucketName string, s3Keys []string) error
+}
+
+// ObjectSummary describes an object returned by ListObjectsInS3
+type ObjectSummary struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// StoreOptions holds the optional attributes of stored objects and the conditions for storing them
+type StoreOptions struct {
+	ContentType     string
+	ContentEncoding string
+	// IfNoneMatch set to IfNoneMatchAny only stores the object when the key does not exist, otherwise the store fails
+	// with an *ObjectAlreadyExistsError
+	IfNoneMatch string
+	// IfMatch only replaces the object when its current ETag matches, otherwise the store fails with an
+	// *ObjectModifiedError
+	IfMatch string
+	// Metadata is stored as user-defined object metadata (x-amz-meta-*)
+	Metadata map[string]string
+	// Tags are stored as object tags, for example to select the object in lifecycle rules
+	Tags map[string]string
+}
+
+// ObjectMetadata describes an object returned by GetObjectMetadataFromS3
+type ObjectMetadata struct {
+	Size            int64
+	ContentType     string
+	ContentEncoding string
+	ETag            string
+	VersionId       string
+	LastModified    time.Time
+	// Metadata holds the user-defined object metadata, keyed by lower case names
+	Metadata map[string]string
+}
+
+// StoreResult describes an object stored by StoreTextInS3WithOptions. VersionId is empty unless the bucket is versioned.
+type StoreResult struct {
+	ETag      string
+	VersionId string
 }
 
 type S3Dao struct {
@@ -22,18 +101,28 @@ type S3Dao struct {
 	S3Client                     S3SvcClientI
 	ServerSideEncryptionStrategy encryption.ServerSideEncryptionStrategy
 	ObjectCannedACL              types.ObjectCannedACL
+	// BatchConcurrency is the number of concurrent requests used by batch gets and stores, it is optional and defaults
+	// to DefaultBatchConcurrency
+	BatchConcurrency int
 }
 
 func (dao *S3Dao) GetTextFromS3(s3BucketName, s3Key string) (string, error) {
+	return dao.GetTextFromS3Version(s3BucketName, s3Key, "")
+}
+
+func (dao *S3Dao) GetTextFromS3Version(s3BucketName, s3Key, versionId string) (string, error) {
 	getObjectInput := &s3.GetObjectInput{
 		Bucket: &s3BucketName,
 		Key:    &s3Key,
 	}
+	if versionId != "" {
+		getObjectInput.VersionId = &versionId
+	}
 
 	ctx := context.Background()
 	object, err := dao.S3Client.GetObject(ctx, getObjectInput)
 	if err != nil {
-		err := errors.New("Failed to get the S3Client object which contains the payload.")
+		err := withCause("Failed to get the S3Client object which contains the payload.", err)
 		log.Println(err)
 		return "", err
 	}
@@ -51,6 +140,11 @@ func (dao *S3Dao) GetTextFromS3(s3BucketName, s3Key string) (string, error) {
 }
 
 func (dao *S3Dao) StoreTextInS3(s3BucketName, s3Key, payloadContentStr string) error {
+	_, err := dao.StoreTextInS3WithOptions(s3BucketName, s3Key, payloadContentStr, StoreOptions{})
+	return err
+}
+
+func (dao *S3Dao) StoreTextInS3WithOptions(s3BucketName, s3Key, payloadContentStr string, options StoreOptions) (StoreResult, error) {
 	payloadReader := strings.NewReader(payloadContentStr)
 	putObjectInput := &s3.PutObjectInput{
 		Bucket: &s3BucketName,
@@ -60,6 +154,19 @@ func (dao *S3Dao) StoreTextInS3(s3BucketName, s3Key, payloadContentStr string) e
 	if dao.ObjectCannedACL != "" {
 		putObjectInput.ACL = dao.ObjectCannedACL
 	}
+	if options.ContentType != "" {
+		putObjectInput.ContentType = &options.ContentType
+	}
+	if options.ContentEncoding != "" {
+		putObjectInput.ContentEncoding = &options.ContentEncoding
+	}
+	if len(options.Metadata) > 0 {
+		putObjectInput.Metadata = options.Metadata
+	}
+	if len(options.Tags) > 0 {
+		tagging := encodeTags(options.Tags)
+		putObjectInput.Tagging = &tagging
+	}
 
 	if dao.ServerSideEncryptionStrategy != nil {
 		dao.ServerSideEncryptionStrategy.Decorate(putObjectInput)
@@ -78,20 +185,110 @@ func (dao *S3Dao) StoreTextInS3(s3BucketName, s3Key, payloadContentStr string) e
 	//	dao.S3Client.PutBucketEncryption(ctx, encryptionInput)
 	//}
 
-	_, err := dao.S3Client.PutObject(ctx, putObjectInput)
+	output, err := dao.S3Client.PutObject(ctx, putObjectInput, conditionalHeaders(options)...)
 	if err != nil {
 		log.Println(err)
-		return errors.New("Failed to store the message content in an S3Client object.")
+		if conditionErr := conditionalStoreError(err, s3BucketName, s3Key, options); conditionErr != nil {
+			return StoreResult{}, conditionErr
+		}
+		return StoreResult{}, errors.New("Failed to store the message content in an S3Client object.")
 	}
 
-	return nil
+	if output == nil {
+		return StoreResult{}, nil
+	}
+	return StoreResult{ETag: aws.ToString(output.ETag), VersionId: aws.ToString(output.VersionId)}, nil
+}
+
+func (dao *S3Dao) CopyObjectInS3(sourceBucketName, sourceKey, versionId, s3BucketName, s3Key string) (StoreResult, error) {
+	return dao.copyObject(sourceBucketName, sourceKey, versionId, s3BucketName, s3Key, nil)
+}
+
+func (dao *S3Dao) CopyObjectInS3WithOptions(sourceBucketName, sourceKey, versionId, s3BucketName, s3Key string, options StoreOptions) (StoreResult, error) {
+	return dao.copyObject(sourceBucketName, sourceKey, versionId, s3BucketName, s3Key, &options)
+}
+
+// copyObject copies an object, replacing its metadata and tags with those of options when they are not nil.
+func (dao *S3Dao) copyObject(sourceBucketName, sourceKey, versionId, s3BucketName, s3Key string, options *StoreOptions) (StoreResult, error) {
+	copySource := url.PathEscape(sourceBucketName) + "/" + strings.ReplaceAll(url.PathEscape(sourceKey), "%2F", "/")
+	if versionId != "" {
+		copySource += "?versionId=" + url.QueryEscape(versionId)
+	}
+	copyObjectInput := &s3.CopyObjectInput{
+		Bucket:     &s3BucketName,
+		Key:        &s3Key,
+		CopySource: &copySource,
+	}
+	if dao.ObjectCannedACL != "" {
+		copyObjectInput.ACL = dao.ObjectCannedACL
+	}
+	if options != nil {
+		copyObjectInput.MetadataDirective = types.MetadataDirectiveReplace
+		copyObjectInput.TaggingDirective = types.TaggingDirectiveReplace
+		if options.ContentType != "" {
+			copyObjectInput.ContentType = &options.ContentType
+		}
+		if options.ContentEncoding != "" {
+			copyObjectInput.ContentEncoding = &options.ContentEncoding
+		}
+		if len(options.Metadata) > 0 {
+			copyObjectInput.Metadata = options.Metadata
+		}
+		if len(options.Tags) > 0 {
+			tagging := encodeTags(options.Tags)
+			copyObjectInput.Tagging = &tagging
+		}
+	}
+
+	ctx := context.Background()
+	// S3 does not copy the encryption of the source object
+	var encryption s3.PutObjectInput
+	if dao.ServerSideEncryptionStrategy != nil {
+		dao.ServerSideEncryptionStrategy.Decorate(&encryption)
+	} else {
+		headObjectInput := &s3.HeadObjectInput{Bucket: &sourceBucketName, Key: &sourceKey}
+		if versionId != "" {
+			headObjectInput.VersionId = &versionId
+		}
+		source, err := dao.S3Client.HeadObject(ctx, headObjectInput)
+		if err != nil {
+			log.Println(err)
+			return StoreResult{}, errors.New("Failed to get the metadata of the S3Client object to copy")
+		}
+		encryption.ServerSideEncryption = source.ServerSideEncryption
+		encryption.SSEKMSKeyId = source.SSEKMSKeyId
+	}
+	copyObjectInput.ServerSideEncryption = encryption.ServerSideEncryption
+	copyObjectInput.SSEKMSKeyId = encryption.SSEKMSKeyId
+
+	output, err := dao.S3Client.CopyObject(ctx, copyObjectInput)
+	if err != nil {
+		log.Println(err)
+		return StoreResult{}, errors.New("Failed to copy the S3Client object.")
+	}
+
+	if output == nil {
+		return StoreResult{}, nil
+	}
+	result := StoreResult{VersionId: aws.ToString(output.VersionId)}
+	if output.CopyObjectResult != nil {
+		result.ETag = aws.ToString(output.CopyObjectResult.ETag)
+	}
+	return result, nil
 }
 
 func (dao *S3Dao) DeletePayloadFromS3(s3BucketName, s3Key string) error {
+	return dao.DeletePayloadVersionFromS3(s3BucketName, s3Key, "")
+}
+
+func (dao *S3Dao) DeletePayloadVersionFromS3(s3BucketName, s3Key, versionId string) error {
 	deleteObjectInput := &s3.DeleteObjectInput{
 		Bucket: &s3BucketName,
 		Key:    &s3Key,
 	}
+	if versionId != "" {
+		deleteObjectInput.VersionId = &versionId
+	}
 	ctx := context.Background()
 	_, err := dao.S3Client.DeleteObject(ctx, deleteObjectInput)
 	if err != nil {
@@ -103,3 +300,293 @@ func (dao *S3Dao) DeletePayloadFromS3(s3BucketName, s3Key string) error {
 
 	return nil
 }
+
+func (dao *S3Dao) DeleteAllVersionsFromS3(s3BucketName, s3Key string) error {
+	listObjectVersionsInput := &s3.ListObjectVersionsInput{
+		Bucket: &s3BucketName,
+		Prefix: &s3Key,
+	}
+	ctx := context.Background()
+	deleted := 0
+	for {
+		output, err := dao.S3Client.ListObjectVersions(ctx, listObjectVersionsInput)
+		if err != nil {
+			log.Println(err)
+			return errors.New("Failed to list the versions of the S3Client object which contains the payload")
+		}
+
+		// The prefix also matches longer keys, only the versions of s3Key itself are deleted
+		objects := make([]types.ObjectIdentifier, 0, len(output.Versions)+len(output.DeleteMarkers))
+		for _, version := range output.Versions {
+			if aws.ToString(version.Key) == s3Key {
+				objects = append(objects, types.ObjectIdentifier{Key: version.Key, VersionId: version.VersionId})
+			}
+		}
+		for _, marker := range output.DeleteMarkers {
+			if aws.ToString(marker.Key) == s3Key {
+				objects = append(objects, types.ObjectIdentifier{Key: marker.Key, VersionId: marker.VersionId})
+			}
+		}
+		if len(objects) > 0 {
+			deleteObjectsInput := &s3.DeleteObjectsInput{
+				Bucket: &s3BucketName,
+				Delete: &types.Delete{Objects: objects, Quiet: true},
+			}
+			deleteOutput, err := dao.S3Client.DeleteObjects(ctx, deleteObjectsInput)
+			if err == nil && len(deleteOutput.Errors) > 0 {
+				err = fmt.Errorf("%s: %s", aws.ToString(deleteOutput.Errors[0].Code), aws.ToString(deleteOutput.Errors[0].Message))
+			}
+			if err != nil {
+				log.Println(err)
+				return errors.New("Failed to delete the versions of the S3Client object which contains the payload")
+			}
+			deleted += len(objects)
+		}
+
+		if !output.IsTruncated {
+			break
+		}
+		listObjectVersionsInput.KeyMarker = output.NextKeyMarker
+		listObjectVersionsInput.VersionIdMarker = output.NextVersionIdMarker
+	}
+	log.Printf("S3Client object versions deleted, Bucket name: %s, Object key: %s, Number of versions: %d.", s3BucketName, s3Key, deleted) // info
+
+	return nil
+}
+
+func (dao *S3Dao) DoesObjectExistInS3(s3BucketName, s3Key string) (bool, error) {
+	headObjectInput := &s3.HeadObjectInput{
+		Bucket: &s3BucketName,
+		Key:    &s3Key,
+	}
+	ctx := context.Background()
+	_, err := dao.S3Client.HeadObject(ctx, headObjectInput)
+	if err != nil {
+		if IsNotFound(err) {
+			return false, nil
+		}
+		log.Println(err)
+		return false, errors.New("Failed to check whether the S3Client object exists")
+	}
+
+	return true, nil
+}
+
+func (dao *S3Dao) DoesBucketExistInS3(s3BucketName string) (bool, error) {
+	headBucketInput := &s3.HeadBucketInput{
+		Bucket: &s3BucketName,
+	}
+	ctx := context.Background()
+	_, err := dao.S3Client.HeadBucket(ctx, headBucketInput)
+	if err != nil {
+		if IsNotFound(err) {
+			return false, nil
+		}
+		log.Println(err)
+		return false, errors.New("Failed to check whether the S3Client bucket exists")
+	}
+
+	return true, nil
+}
+
+func (dao *S3Dao) GetObjectMetadataFromS3(s3BucketName, s3Key string) (*ObjectMetadata, error) {
+	headObjectInput := &s3.HeadObjectInput{
+		Bucket: &s3BucketName,
+		Key:    &s3Key,
+	}
+	ctx := context.Background()
+	output, err := dao.S3Client.HeadObject(ctx, headObjectInput)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		log.Println(err)
+		return nil, errors.New("Failed to get the metadata of the S3Client object")
+	}
+
+	metadata := &ObjectMetadata{
+		Size:            output.ContentLength,
+		ContentType:     aws.ToString(output.ContentType),
+		ContentEncoding: aws.ToString(output.ContentEncoding),
+		ETag:            aws.ToString(output.ETag),
+		VersionId:       aws.ToString(output.VersionId),
+		Metadata:        make(map[string]string, len(output.Metadata)),
+	}
+	if output.LastModified != nil {
+		metadata.LastModified = *output.LastModified
+	}
+	for name, value := range output.Metadata {
+		metadata.Metadata[strings.ToLower(name)] = value
+	}
+	return metadata, nil
+}
+
+func (dao *S3Dao) ListObjectsInS3(s3BucketName, prefix string) ([]ObjectSummary, error) {
+	summaries := make([]ObjectSummary, 0)
+	err := dao.ListObjectPagesInS3(s3BucketName, prefix, func(page []ObjectSummary) bool {
+		summaries = append(summaries, page...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
+
+func (dao *S3Dao) ListObjectPagesInS3(s3BucketName, prefix string, fn func(page []ObjectSummary) bool) error {
+	listObjectsInput := &s3.ListObjectsV2Input{
+		Bucket: &s3BucketName,
+		Prefix: &prefix,
+	}
+	ctx := context.Background()
+	for {
+		output, err := dao.S3Client.ListObjectsV2(ctx, listObjectsInput)
+		if err != nil {
+			log.Println(err)
+			return errors.New("Failed to list the S3Client objects")
+		}
+		page := make([]ObjectSummary, 0, len(output.Contents))
+		for _, object := range output.Contents {
+			summary := ObjectSummary{Key: *object.Key, Size: object.Size}
+			if object.LastModified != nil {
+				summary.LastModified = *object.LastModified
+			}
+			page = append(page, summary)
+		}
+		if !fn(page) || !output.IsTruncated || output.NextContinuationToken == nil {
+			return nil
+		}
+		listObjectsInput.ContinuationToken = output.NextContinuationToken
+	}
+}
+
+func (dao *S3Dao) GetTextsFromS3(s3BucketName string, s3Keys []string) ([]string, error) {
+	payloads := make([]string, len(s3Keys))
+	errs := util.RunConcurrently(len(s3Keys), dao.batchConcurrency(), func(i int) error {
+		var err error
+		payloads[i], err = dao.GetTextFromS3(s3BucketName, s3Keys[i])
+		return err
+	})
+	return payloads, NewBatchError(errs)
+}
+
+func (dao *S3Dao) StoreTextsInS3(s3BucketName string, s3Keys, payloadContentStrs []string, options StoreOptions) ([]StoreResult, error) {
+	if len(s3Keys) != len(payloadContentStrs) {
+		return nil, errors.New("The number of S3Client keys and payloads must be equal.")
+	}
+	results := make([]StoreResult, len(s3Keys))
+	errs := util.RunConcurrently(len(s3Keys), dao.batchConcurrency(), func(i int) error {
+		var err error
+		results[i], err = dao.StoreTextInS3WithOptions(s3BucketName, s3Keys[i], payloadContentStrs[i], options)
+		return err
+	})
+	return results, NewBatchError(errs)
+}
+
+func (dao *S3Dao) DeletePayloadsFromS3(s3BucketName string, s3Keys []string) error {
+	errs := make([]error, len(s3Keys))
+	ctx := context.Background()
+	for start := 0; start < len(s3Keys); start += maxDeleteObjectsKeys {
+		end := start + maxDeleteObjectsKeys
+		if end > len(s3Keys) {
+			end = len(s3Keys)
+		}
+
+		indexes := make(map[string][]int)
+		objects := make([]types.ObjectIdentifier, 0, end-start)
+		for i := start; i < end; i++ {
+			s3Key := s3Keys[i]
+			if _, ok := indexes[s3Key]; !ok {
+				objects = append(objects, types.ObjectIdentifier{Key: &s3Keys[i]})
+			}
+			indexes[s3Key] = append(indexes[s3Key], i)
+		}
+		deleteObjectsInput := &s3.DeleteObjectsInput{
+			Bucket: &s3BucketName,
+			Delete: &types.Delete{Objects: objects, Quiet: true},
+		}
+
+		output, err := dao.S3Client.DeleteObjects(ctx, deleteObjectsInput)
+		if err != nil {
+			log.Println(err)
+			err := errors.New("Failed to delete the S3Client objects which contain the payloads")
+			for i := start; i < end; i++ {
+				errs[i] = err
+			}
+			continue
+		}
+		for _, deleteError := range output.Errors {
+			if deleteError.Key == nil {
+				continue
+			}
+			err := fmt.Errorf("Failed to delete the S3Client object which contains the payload: %s", aws.ToString(deleteError.Message))
+			log.Println(err)
+			for _, i := range indexes[*deleteError.Key] {
+				errs[i] = err
+			}
+		}
+		log.Printf("S3Client objects deleted, Bucket name: %s, Number of objects: %d.", s3BucketName, len(objects)-len(output.Errors)) // info
+	}
+
+	return NewBatchError(errs)
+}
+
+func (dao *S3Dao) batchConcurrency() int {
+	if dao.BatchConcurrency <= 0 {
+		return DefaultBatchConcurrency
+	}
+	return dao.BatchConcurrency
+}
+
+// encodeTags returns the tags in the URL query format of the x-amz-tagging header
+func encodeTags(tags map[string]string) string {
+	values := url.Values{}
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
+
+// IsNotFound reports whether err is an S3 response with HTTP status 404, for example for a missing object, bucket or
+// bucket configuration
+func IsNotFound(err error) bool {
+	return httpStatusCode(err) == 404
+}
+
+// IsUnavailable reports whether err shows that S3 could not serve the request, rather than rejecting it: the request
+// was not sent or got no response, S3 answered with a 5xx status or it throttled the request
+func IsUnavailable(err error) bool {
+	var sendError *smithyhttp.RequestSendError
+	if errors.As(err, &sendError) {
+		return true
+	}
+	status := httpStatusCode(err)
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// causeError keeps the S3 error that caused an error of the dao, so it can be classified
+type causeError struct {
+	message string
+	cause   error
+}
+
+func withCause(message string, cause error) error {
+	return &causeError{message: message, cause: cause}
+}
+
+func (e *causeError) Error() string {
+	return e.message
+}
+
+func (e *causeError) Unwrap() error {
+	return e.cause
+}
+
+// httpStatusCode returns the HTTP status of the S3 response that caused err, or 0 when there was none
+func httpStatusCode(err error) int {
+	var responseError *awshttp.ResponseError
+	if errors.As(err, &responseError) {
+		return responseError.HTTPStatusCode()
+	}
+	return 0
+}
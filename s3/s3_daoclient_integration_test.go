@@ -0,0 +1,452 @@
+package s3_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/threehook/aws-payload-offloading-go/encryption"
+	s3dao "github.com/threehook/aws-payload-offloading-go/s3"
+	"github.com/threehook/aws-payload-offloading-go/s3/s3test"
+	"testing"
+	"time"
+)
+
+func TestS3DaoEndToEnd(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+
+	dao := s3dao.S3Dao{S3Client: server.Client()}
+
+	err := dao.StoreTextInS3(s3BucketName, anyS3Key, anyPayload)
+	assert.NoError(t, err)
+
+	actualPayload, err := dao.GetTextFromS3(s3BucketName, anyS3Key)
+	assert.NoError(t, err)
+	assert.Equal(t, anyPayload, actualPayload)
+
+	err = dao.DeletePayloadFromS3(s3BucketName, anyS3Key)
+	assert.NoError(t, err)
+
+	_, err = dao.GetTextFromS3(s3BucketName, anyS3Key)
+	assert.Error(t, err)
+	assert.Empty(t, server.Keys(s3BucketName))
+}
+
+func TestS3DaoEndToEndWithSSEAndCanned(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	awsTestCustomerKey := "aws_test_customer_key"
+
+	dao := s3dao.S3Dao{
+		S3Client:                     server.Client(),
+		ServerSideEncryptionStrategy: &encryption.CustomerKey{AwsKmsKeyId: awsTestCustomerKey},
+		ObjectCannedACL:              objectCannedACL,
+	}
+	err := dao.StoreTextInS3(s3BucketName, anyS3Key, anyPayload)
+	assert.NoError(t, err)
+
+	object, ok := server.Object(s3BucketName, anyS3Key)
+	assert.True(t, ok)
+	assert.Equal(t, anyPayload, string(object.Body))
+	assert.Equal(t, string(types.ServerSideEncryptionAwsKms), object.Header.Get("X-Amz-Server-Side-Encryption"))
+	assert.Equal(t, awsTestCustomerKey, object.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+	assert.Equal(t, string(objectCannedACL), object.Header.Get("X-Amz-Acl"))
+}
+
+func TestS3DaoEndToEndStoreWithOptions(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+
+	dao := s3dao.S3Dao{S3Client: server.Client()}
+	result, err := dao.StoreTextInS3WithOptions(s3BucketName, anyS3Key, anyPayload, s3dao.StoreOptions{ContentType: "application/json", ContentEncoding: "identity"})
+	assert.NoError(t, err)
+
+	object, ok := server.Object(s3BucketName, anyS3Key)
+	assert.True(t, ok)
+	assert.Equal(t, object.ETag, result.ETag)
+	assert.Equal(t, "application/json", object.Header.Get("Content-Type"))
+	assert.Equal(t, "identity", object.Header.Get("Content-Encoding"))
+}
+
+func TestS3DaoEndToEndVersioning(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	server.EnableVersioning(s3BucketName)
+
+	dao := s3dao.S3Dao{S3Client: server.Client()}
+	first, err := dao.StoreTextInS3WithOptions(s3BucketName, anyS3Key, "first", s3dao.StoreOptions{})
+	assert.NoError(t, err)
+	_, err = dao.StoreTextInS3WithOptions(s3BucketName, anyS3Key, anyPayload, s3dao.StoreOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, dao.StoreTextInS3(s3BucketName, anyS3Key+"-other", anyPayload))
+
+	actualPayload, err := dao.GetTextFromS3Version(s3BucketName, anyS3Key, first.VersionId)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", actualPayload)
+
+	assert.NoError(t, dao.DeletePayloadVersionFromS3(s3BucketName, anyS3Key, first.VersionId))
+	_, err = dao.GetTextFromS3Version(s3BucketName, anyS3Key, first.VersionId)
+	assert.Error(t, err)
+	assert.NoError(t, dao.DeletePayloadFromS3(s3BucketName, anyS3Key))
+	assert.Len(t, server.Versions(s3BucketName, anyS3Key), 2)
+
+	assert.NoError(t, dao.DeleteAllVersionsFromS3(s3BucketName, anyS3Key))
+	assert.Empty(t, server.Versions(s3BucketName, anyS3Key))
+	assert.Equal(t, []string{anyS3Key + "-other"}, server.Keys(s3BucketName))
+}
+
+func TestS3DaoEndToEndConditionalStore(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+
+	dao := s3dao.S3Dao{S3Client: server.Client()}
+	createOnly := s3dao.StoreOptions{IfNoneMatch: s3dao.IfNoneMatchAny}
+	first, err := dao.StoreTextInS3WithOptions(s3BucketName, anyS3Key, "first", createOnly)
+	assert.NoError(t, err)
+	object, _ := server.Object(s3BucketName, anyS3Key)
+	assert.Equal(t, "*", object.Header.Get("If-None-Match"))
+
+	_, err = dao.StoreTextInS3WithOptions(s3BucketName, anyS3Key, "second", createOnly)
+	var existsError *s3dao.ObjectAlreadyExistsError
+	assert.True(t, errors.As(err, &existsError))
+	assert.Equal(t, anyS3Key, existsError.S3Key)
+
+	replaced, err := dao.StoreTextInS3WithOptions(s3BucketName, anyS3Key, "third", s3dao.StoreOptions{IfMatch: first.ETag})
+	assert.NoError(t, err)
+	_, err = dao.StoreTextInS3WithOptions(s3BucketName, anyS3Key, "fourth", s3dao.StoreOptions{IfMatch: first.ETag})
+	assert.True(t, s3dao.IsObjectModified(err))
+	_, err = dao.StoreTextInS3WithOptions(s3BucketName, "missing", "fourth", s3dao.StoreOptions{IfMatch: replaced.ETag})
+	assert.True(t, s3dao.IsObjectModified(err))
+
+	actualPayload, err := dao.GetTextFromS3(s3BucketName, anyS3Key)
+	assert.NoError(t, err)
+	assert.Equal(t, "third", actualPayload)
+}
+
+func TestS3DaoEndToEndObjectMetadata(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+
+	dao := s3dao.S3Dao{S3Client: server.Client()}
+	options := s3dao.StoreOptions{ContentType: "application/json", Metadata: map[string]string{"sha256": "checksum"}}
+	result, err := dao.StoreTextInS3WithOptions(s3BucketName, anyS3Key, anyPayload, options)
+	assert.NoError(t, err)
+
+	metadata, err := dao.GetObjectMetadataFromS3(s3BucketName, anyS3Key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(anyPayload)), metadata.Size)
+	assert.Equal(t, "application/json", metadata.ContentType)
+	assert.Equal(t, result.ETag, metadata.ETag)
+	assert.Equal(t, map[string]string{"sha256": "checksum"}, metadata.Metadata)
+	assert.False(t, metadata.LastModified.IsZero())
+
+	metadata, err = dao.GetObjectMetadataFromS3(s3BucketName, "missing")
+	assert.NoError(t, err)
+	assert.Nil(t, metadata)
+}
+
+func TestS3DaoEndToEndMissingBucket(t *testing.T) {
+	server := s3test.NewServer()
+	defer server.Close()
+
+	dao := s3dao.S3Dao{S3Client: server.Client()}
+
+	assert.Error(t, dao.StoreTextInS3(s3BucketName, anyS3Key, anyPayload))
+	_, err := dao.GetTextFromS3(s3BucketName, anyS3Key)
+	assert.Error(t, err)
+}
+
+func TestS3DaoEndToEndUnavailable(t *testing.T) {
+	server := s3test.NewServer()
+	server.CreateBucket(s3BucketName)
+	dao := s3dao.S3Dao{S3Client: server.Client(func(o *s3.Options) { o.Retryer = aws.NopRetryer{} })}
+
+	_, err := dao.GetTextFromS3(s3BucketName, anyS3Key)
+	assert.True(t, s3dao.IsNotFound(err))
+	assert.False(t, s3dao.IsUnavailable(err))
+
+	server.Close()
+	_, err = dao.GetTextFromS3(s3BucketName, anyS3Key)
+	assert.True(t, s3dao.IsUnavailable(err))
+	assert.False(t, s3dao.IsUnavailable(errors.New("Not an S3 error")))
+}
+
+func TestS3DaoEndToEndDoesObjectExist(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+
+	dao := s3dao.S3Dao{S3Client: server.Client()}
+
+	exists, err := dao.DoesObjectExistInS3(s3BucketName, anyS3Key)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.NoError(t, dao.StoreTextInS3(s3BucketName, anyS3Key, anyPayload))
+	exists, err = dao.DoesObjectExistInS3(s3BucketName, anyS3Key)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestS3DaoEndToEndDoesBucketExist(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+
+	dao := s3dao.S3Dao{S3Client: server.Client()}
+
+	exists, err := dao.DoesBucketExistInS3(s3BucketName)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = dao.DoesBucketExistInS3("missing-bucket")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestS3DaoEndToEndListObjects(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+
+	dao := s3dao.S3Dao{S3Client: server.Client()}
+	assert.NoError(t, dao.StoreTextInS3(s3BucketName, "other", anyPayload))
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, dao.StoreTextInS3(s3BucketName, fmt.Sprintf("prefix/%d", i), anyPayload))
+	}
+
+	summaries, err := dao.ListObjectsInS3(s3BucketName, "prefix/")
+	assert.NoError(t, err)
+	assert.Len(t, summaries, 3)
+	assert.Equal(t, "prefix/0", summaries[0].Key)
+	assert.Equal(t, int64(len(anyPayload)), summaries[0].Size)
+	assert.False(t, summaries[0].LastModified.IsZero())
+
+	var paged []s3dao.ObjectSummary
+	err = dao.ListObjectPagesInS3(s3BucketName, "prefix/", func(page []s3dao.ObjectSummary) bool {
+		paged = append(paged, page...)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, summaries, paged)
+}
+
+func TestS3DaoEndToEndBatch(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+
+	dao := s3dao.S3Dao{S3Client: server.Client(), BatchConcurrency: 3}
+	s3Keys := make([]string, 20)
+	payloads := make([]string, 20)
+	for i := range s3Keys {
+		s3Keys[i] = fmt.Sprintf("batch/%02d", i)
+		payloads[i] = fmt.Sprintf("payload %d", i)
+	}
+
+	results, err := dao.StoreTextsInS3(s3BucketName, s3Keys, payloads, s3dao.StoreOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, results, 20)
+	assert.Equal(t, s3Keys, server.Keys(s3BucketName))
+
+	actualPayloads, err := dao.GetTextsFromS3(s3BucketName, append(s3Keys, "missing"))
+	var batchError *s3dao.BatchError
+	assert.True(t, errors.As(err, &batchError))
+	assert.Error(t, batchError.Err(20))
+	assert.Equal(t, append(payloads, ""), actualPayloads)
+
+	assert.NoError(t, dao.DeletePayloadsFromS3(s3BucketName, s3Keys))
+	assert.Empty(t, server.Keys(s3BucketName))
+}
+
+func TestS3DaoEndToEndStoreWithTags(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+
+	dao := s3dao.S3Dao{S3Client: server.Client()}
+	options := s3dao.StoreOptions{Tags: map[string]string{s3dao.ExpiryClassTagKey: s3dao.ExpiryClass(7 * 24 * time.Hour)}}
+	_, err := dao.StoreTextInS3WithOptions(s3BucketName, anyS3Key, anyPayload, options)
+	assert.NoError(t, err)
+
+	object, ok := server.Object(s3BucketName, anyS3Key)
+	assert.True(t, ok)
+	assert.Equal(t, "payload-expiry-class=7d", object.Header.Get("X-Amz-Tagging"))
+}
+
+func TestInstallExpiryRules(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	otherRule := types.LifecycleRule{
+		ID:                             aws.String("abort-uploads"),
+		Status:                         types.ExpirationStatusEnabled,
+		Filter:                         &types.LifecycleRuleFilterMemberPrefix{Value: ""},
+		AbortIncompleteMultipartUpload: &types.AbortIncompleteMultipartUpload{DaysAfterInitiation: 1},
+	}
+	_, err := client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(s3BucketName),
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{Rules: []types.LifecycleRule{otherRule}},
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, s3dao.InstallExpiryRules(ctx, client, s3BucketName, time.Hour, 24*time.Hour, 30*24*time.Hour))
+	// Installing again replaces the expiry rules
+	assert.NoError(t, s3dao.InstallExpiryRules(ctx, client, s3BucketName, 36*time.Hour, 30*24*time.Hour))
+
+	output, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(s3BucketName)})
+	assert.NoError(t, err)
+	var ids []string
+	for _, rule := range output.Rules {
+		ids = append(ids, aws.ToString(rule.ID))
+	}
+	assert.Equal(t, []string{"abort-uploads", "payload-expiry-2d", "payload-expiry-30d", "payload-expiry-delete-markers"}, ids)
+	assert.Equal(t, int32(2), output.Rules[1].Expiration.Days)
+	filter, ok := output.Rules[1].Filter.(*types.LifecycleRuleFilterMemberTag)
+	if assert.True(t, ok) {
+		assert.Equal(t, s3dao.ExpiryClassTagKey, aws.ToString(filter.Value.Key))
+		assert.Equal(t, "2d", aws.ToString(filter.Value.Value))
+	}
+}
+
+func TestInstallExpiryRulesWithoutLifecycleConfiguration(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+
+	assert.NoError(t, s3dao.InstallExpiryRules(context.Background(), server.Client(), s3BucketName, time.Minute))
+
+	output, err := server.Client().GetBucketLifecycleConfiguration(context.Background(), &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(s3BucketName)})
+	assert.NoError(t, err)
+	assert.Len(t, output.Rules, 2)
+	assert.Equal(t, "payload-expiry-1d", aws.ToString(output.Rules[0].ID))
+}
+
+func TestInstallExpiryRulesOnVersionedBucket(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	server.EnableVersioning(s3BucketName)
+	client := server.Client()
+	ctx := context.Background()
+
+	assert.NoError(t, s3dao.InstallExpiryRules(ctx, client, s3BucketName, 7*24*time.Hour))
+
+	output, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(s3BucketName)})
+	assert.NoError(t, err)
+	if assert.Len(t, output.Rules, 2) {
+		// Expired and deleted payloads become noncurrent versions, which expire after the same number of days
+		assert.Equal(t, int32(7), output.Rules[0].Expiration.Days)
+		assert.Equal(t, &types.NoncurrentVersionExpiration{NoncurrentDays: 7}, output.Rules[0].NoncurrentVersionExpiration)
+		assert.Equal(t, "payload-expiry-delete-markers", aws.ToString(output.Rules[1].ID))
+		assert.Equal(t, &types.LifecycleExpiration{ExpiredObjectDeleteMarker: true}, output.Rules[1].Expiration)
+	}
+
+	// Like S3, the test server rejects delete markers expired by a rule filtered by tags
+	rule, _ := s3dao.ExpiryRule(7 * 24 * time.Hour)
+	rule.Expiration = &types.LifecycleExpiration{ExpiredObjectDeleteMarker: true}
+	_, err = client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(s3BucketName),
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{Rules: []types.LifecycleRule{rule}},
+	})
+	assert.Error(t, err)
+}
+
+func TestExpiryRulesRejectNonPositiveTTLs(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+
+	for _, ttl := range []time.Duration{0, -time.Hour} {
+		_, err := s3dao.ExpiryRule(ttl)
+		assert.Error(t, err)
+		_, err = s3dao.ContentAddressedExpiryRule(ttl)
+		assert.Error(t, err)
+		assert.Error(t, s3dao.InstallExpiryRules(context.Background(), server.Client(), s3BucketName, time.Hour, ttl))
+	}
+	assert.NotContains(t, server.Operations(), "PutBucketLifecycleConfiguration")
+}
+
+func TestInstallNoExpiryRules(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	assert.NoError(t, s3dao.InstallExpiryRules(ctx, client, s3BucketName))
+	assert.NotContains(t, server.Operations(), "PutBucketLifecycleConfiguration")
+
+	// Removing the last expiry rule deletes the configuration
+	assert.NoError(t, s3dao.InstallExpiryRules(ctx, client, s3BucketName, time.Hour))
+	assert.NoError(t, s3dao.InstallExpiryRules(ctx, client, s3BucketName))
+	assert.Contains(t, server.Operations(), "DeleteBucketLifecycle")
+	_, err := client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(s3BucketName)})
+	assert.Error(t, err)
+}
+
+func TestS3DaoEndToEndCopyObject(t *testing.T) {
+	const targetBucketName = "target-bucket-name"
+	const sourceKey = "dir/key with spaces+"
+	server := s3test.NewServer(s3BucketName, targetBucketName)
+	defer server.Close()
+	server.EnableVersioning(s3BucketName)
+
+	source := s3dao.S3Dao{S3Client: server.Client(), ServerSideEncryptionStrategy: &encryption.CustomerKey{AwsKmsKeyId: "source_key"}}
+	first, err := source.StoreTextInS3WithOptions(s3BucketName, sourceKey, "first", s3dao.StoreOptions{
+		ContentType: "application/json",
+		Metadata:    map[string]string{"sha256": "abc"},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, source.StoreTextInS3(s3BucketName, sourceKey, "second"))
+
+	// Without a strategy the copy is encrypted like the source
+	dao := s3dao.S3Dao{S3Client: server.Client()}
+	result, err := dao.CopyObjectInS3(s3BucketName, sourceKey, first.VersionId, targetBucketName, sourceKey)
+	assert.NoError(t, err)
+	assert.Equal(t, first.ETag, result.ETag)
+
+	copied, ok := server.Object(targetBucketName, sourceKey)
+	assert.True(t, ok)
+	assert.Equal(t, "first", string(copied.Body))
+	assert.Equal(t, "application/json", copied.Header.Get("Content-Type"))
+	assert.Equal(t, "abc", copied.Header.Get("X-Amz-Meta-Sha256"))
+	assert.Equal(t, "source_key", copied.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+
+	// With a strategy the copy is encrypted by the strategy
+	dao.ServerSideEncryptionStrategy = &encryption.CustomerKey{AwsKmsKeyId: "target_key"}
+	_, err = dao.CopyObjectInS3(s3BucketName, sourceKey, "", targetBucketName, "copy")
+	assert.NoError(t, err)
+	copied, _ = server.Object(targetBucketName, "copy")
+	assert.Equal(t, "second", string(copied.Body))
+	assert.Equal(t, "target_key", copied.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"))
+
+	_, err = dao.CopyObjectInS3(s3BucketName, "missing", "", targetBucketName, "missing")
+	assert.Error(t, err)
+}
+
+func TestS3DaoEndToEndCopyObjectOntoItself(t *testing.T) {
+	server := s3test.NewServer(s3BucketName)
+	defer server.Close()
+
+	dao := s3dao.S3Dao{S3Client: server.Client()}
+	_, err := dao.StoreTextInS3WithOptions(s3BucketName, anyS3Key, anyPayload, s3dao.StoreOptions{
+		Metadata: map[string]string{"sha256": "abc"},
+		Tags:     map[string]string{s3dao.ExpiryClassTagKey: s3dao.ExpiryClass(24 * time.Hour)},
+	})
+	assert.NoError(t, err)
+	_, err = dao.CopyObjectInS3(s3BucketName, anyS3Key, "", s3BucketName, anyS3Key)
+	assert.Error(t, err)
+
+	options := s3dao.StoreOptions{
+		ContentType: "application/json",
+		Tags:        map[string]string{s3dao.ExpiryClassTagKey: s3dao.ExpiryClass(7 * 24 * time.Hour)},
+	}
+	result, err := dao.CopyObjectInS3WithOptions(s3BucketName, anyS3Key, "", s3BucketName, anyS3Key, options)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, result.ETag)
+
+	object, ok := server.Object(s3BucketName, anyS3Key)
+	assert.True(t, ok)
+	assert.Equal(t, anyPayload, string(object.Body))
+	assert.Equal(t, "application/json", object.Header.Get("Content-Type"))
+	assert.Empty(t, object.Header.Get("X-Amz-Meta-Sha256"))
+	assert.Equal(t, "payload-expiry-class=7d", object.Header.Get("X-Amz-Tagging"))
+}
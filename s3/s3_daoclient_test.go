@@ -1,13 +1,17 @@
-package s3
+package s3_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/threehook/aws-payload-offloading-go/encryption"
 	"github.com/threehook/aws-payload-offloading-go/mocks"
+	s3dao "github.com/threehook/aws-payload-offloading-go/s3"
 	"strings"
 	"testing"
 )
@@ -37,7 +41,7 @@ func TestStoreTextInS3WithoutSSEOrCanned(t *testing.T) {
 		},
 	).Times(1)
 
-	dao := S3Dao{S3Client: mockS3Client}
+	dao := s3dao.S3Dao{S3Client: mockS3Client}
 	err := dao.StoreTextInS3(s3BucketName, anyS3Key, anyPayload)
 	if err != nil {
 		t.Errorf("Expected no error, but got: '%v'", err)
@@ -65,7 +69,7 @@ func TestStoreTextInS3WithSSE(t *testing.T) {
 		},
 	).Times(1)
 
-	dao := S3Dao{S3Client: mockS3Client, ServerSideEncryptionStrategy: &encryption.AwsManagedCmk{}, ObjectCannedACL: ""}
+	dao := s3dao.S3Dao{S3Client: mockS3Client, ServerSideEncryptionStrategy: &encryption.AwsManagedCmk{}, ObjectCannedACL: ""}
 	err := dao.StoreTextInS3(s3BucketName, anyS3Key, anyPayload)
 	if err != nil {
 		t.Errorf("Expected no error, but got: '%v'", err)
@@ -95,7 +99,7 @@ func TestStoreTextInS3WithBoth(t *testing.T) {
 
 	//mockS3Client.EXPECT().PutBucketEncryption(ctx, gomock.Any()).Times(1)
 
-	dao := S3Dao{S3Client: mockS3Client, ServerSideEncryptionStrategy: &encryption.CustomerKey{AwsKmsKeyId: awsTestCustomerKey}, ObjectCannedACL: objectCannedACL}
+	dao := s3dao.S3Dao{S3Client: mockS3Client, ServerSideEncryptionStrategy: &encryption.CustomerKey{AwsKmsKeyId: awsTestCustomerKey}, ObjectCannedACL: objectCannedACL}
 	err := dao.StoreTextInS3(s3BucketName, anyS3Key, anyPayload)
 	if err != nil {
 		t.Errorf("Expected no error, but got: '%v'", err)
@@ -106,3 +110,64 @@ func TestStoreTextInS3WithBoth(t *testing.T) {
 	assert.Equal(t, capturedArgsMap["acl"], objectCannedACL)
 	assert.Equal(t, capturedArgsMap["bucket"], s3BucketName)
 }
+
+func TestDoesObjectExistInS3OnS3Failure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Client := mocks.NewMockS3SvcClientI(mockCtrl)
+
+	mockS3Client.EXPECT().HeadObject(gomock.Any(), gomock.Any()).Return(nil, errors.New("S3Client Exception")).Times(1)
+
+	dao := s3dao.S3Dao{S3Client: mockS3Client}
+	exists, err := dao.DoesObjectExistInS3(s3BucketName, anyS3Key)
+
+	assert.False(t, exists)
+	assert.Error(t, err)
+}
+
+func TestDeletePayloadsFromS3InChunks(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Client := mocks.NewMockS3SvcClientI(mockCtrl)
+
+	s3Keys := make([]string, 2500)
+	for i := range s3Keys {
+		s3Keys[i] = fmt.Sprintf("key-%d", i)
+	}
+
+	var chunkSizes []int
+	mockS3Client.EXPECT().DeleteObjects(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, input *s3.DeleteObjectsInput, optFns ...func(options *s3.Options)) (*s3.DeleteObjectsOutput, error) {
+			chunkSizes = append(chunkSizes, len(input.Delete.Objects))
+			assert.Equal(t, s3BucketName, *input.Bucket)
+			assert.True(t, input.Delete.Quiet)
+			output := &s3.DeleteObjectsOutput{}
+			if len(chunkSizes) == 2 {
+				output.Errors = []types.Error{{Key: aws.String("key-1500"), Message: aws.String("Access Denied")}}
+			}
+			return output, nil
+		},
+	).Times(3)
+
+	dao := s3dao.S3Dao{S3Client: mockS3Client}
+	err := dao.DeletePayloadsFromS3(s3BucketName, s3Keys)
+
+	assert.Equal(t, []int{1000, 1000, 500}, chunkSizes)
+	var batchError *s3dao.BatchError
+	assert.True(t, errors.As(err, &batchError))
+	assert.Error(t, batchError.Err(1500))
+	assert.NoError(t, batchError.Err(1499))
+}
+
+func TestDeletePayloadsFromS3OnS3Failure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockS3Client := mocks.NewMockS3SvcClientI(mockCtrl)
+
+	mockS3Client.EXPECT().DeleteObjects(gomock.Any(), gomock.Any()).Return(nil, errors.New("S3Client Exception")).Times(1)
+
+	dao := s3dao.S3Dao{S3Client: mockS3Client}
+	err := dao.DeletePayloadsFromS3(s3BucketName, []string{anyS3Key, "other"})
+
+	var batchError *s3dao.BatchError
+	assert.True(t, errors.As(err, &batchError))
+	assert.Error(t, batchError.Err(0))
+	assert.Error(t, batchError.Err(1))
+}
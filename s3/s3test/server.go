@@ -0,0 +1,903 @@
+// Package s3test provides an in-process S3-compatible HTTP server for integration tests. Requests are sent by a real
+// aws-sdk-go-v2 s3.Client and their SigV4 signatures are verified, so request signing, headers and SDK serialisation are
+// exercised without any AWS account.
+package s3test
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Region          = "us-east-1"
+	AccessKeyId     = "AKIAS3TESTSERVER"
+	SecretAccessKey = "s3test-secret-access-key"
+)
+
+// Object is an object stored by the Server. Header holds the request headers the object was created with, so tests can
+// verify what the client sent (server side encryption, ACL, metadata, ...).
+type Object struct {
+	Body         []byte
+	ETag         string
+	LastModified time.Time
+	Header       http.Header
+	// VersionId is empty unless versioning is enabled on the bucket
+	VersionId string
+
+	deleteMarker bool
+}
+
+type multipartUpload struct {
+	bucket string
+	key    string
+	header http.Header
+	parts  map[int][]byte
+}
+
+// Server is an S3-compatible HTTP server supporting PutObject, CopyObject, GetObject, DeleteObject, DeleteObjects,
+// HeadObject, ListObjectsV2, ListObjectVersions, HeadBucket, bucket configurations (lifecycle, encryption and public
+// access block) and multipart uploads on path-style URLs. Buckets must be created up front, requests on unknown buckets
+// fail with NoSuchBucket. Versioning can be enabled per bucket with EnableVersioning.
+type Server struct {
+	URL string
+
+	httpServer *httptest.Server
+	mu         sync.Mutex
+	buckets    map[string]map[string]*Object
+	versions   map[string]map[string][]*Object // per versioned bucket and key, oldest first
+	configs    map[string]map[string][]byte    // configuration XML per bucket and sub-resource
+	uploads    map[string]*multipartUpload
+	operations []string
+	nextId     int
+}
+
+// NewServer starts a server with the given buckets. Call Close when done.
+func NewServer(buckets ...string) *Server {
+	s := &Server{
+		buckets:  make(map[string]map[string]*Object),
+		versions: make(map[string]map[string][]*Object),
+		configs:  make(map[string]map[string][]byte),
+		uploads:  make(map[string]*multipartUpload),
+	}
+	for _, bucket := range buckets {
+		s.CreateBucket(bucket)
+	}
+	s.httpServer = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.httpServer.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.httpServer.Close()
+}
+
+// Client returns an s3.Client that signs its requests with static test credentials and sends them to this server.
+func (s *Server) Client(optFns ...func(*s3.Options)) *s3.Client {
+	options := s3.Options{
+		Region: Region,
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: AccessKeyId, SecretAccessKey: SecretAccessKey, Source: "s3test"}, nil
+		}),
+		// Setting the signing region up front keeps the resolver from assigning it on every, possibly concurrent, request
+		EndpointResolver: s3.EndpointResolverFromURL(s.URL, func(e *aws.Endpoint) { e.SigningRegion = Region }),
+		UsePathStyle:     true,
+		HTTPClient:       s.httpServer.Client(),
+		Retryer:          aws.NopRetryer{},
+	}
+	return s3.New(options, optFns...)
+}
+
+func (s *Server) CreateBucket(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket]; !ok {
+		s.buckets[bucket] = make(map[string]*Object)
+	}
+}
+
+// EnableVersioning makes the bucket keep every version of its objects, like an S3 bucket with versioning enabled.
+func (s *Server) EnableVersioning(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.versions[bucket]; !ok {
+		s.versions[bucket] = make(map[string][]*Object)
+	}
+}
+
+// Versions returns the version ids of the given key, oldest first. Delete markers are included.
+func (s *Server) Versions(bucket, key string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versionIds := make([]string, 0)
+	for _, version := range s.versions[bucket][key] {
+		versionIds = append(versionIds, version.VersionId)
+	}
+	return versionIds
+}
+
+// Object returns a copy of the object stored under the given bucket and key.
+func (s *Server) Object(bucket, key string) (*Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	copied := *object
+	copied.Header = object.Header.Clone()
+	return &copied, true
+}
+
+// Keys returns the sorted keys of all objects in the given bucket.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Operations returns the names of the S3 operations received so far, in order.
+func (s *Server) Operations() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.operations...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+AccessKeyId+"/") {
+		writeError(w, r, http.StatusForbidden, "AccessDenied", "The request is not signed with the s3test credentials.")
+		return
+	}
+	if !signatureMatches(r) {
+		writeError(w, r, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+		return
+	}
+	if contentSha256 := r.Header.Get("X-Amz-Content-Sha256"); len(contentSha256) == sha256.Size*2 {
+		sum := sha256.Sum256(body)
+		if hex.EncodeToString(sum[:]) != contentSha256 {
+			writeError(w, r, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.")
+			return
+		}
+	}
+
+	if contentMd5 := r.Header.Get("Content-Md5"); contentMd5 != "" {
+		sum := md5.Sum(body)
+		if base64.StdEncoding.EncodeToString(sum[:]) != contentMd5 {
+			writeError(w, r, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received.")
+			return
+		}
+	}
+
+	bucket, key := splitPath(r.URL.Path)
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.operations = append(s.operations, operationName(r))
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+		return
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		s.listObjectsV2(w, r, bucket, objects, query)
+	case key == "" && r.Method == http.MethodGet && query["versions"] != nil:
+		s.listObjectVersions(w, r, bucket, query)
+	case key == "" && r.Method == http.MethodPost && query["delete"] != nil:
+		s.deleteObjects(w, r, bucket, body)
+	case key == "" && bucketSubresource(query) != "":
+		s.bucketConfiguration(w, r, bucket, bucketSubresource(query), body)
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "":
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "Bucket operations are not supported.")
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		s.createMultipartUpload(w, r, bucket, key)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		s.uploadPart(w, r, query, body)
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		s.completeMultipartUpload(w, r, query, body)
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		s.abortMultipartUpload(w, r, query)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		if !checkWriteConditions(w, r, objects[key]) {
+			return
+		}
+		s.copyObject(w, r, bucket, key)
+	case r.Method == http.MethodPut:
+		if !checkWriteConditions(w, r, objects[key]) {
+			return
+		}
+		object := s.put(bucket, key, newObject(body, r.Header.Clone()))
+		w.Header().Set("ETag", object.ETag)
+		if object.VersionId != "" {
+			w.Header().Set("X-Amz-Version-Id", object.VersionId)
+		}
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := objects[key]
+		if versionId := query.Get("versionId"); versionId != "" {
+			object, ok = s.version(bucket, key, versionId)
+			if !ok {
+				writeError(w, r, http.StatusNotFound, "NoSuchVersion", "The specified version does not exist.")
+				return
+			}
+			if object.deleteMarker {
+				writeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+				return
+			}
+		}
+		if !ok {
+			writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		writeObject(w, r, object)
+	case r.Method == http.MethodDelete:
+		if marker := s.delete(bucket, key, query.Get("versionId")); marker != nil {
+			w.Header().Set("X-Amz-Version-Id", marker.VersionId)
+			if marker.deleteMarker {
+				w.Header().Set("X-Amz-Delete-Marker", "true")
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+	}
+}
+
+// copyObject copies the object named by the X-Amz-Copy-Source header. Like S3 it keeps the metadata of the source
+// unless the metadata directive is REPLACE, takes encryption and ACL from the request only, and rejects copying an
+// object onto itself without replacing its metadata.
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	copySource, err := url.Parse(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid copy source.")
+		return
+	}
+	sourceBucket, sourceKey := splitPath(copySource.Path)
+	source, ok := s.buckets[sourceBucket][sourceKey]
+	if _, exists := s.buckets[sourceBucket]; !exists {
+		writeError(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist.")
+		return
+	}
+	if versionId := copySource.Query().Get("versionId"); versionId != "" {
+		source, ok = s.version(sourceBucket, sourceKey, versionId)
+		if ok && source.deleteMarker {
+			ok = false
+		}
+	}
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if sourceBucket == bucket && sourceKey == key && r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+		writeError(w, r, http.StatusBadRequest, "InvalidRequest", "This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata.")
+		return
+	}
+
+	header := r.Header.Clone()
+	if r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+		header = source.Header.Clone()
+		for name := range header {
+			if strings.HasPrefix(name, "X-Amz-Server-Side-Encryption") || name == "X-Amz-Acl" {
+				header.Del(name)
+			}
+		}
+		for name, values := range r.Header {
+			if strings.HasPrefix(name, "X-Amz-Server-Side-Encryption") || name == "X-Amz-Acl" {
+				header[name] = values
+			}
+		}
+	}
+	header.Del("X-Amz-Copy-Source")
+	object := s.put(bucket, key, newObject(append([]byte(nil), source.Body...), header))
+
+	if source.VersionId != "" {
+		w.Header().Set("X-Amz-Copy-Source-Version-Id", source.VersionId)
+	}
+	if object.VersionId != "" {
+		w.Header().Set("X-Amz-Version-Id", object.VersionId)
+	}
+	writeXML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: object.ETag, LastModified: object.LastModified.Format(time.RFC3339)})
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	s.nextId++
+	uploadId := fmt.Sprintf("upload-%d", s.nextId)
+	s.uploads[uploadId] = &multipartUpload{bucket: bucket, key: key, header: r.Header.Clone(), parts: make(map[int][]byte)}
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: bucket, Key: key, UploadId: uploadId})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, query url.Values, body []byte) {
+	upload, ok := s.uploads[query.Get("uploadId")]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	partNumber, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > 10000 {
+		writeError(w, r, http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000.")
+		return
+	}
+	upload.parts[partNumber] = body
+	w.Header().Set("ETag", etag(body))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, query url.Values, body []byte) {
+	uploadId := query.Get("uploadId")
+	upload, ok := s.uploads[uploadId]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	var request struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil || len(request.Parts) == 0 {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed.")
+		return
+	}
+
+	var content []byte
+	digests := md5.New()
+	for i, part := range request.Parts {
+		data, ok := upload.parts[part.PartNumber]
+		if !ok || part.ETag != etag(data) || (i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber) {
+			writeError(w, r, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+			return
+		}
+		sum := md5.Sum(data)
+		digests.Write(sum[:])
+		content = append(content, data...)
+	}
+	delete(s.uploads, uploadId)
+
+	object := newObject(content, upload.header)
+	object.ETag = fmt.Sprintf("\"%s-%d\"", hex.EncodeToString(digests.Sum(nil)), len(request.Parts))
+	s.put(upload.bucket, upload.key, object)
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{Location: s.URL + "/" + upload.bucket + "/" + upload.key, Bucket: upload.bucket, Key: upload.key, ETag: object.ETag})
+}
+
+func (s *Server) abortMultipartUpload(w http.ResponseWriter, r *http.Request, query url.Values) {
+	uploadId := query.Get("uploadId")
+	if _, ok := s.uploads[uploadId]; !ok {
+		writeError(w, r, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return
+	}
+	delete(s.uploads, uploadId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listObjectsV2(w http.ResponseWriter, r *http.Request, bucket string, objects map[string]*Object, query url.Values) {
+	maxKeys := 1000
+	if value := query.Get("max-keys"); value != "" {
+		var err error
+		if maxKeys, err = strconv.Atoi(value); err != nil || maxKeys < 0 {
+			writeError(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid max-keys.")
+			return
+		}
+	}
+	prefix := query.Get("prefix")
+	// The continuation token is simply the last key of the previous page
+	after := query.Get("continuation-token")
+	if after == "" {
+		after = query.Get("start-after")
+	}
+
+	keys := make([]string, 0)
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type contents struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+		StorageClass string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []contents
+	}{Name: bucket, Prefix: prefix, MaxKeys: maxKeys, ContinuationToken: query.Get("continuation-token")}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		object := objects[key]
+		result.Contents = append(result.Contents, contents{
+			Key:          key,
+			LastModified: object.LastModified.Format(time.RFC3339),
+			ETag:         object.ETag,
+			Size:         len(object.Body),
+			StorageClass: "STANDARD",
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	writeXML(w, http.StatusOK, result)
+}
+
+func (s *Server) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string, body []byte) {
+	if r.Header.Get("Content-Md5") == "" {
+		writeError(w, r, http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: Content-MD5.")
+		return
+	}
+	var request struct {
+		Quiet   bool
+		Objects []struct {
+			Key       string
+			VersionId string
+		} `xml:"Object"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil || len(request.Objects) == 0 || len(request.Objects) > 1000 {
+		writeError(w, r, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed.")
+		return
+	}
+
+	type deleted struct {
+		Key       string
+		VersionId string `xml:",omitempty"`
+	}
+	result := struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Deleted []deleted `xml:"Deleted"`
+	}{}
+	for _, object := range request.Objects {
+		s.delete(bucket, object.Key, object.VersionId)
+		if !request.Quiet {
+			result.Deleted = append(result.Deleted, deleted{Key: object.Key, VersionId: object.VersionId})
+		}
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+// bucketConfigurationErrors holds the error code of every supported bucket sub-resource when it is not configured.
+var bucketConfigurationErrors = map[string]string{
+	"lifecycle":         "NoSuchLifecycleConfiguration",
+	"encryption":        "ServerSideEncryptionConfigurationNotFoundError",
+	"publicAccessBlock": "NoSuchPublicAccessBlockConfiguration",
+}
+
+// bucketSubresource returns the bucket sub-resource addressed by query, or "" when there is none.
+func bucketSubresource(query url.Values) string {
+	for subresource := range bucketConfigurationErrors {
+		if query[subresource] != nil {
+			return subresource
+		}
+	}
+	return ""
+}
+
+// bucketConfiguration stores, returns or deletes a configuration of a bucket. The configuration is kept as sent, it
+// is not applied to the objects of the bucket. Lifecycle rules are checked for the combinations S3 rejects.
+func (s *Server) bucketConfiguration(w http.ResponseWriter, r *http.Request, bucket, subresource string, body []byte) {
+	configs, ok := s.configs[bucket]
+	if !ok {
+		configs = make(map[string][]byte)
+		s.configs[bucket] = configs
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if subresource == "lifecycle" {
+			if code, message := invalidLifecycle(body); code != "" {
+				writeError(w, r, http.StatusBadRequest, code, message)
+				return
+			}
+		}
+		configs[subresource] = body
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		config, ok := configs[subresource]
+		if !ok {
+			writeError(w, r, http.StatusNotFound, bucketConfigurationErrors[subresource], "The "+subresource+" configuration does not exist.")
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(config)
+	case http.MethodDelete:
+		delete(configs, subresource)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, http.StatusNotImplemented, "NotImplemented", "Bucket operations are not supported.")
+	}
+}
+
+// invalidLifecycle returns the error code and message of S3 for a lifecycle configuration with an expired object
+// delete marker expiration next to days or a date, or in a rule filtered by tags. It returns "" when body is valid.
+func invalidLifecycle(body []byte) (string, string) {
+	type tag struct {
+		Key string
+	}
+	var configuration struct {
+		Rules []struct {
+			Filter struct {
+				Tag *tag
+				And *struct {
+					Tags []tag `xml:"Tag"`
+				}
+			}
+			Expiration *struct {
+				Days                      int
+				Date                      string
+				ExpiredObjectDeleteMarker bool
+			}
+		} `xml:"Rule"`
+	}
+	if err := xml.Unmarshal(body, &configuration); err != nil || len(configuration.Rules) == 0 {
+		return "MalformedXML", "The XML you provided was not well-formed."
+	}
+	for _, rule := range configuration.Rules {
+		if rule.Expiration == nil || !rule.Expiration.ExpiredObjectDeleteMarker {
+			continue
+		}
+		if rule.Expiration.Days != 0 || rule.Expiration.Date != "" {
+			return "MalformedXML", "The XML you provided was not well-formed."
+		}
+		if rule.Filter.Tag != nil || (rule.Filter.And != nil && len(rule.Filter.And.Tags) > 0) {
+			return "InvalidRequest", "ExpiredObjectDeleteMarker cannot be specified with object tags."
+		}
+	}
+	return "", ""
+}
+
+// listObjectVersions lists all versions and delete markers under the prefix in a single page.
+func (s *Server) listObjectVersions(w http.ResponseWriter, r *http.Request, bucket string, query url.Values) {
+	prefix := query.Get("prefix")
+	keys := make([]string, 0)
+	history := s.versions[bucket]
+	if history == nil {
+		// Objects of unversioned buckets are listed with the null version
+		history = make(map[string][]*Object)
+		for key, object := range s.buckets[bucket] {
+			history[key] = []*Object{object}
+		}
+	}
+	for key := range history {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type version struct {
+		Key          string
+		VersionId    string
+		IsLatest     bool
+		LastModified string
+		ETag         string `xml:",omitempty"`
+		Size         int
+	}
+	result := struct {
+		XMLName       xml.Name `xml:"ListVersionsResult"`
+		Name          string
+		Prefix        string
+		MaxKeys       int
+		IsTruncated   bool
+		Versions      []version `xml:"Version"`
+		DeleteMarkers []version `xml:"DeleteMarker"`
+	}{Name: bucket, Prefix: prefix, MaxKeys: 1000}
+	for _, key := range keys {
+		versions := history[key]
+		// Like S3, versions are listed newest first
+		for i := len(versions) - 1; i >= 0; i-- {
+			object := versions[i]
+			versionId := object.VersionId
+			if versionId == "" {
+				versionId = "null"
+			}
+			entry := version{Key: key, VersionId: versionId, IsLatest: i == len(versions)-1, LastModified: object.LastModified.Format(time.RFC3339)}
+			if object.deleteMarker {
+				result.DeleteMarkers = append(result.DeleteMarkers, entry)
+				continue
+			}
+			entry.ETag = object.ETag
+			entry.Size = len(object.Body)
+			result.Versions = append(result.Versions, entry)
+		}
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+// put stores object as the current version of the key. The caller must hold the lock.
+func (s *Server) put(bucket, key string, object *Object) *Object {
+	if history, ok := s.versions[bucket]; ok {
+		s.nextId++
+		object.VersionId = fmt.Sprintf("version-%d", s.nextId)
+		history[key] = append(history[key], object)
+	}
+	s.buckets[bucket][key] = object
+	return object
+}
+
+// version returns the given version of the key. The caller must hold the lock.
+func (s *Server) version(bucket, key, versionId string) (*Object, bool) {
+	for _, object := range s.versions[bucket][key] {
+		if object.VersionId == versionId {
+			return object, true
+		}
+	}
+	if object, ok := s.buckets[bucket][key]; ok && versionId == "null" && object.VersionId == "" {
+		return object, true
+	}
+	return nil, false
+}
+
+// delete deletes a version of the key, or the key itself when versionId is empty. On versioned buckets deleting the key
+// adds a delete marker, which is returned, and deleting a version returns the deleted version. The caller must hold
+// the lock.
+func (s *Server) delete(bucket, key, versionId string) *Object {
+	history, versioned := s.versions[bucket]
+	if !versioned {
+		if versionId == "" || versionId == "null" {
+			delete(s.buckets[bucket], key)
+		}
+		return nil
+	}
+	if versionId == "" {
+		s.nextId++
+		marker := &Object{VersionId: fmt.Sprintf("version-%d", s.nextId), LastModified: time.Now().UTC().Truncate(time.Second), deleteMarker: true}
+		history[key] = append(history[key], marker)
+		delete(s.buckets[bucket], key)
+		return marker
+	}
+
+	var deleted *Object
+	versions := history[key][:0]
+	for _, object := range history[key] {
+		if object.VersionId == versionId {
+			deleted = object
+			continue
+		}
+		versions = append(versions, object)
+	}
+	if len(versions) == 0 {
+		delete(history, key)
+		delete(s.buckets[bucket], key)
+		return deleted
+	}
+	history[key] = versions
+	if latest := versions[len(versions)-1]; latest.deleteMarker {
+		delete(s.buckets[bucket], key)
+	} else {
+		s.buckets[bucket][key] = latest
+	}
+	return deleted
+}
+
+// checkWriteConditions verifies the If-None-Match and If-Match headers of a write against the current object, which is
+// nil when the key does not exist. It writes the error response and returns false when a condition fails.
+func checkWriteConditions(w http.ResponseWriter, r *http.Request, current *Object) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if ifNoneMatch != "*" {
+			writeError(w, r, http.StatusNotImplemented, "NotImplemented", "If-None-Match only supports '*'.")
+			return false
+		}
+		if current != nil {
+			writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold.")
+			return false
+		}
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if current == nil {
+			writeError(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return false
+		}
+		if ifMatch != "*" && ifMatch != current.ETag {
+			writeError(w, r, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold.")
+			return false
+		}
+	}
+	return true
+}
+
+// signatureMatches reports whether the SigV4 signature of r is the one the s3test credentials give for the headers it
+// signed.
+func signatureMatches(r *http.Request) bool {
+	authorization := r.Header.Get("Authorization")
+	var signedHeaders []string
+	for _, field := range strings.Split(strings.TrimPrefix(authorization, "AWS4-HMAC-SHA256 "), ",") {
+		if value := strings.TrimPrefix(strings.TrimSpace(field), "SignedHeaders="); value != strings.TrimSpace(field) {
+			signedHeaders = strings.Split(value, ";")
+		}
+	}
+	signingTime, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil || len(signedHeaders) == 0 {
+		return false
+	}
+
+	// Sign a copy of r holding only the signed headers, the transport adds headers after signing
+	signed := r.Clone(r.Context())
+	signed.Header = make(http.Header)
+	for _, name := range signedHeaders {
+		if values, ok := r.Header[http.CanonicalHeaderKey(name)]; ok {
+			signed.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	credentials := aws.Credentials{AccessKeyID: AccessKeyId, SecretAccessKey: SecretAccessKey}
+	err = v4.NewSigner().SignHTTP(r.Context(), credentials, signed, r.Header.Get("X-Amz-Content-Sha256"), "s3", Region, signingTime, func(o *v4.SignerOptions) {
+		o.DisableURIPathEscaping = true
+	})
+	return err == nil && signed.Header.Get("Authorization") == authorization
+}
+
+func newObject(body []byte, header http.Header) *Object {
+	header.Del("Authorization")
+	return &Object{Body: body, ETag: etag(body), LastModified: time.Now().UTC().Truncate(time.Second), Header: header}
+}
+
+// persistedHeaders are the request headers S3 stores with an object and returns when it is read.
+var persistedHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Type",
+	"X-Amz-Server-Side-Encryption",
+	"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id",
+	"X-Amz-Storage-Class",
+}
+
+func writeObject(w http.ResponseWriter, r *http.Request, object *Object) {
+	header := w.Header()
+	for _, name := range persistedHeaders {
+		if value := object.Header.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	for name, values := range object.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			header[name] = values
+		}
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "binary/octet-stream")
+	}
+	header.Set("ETag", object.ETag)
+	if object.VersionId != "" {
+		header.Set("X-Amz-Version-Id", object.VersionId)
+	}
+	header.Set("Last-Modified", object.LastModified.Format(http.TimeFormat))
+	header.Set("Content-Length", strconv.Itoa(len(object.Body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(object.Body)
+	}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if r.Method == http.MethodHead {
+		// Like S3, error responses to HEAD requests have no body
+		w.WriteHeader(status)
+		return
+	}
+	writeXML(w, status, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: code, Message: message, Resource: r.URL.Path})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	bytes, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(bytes)
+}
+
+func splitPath(path string) (string, string) {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+func operationName(r *http.Request) string {
+	query := r.URL.Query()
+	if id := query.Get("x-id"); id != "" {
+		return id
+	}
+	if _, key := splitPath(r.URL.Path); key == "" && bucketSubresource(query) != "" {
+		names := map[string]string{
+			"lifecycle":         "BucketLifecycleConfiguration",
+			"encryption":        "BucketEncryption",
+			"publicAccessBlock": "PublicAccessBlock",
+		}
+		name := names[bucketSubresource(query)]
+		switch r.Method {
+		case http.MethodPut:
+			return "Put" + name
+		case http.MethodGet:
+			return "Get" + name
+		case http.MethodDelete:
+			return "Delete" + strings.TrimSuffix(name, "Configuration")
+		}
+	}
+	switch r.Method {
+	case http.MethodHead:
+		if _, key := splitPath(r.URL.Path); key == "" {
+			return "HeadBucket"
+		}
+		return "HeadObject"
+	case http.MethodPost:
+		if query["uploads"] != nil {
+			return "CreateMultipartUpload"
+		}
+	case http.MethodGet:
+		if query["versions"] != nil {
+			return "ListObjectVersions"
+		}
+	}
+	return r.Method
+}
+
+func etag(body []byte) string {
+	sum := md5.Sum(body)
+	return "\"" + hex.EncodeToString(sum[:]) + "\""
+}
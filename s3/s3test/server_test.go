@@ -0,0 +1,258 @@
+package s3test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	s3BucketName = "test-bucket-name"
+	anyS3Key     = "some/nested/AnyS3key"
+	anyPayload   = "AnyPayload"
+)
+
+func TestPutGetHeadDeleteObject(t *testing.T) {
+	server := NewServer(s3BucketName)
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s3BucketName),
+		Key:         aws.String(anyS3Key),
+		Body:        strings.NewReader(anyPayload),
+		ContentType: aws.String("text/plain"),
+		Metadata:    map[string]string{"origin": "test"},
+	})
+	assert.NoError(t, err)
+
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key)})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(anyPayload)), head.ContentLength)
+	assert.Equal(t, "text/plain", *head.ContentType)
+	assert.Equal(t, "test", head.Metadata["origin"])
+
+	object, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key)})
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(object.Body)
+	assert.Equal(t, anyPayload, string(body))
+
+	_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key)})
+	assert.NoError(t, err)
+	assert.Empty(t, server.Keys(s3BucketName))
+	assert.Equal(t, []string{"PutObject", "HeadObject", "GetObject", "DeleteObject"}, server.Operations())
+}
+
+func TestGetMissingObject(t *testing.T) {
+	server := NewServer(s3BucketName)
+	defer server.Close()
+
+	_, err := server.Client().GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key)})
+
+	var noSuchKey *types.NoSuchKey
+	assert.True(t, errors.As(err, &noSuchKey))
+}
+
+func TestUnknownBucket(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+
+	_, err := server.Client().PutObject(context.Background(), &s3.PutObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key), Body: strings.NewReader(anyPayload)})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "NoSuchBucket")
+}
+
+func TestRejectsUnsignedRequests(t *testing.T) {
+	server := NewServer(s3BucketName)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/" + s3BucketName + "/" + anyS3Key)
+	assert.NoError(t, err)
+	response.Body.Close()
+
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+}
+
+// tamperingTransport changes the key of each request after it has been signed
+type tamperingTransport struct {
+	http.RoundTripper
+}
+
+func (tt tamperingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Path += "-tampered"
+	r.URL.RawPath = ""
+	return tt.RoundTripper.RoundTrip(r)
+}
+
+func TestVerifiesSignatures(t *testing.T) {
+	server := NewServer(s3BucketName)
+	defer server.Close()
+	ctx := context.Background()
+	putObjectInput := &s3.PutObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key), Body: strings.NewReader(anyPayload)}
+
+	wrongSecret := server.Client(func(o *s3.Options) {
+		o.Credentials = aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: AccessKeyId, SecretAccessKey: "wrong-secret-access-key"}, nil
+		})
+	})
+	_, err := wrongSecret.PutObject(ctx, putObjectInput)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "SignatureDoesNotMatch")
+
+	tampering := server.Client(func(o *s3.Options) {
+		o.HTTPClient = &http.Client{Transport: tamperingTransport{server.httpServer.Client().Transport}}
+	})
+	putObjectInput.Body = strings.NewReader(anyPayload)
+	_, err = tampering.PutObject(ctx, putObjectInput)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "SignatureDoesNotMatch")
+
+	putObjectInput.Body = strings.NewReader(anyPayload)
+	_, err = server.Client().PutObject(ctx, putObjectInput)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{anyS3Key}, server.Keys(s3BucketName))
+}
+
+func TestMultipartUpload(t *testing.T) {
+	server := NewServer(s3BucketName)
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	created, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               aws.String(s3BucketName),
+		Key:                  aws.String(anyS3Key),
+		ServerSideEncryption: types.ServerSideEncryptionAwsKms,
+	})
+	assert.NoError(t, err)
+
+	parts := [][]byte{bytes.Repeat([]byte("a"), 5*1024*1024), []byte("tail")}
+	var completed []types.CompletedPart
+	for i, part := range parts {
+		uploaded, err := client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(s3BucketName),
+			Key:        aws.String(anyS3Key),
+			UploadId:   created.UploadId,
+			PartNumber: int32(i + 1),
+			Body:       bytes.NewReader(part),
+		})
+		assert.NoError(t, err)
+		completed = append(completed, types.CompletedPart{ETag: uploaded.ETag, PartNumber: int32(i + 1)})
+	}
+
+	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s3BucketName),
+		Key:             aws.String(anyS3Key),
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	assert.NoError(t, err)
+
+	object, ok := server.Object(s3BucketName, anyS3Key)
+	assert.True(t, ok)
+	assert.Equal(t, append(parts[0], parts[1]...), object.Body)
+	assert.True(t, strings.HasSuffix(object.ETag, "-2\""))
+	assert.Equal(t, string(types.ServerSideEncryptionAwsKms), object.Header.Get("X-Amz-Server-Side-Encryption"))
+}
+
+func TestAbortMultipartUpload(t *testing.T) {
+	server := NewServer(s3BucketName)
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	created, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key)})
+	assert.NoError(t, err)
+	_, err = client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key), UploadId: created.UploadId})
+	assert.NoError(t, err)
+
+	_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s3BucketName),
+		Key:             aws.String(anyS3Key),
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: []types.CompletedPart{{ETag: aws.String("\"x\""), PartNumber: 1}}},
+	})
+	assert.Error(t, err)
+	assert.Empty(t, server.Keys(s3BucketName))
+}
+
+func TestListObjectsV2Pagination(t *testing.T) {
+	server := NewServer(s3BucketName)
+	defer server.Close()
+	client := server.Client()
+	ctx := context.Background()
+
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1"} {
+		_, err := client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String(key), Body: strings.NewReader(anyPayload)})
+		assert.NoError(t, err)
+	}
+
+	first, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(s3BucketName), Prefix: aws.String("a/"), MaxKeys: 2})
+	assert.NoError(t, err)
+	assert.True(t, first.IsTruncated)
+	assert.Len(t, first.Contents, 2)
+
+	second, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(s3BucketName), Prefix: aws.String("a/"), MaxKeys: 2, ContinuationToken: first.NextContinuationToken})
+	assert.NoError(t, err)
+	assert.False(t, second.IsTruncated)
+	assert.Len(t, second.Contents, 1)
+	assert.Equal(t, "a/3", *second.Contents[0].Key)
+	assert.Equal(t, int64(len(anyPayload)), second.Contents[0].Size)
+}
+
+func TestVersioning(t *testing.T) {
+	server := NewServer(s3BucketName)
+	defer server.Close()
+	server.EnableVersioning(s3BucketName)
+	client := server.Client()
+	ctx := context.Background()
+
+	first, err := client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key), Body: strings.NewReader("first")})
+	assert.NoError(t, err)
+	second, err := client.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key), Body: strings.NewReader("second")})
+	assert.NoError(t, err)
+	assert.NotEqual(t, aws.ToString(first.VersionId), aws.ToString(second.VersionId))
+
+	object, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key), VersionId: first.VersionId})
+	assert.NoError(t, err)
+	body, _ := ioutil.ReadAll(object.Body)
+	assert.Equal(t, "first", string(body))
+	assert.Equal(t, aws.ToString(first.VersionId), aws.ToString(object.VersionId))
+
+	deleted, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key)})
+	assert.NoError(t, err)
+	assert.True(t, deleted.DeleteMarker)
+	assert.Empty(t, server.Keys(s3BucketName))
+	_, err = client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key), VersionId: second.VersionId})
+	assert.NoError(t, err)
+
+	versions, err := client.ListObjectVersions(ctx, &s3.ListObjectVersionsInput{Bucket: aws.String(s3BucketName), Prefix: aws.String(anyS3Key)})
+	assert.NoError(t, err)
+	assert.Len(t, versions.Versions, 2)
+	assert.Len(t, versions.DeleteMarkers, 1)
+	assert.True(t, versions.DeleteMarkers[0].IsLatest)
+
+	// Deleting the delete marker restores the latest version
+	_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key), VersionId: deleted.VersionId})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{anyS3Key}, server.Keys(s3BucketName))
+	current, _ := server.Object(s3BucketName, anyS3Key)
+	assert.Equal(t, "second", string(current.Body))
+	assert.Equal(t, []string{aws.ToString(first.VersionId), aws.ToString(second.VersionId)}, server.Versions(s3BucketName, anyS3Key))
+
+	_, err = client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String(anyS3Key), VersionId: aws.String("missing")})
+	var responseError interface{ HTTPStatusCode() int }
+	assert.True(t, errors.As(err, &responseError))
+	assert.Equal(t, http.StatusNotFound, responseError.HTTPStatusCode())
+}
@@ -1,7 +1,41 @@
 package util
 
-import "runtime"
+import (
+	"runtime"
+	"sync"
+)
 
 func GetUserAgentHeader(clientName string) string {
 	return clientName + "/" + runtime.Version()
 }
+
+// RunConcurrently calls fn for every index in [0, n) on at most concurrency goroutines and returns the errors indexed
+// like the calls. A concurrency below 1 runs the calls one at a time.
+func RunConcurrently(n, concurrency int, fn func(i int) error) []error {
+	errs := make([]error, n)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > n {
+		concurrency = n
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return errs
+}